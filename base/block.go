@@ -0,0 +1,213 @@
+// Copyright 2025 The QuellDB Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be found in
+// the LICENSE file.
+
+// blocks of the block-based SSStorage format
+package base
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"strings"
+
+	"github.com/quellington/quelldb/utils"
+)
+
+// block types, recorded in the block trailer
+const (
+	blockTypeNone byte = iota
+	blockTypeSnappy
+	blockTypeZstd
+	blockTypeLZ4
+)
+
+// blockTrailerLen is the size of the type byte and checksum ending a block.
+const blockTrailerLen = 5
+
+var blockCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// blockHandle locates a data block and names the last key it holds.
+type blockHandle struct {
+	lastKey string
+	offset  uint64
+	size    uint64
+}
+
+// appendRecord adds a record to a block as [kind][len][key][len][value].
+// Merge operands are stored as the record value.
+func appendRecord(buf *bytes.Buffer, key string, entry Entry) {
+	value := []byte(entry.Value)
+	if entry.Kind == KindMerge {
+		value = EncodeOperands(entry.Operands)
+	}
+	buf.WriteByte(entry.Kind)
+	putBlockUvarint(buf, uint64(len(key)))
+	buf.WriteString(key)
+	putBlockUvarint(buf, uint64(len(value)))
+	buf.Write(value)
+}
+
+func putBlockUvarint(buf *bytes.Buffer, v uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	buf.Write(tmp[:binary.PutUvarint(tmp[:], v)])
+}
+
+// readBlockBytes reads a length prefixed byte string of a block.
+func readBlockBytes(r *bytes.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(r.Len()) {
+		return nil, fmt.Errorf("invalid SSStorage block: length %d out of range", n)
+	}
+	b := make([]byte, n)
+	r.Read(b)
+	return b, nil
+}
+
+// nextRecord reads the record at the reader position of a block.
+func nextRecord(r *bytes.Reader) (string, Entry, error) {
+	kind, err := r.ReadByte()
+	if err != nil {
+		return "", Entry{}, err
+	}
+	key, err := readBlockBytes(r)
+	if err != nil {
+		return "", Entry{}, err
+	}
+	value, err := readBlockBytes(r)
+	if err != nil {
+		return "", Entry{}, err
+	}
+
+	entry := Entry{Kind: kind}
+	if kind == KindMerge {
+		entry.Operands, err = DecodeOperands(value)
+		if err != nil {
+			return "", Entry{}, err
+		}
+	} else {
+		entry.Value = string(value)
+	}
+	return string(key), entry, nil
+}
+
+// blockGet looks the key up in a decoded block. The records are sorted, so
+// the scan stops at the first larger key.
+func blockGet(block []byte, key string) (Entry, bool, error) {
+	r := bytes.NewReader(block)
+	for r.Len() > 0 {
+		k, entry, err := nextRecord(r)
+		if err != nil {
+			return Entry{}, false, err
+		}
+		if k == key {
+			return entry, true, nil
+		}
+		if k > key {
+			break
+		}
+	}
+	return Entry{}, false, nil
+}
+
+// blockEntries adds the records of a decoded block whose key starts with
+// prefix to result.
+func blockEntries(block []byte, prefix string, result map[string]Entry) error {
+	r := bytes.NewReader(block)
+	for r.Len() > 0 {
+		k, entry, err := nextRecord(r)
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(k, prefix) {
+			result[k] = entry
+		}
+	}
+	return nil
+}
+
+// encodeBlock compresses a block with codec c, encrypts it when a key is
+// given and appends the trailer: the block type naming the codec and a
+// CRC-32C of the stored bytes and type.
+func encodeBlock(plain []byte, key []byte, c Compression, level int) ([]byte, error) {
+	data, typ, err := compressBlock(plain, c, level)
+	if err != nil {
+		return nil, err
+	}
+	if key != nil {
+		data, err = utils.Encrypt(data, key)
+		if err != nil {
+			return nil, err
+		}
+	} else if typ == blockTypeNone {
+		// the trailer must not be appended to the caller's plain block
+		data = append([]byte(nil), data...)
+	}
+	data = append(data, typ)
+	return binary.LittleEndian.AppendUint32(data, crc32.Checksum(data, blockCRCTable)), nil
+}
+
+// decodeBlock verifies the trailer of a stored block and returns its
+// decrypted, decompressed contents.
+func decodeBlock(stored []byte, key []byte) ([]byte, error) {
+	if len(stored) < blockTrailerLen {
+		return nil, fmt.Errorf("invalid SSStorage block: %d bytes", len(stored))
+	}
+	body := stored[:len(stored)-4]
+	if crc32.Checksum(body, blockCRCTable) != binary.LittleEndian.Uint32(stored[len(stored)-4:]) {
+		return nil, fmt.Errorf("invalid SSStorage block: checksum mismatch")
+	}
+	typ := body[len(body)-1]
+	data := body[:len(body)-1]
+
+	if key != nil {
+		var err error
+		data, err = utils.Decrypt(data, key)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return decompressBlock(data, typ)
+}
+
+// encodeIndex serializes the block handles of a table.
+func encodeIndex(handles []blockHandle) []byte {
+	var buf bytes.Buffer
+	for _, h := range handles {
+		putBlockUvarint(&buf, uint64(len(h.lastKey)))
+		buf.WriteString(h.lastKey)
+		putBlockUvarint(&buf, h.offset)
+		putBlockUvarint(&buf, h.size)
+	}
+	return buf.Bytes()
+}
+
+// decodeIndex reverses encodeIndex, checking every handle against the end
+// of the data blocks.
+func decodeIndex(data []byte, dataEnd uint64) ([]blockHandle, error) {
+	r := bytes.NewReader(data)
+	var handles []blockHandle
+	for r.Len() > 0 {
+		lastKey, err := readBlockBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		offset, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		size, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		if offset > dataEnd || size > dataEnd-offset {
+			return nil, fmt.Errorf("invalid SSStorage format: block at %d out of range", offset)
+		}
+		handles = append(handles, blockHandle{lastKey: string(lastKey), offset: offset, size: size})
+	}
+	return handles, nil
+}
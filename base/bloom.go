@@ -7,45 +7,160 @@ package base
 import (
 	"crypto/sha256"
 	"encoding/binary"
-	"os"
+	"fmt"
+	"math"
+
+	"github.com/quellington/quelldb/vfs"
+)
+
+// filter formats, recorded in the filter header
+const (
+	// filterFormatSHA256 Bloom filters take up to 8 probes out of the
+	// SHA-256 digest of a key. They were written without a header or
+	// behind a BLOOM_FILTER_MAGIC header and are only read.
+	filterFormatSHA256 uint8 = 2
+	// filterFormatBlocked Bloom filters keep every probe of a key within
+	// one cache line, derived from a 64-bit hash by double hashing.
+	filterFormatBlocked uint8 = 3
 )
 
+// filterHeaderLen is the size of the filter header:
+// [magic][format][hash count][size].
+const filterHeaderLen = 10
+
+// bloomHeaderLenV2 is the size of the BLOOM_FILTER_MAGIC header:
+// [magic][size][hash count].
+const bloomHeaderLenV2 = 9
+
+// bloomLineBits is the number of bits of a cache line of a blocked filter.
+const bloomLineBits = 512
+
+// maxBloomHashCount bounds the probes per key, more only cost lookup time.
+const maxBloomHashCount = 30
+
+// maxSHA256HashCount is the number of probes one SHA-256 digest yields.
+const maxSHA256HashCount = 8
+
 type BloomFilter struct {
-	bits []byte
-	size uint32
-	k    uint8
+	bits   []byte
+	size   uint32
+	k      uint8
+	format uint8
 }
 
-// NewBloomFilter creates a new Bloom filter with the specified size and number of hash functions.
-// The size is the number of bits in the filter, and k is the number of hash functions to use.
-// The size should be a multiple of 8, as the bits are stored in bytes.
+// ApplyNewBloomFilter creates a new Bloom filter with the specified size and number of hash functions.
+// The size is the number of bits in the filter, rounded up to whole 512-bit
+// cache lines, and k is the number of hash functions to use.
 // The filter is initialized with all bits set to 0.
-// The filter uses SHA-256 to generate the hash values for the keys.
+// Every key sets k bits of a single cache line, picked by a 64-bit hash of
+// the key, so a lookup costs a single memory miss.
 func ApplyNewBloomFilter(size uint32, hashCount uint8) *BloomFilter {
+	lines := (uint64(size) + bloomLineBits - 1) / bloomLineBits
+	if lines == 0 {
+		lines = 1
+	}
+	size = uint32(lines * bloomLineBits)
 	return &BloomFilter{
-		bits: make([]byte, size/8+1),
-		size: size,
-		k:    hashCount,
+		bits:   make([]byte, size/8),
+		size:   size,
+		k:      hashCount,
+		format: filterFormatBlocked,
 	}
 }
 
+// newSHA256BloomFilter creates a filter of the format written before
+// blocked filters, to load one.
+func newSHA256BloomFilter(size uint32, hashCount uint8) *BloomFilter {
+	return &BloomFilter{
+		bits:   make([]byte, size/8+1),
+		size:   size,
+		k:      hashCount,
+		format: filterFormatSHA256,
+	}
+}
+
+// NewBloomFilterForKeys creates a Bloom filter for n keys with bitsPerKey
+// bits each, using the number of hash functions that minimizes the false
+// positive rate, ln(2) * bitsPerKey.
+func NewBloomFilterForKeys(n int, bitsPerKey float64) *BloomFilter {
+	return ApplyNewBloomFilter(uint32(math.Ceil(float64(n)*bitsPerKey)), bloomHashCount(bitsPerKey))
+}
+
+// bloomHashCount returns the number of hash functions for bitsPerKey.
+func bloomHashCount(bitsPerKey float64) uint8 {
+	k := math.Round(bitsPerKey * math.Ln2)
+	if k < 1 {
+		return 1
+	}
+	if k > maxBloomHashCount {
+		return maxBloomHashCount
+	}
+	return uint8(k)
+}
+
+// BloomBitsPerKey returns the bits per key a Bloom filter needs for the
+// false positive rate fpr, -ln(fpr) / ln(2)^2.
+func BloomBitsPerKey(fpr float64) float64 {
+	return -math.Log(fpr) / (math.Ln2 * math.Ln2)
+}
+
+// Size returns the number of bits of the filter.
+func (bf *BloomFilter) Size() uint32 {
+	return bf.size
+}
+
+// HashCount returns the number of hash functions of the filter.
+func (bf *BloomFilter) HashCount() uint8 {
+	return bf.k
+}
+
 func (bf *BloomFilter) Add(key string) {
-	hashes := bf.getHashes(key)
-	for _, h := range hashes {
-		bf.setBit(h % bf.size)
+	if bf.format == filterFormatSHA256 {
+		for _, h := range bf.getHashes(key) {
+			bf.setBit(h % bf.size)
+		}
+		return
+	}
+	line, h, delta := bf.probes(key)
+	for i := uint8(0); i < bf.k; i++ {
+		bf.setBit(line + h%bloomLineBits)
+		h += delta
 	}
 }
 
 func (bf *BloomFilter) Test(key string) bool {
-	hashes := bf.getHashes(key)
-	for _, h := range hashes {
-		if !bf.getBit(h % bf.size) {
+	if bf.format == filterFormatSHA256 {
+		for _, h := range bf.getHashes(key) {
+			if !bf.getBit(h % bf.size) {
+				return false
+			}
+		}
+		return true
+	}
+	line, h, delta := bf.probes(key)
+	for i := uint8(0); i < bf.k; i++ {
+		if !bf.getBit(line + h%bloomLineBits) {
 			return false
 		}
+		h += delta
 	}
 	return true
 }
 
+// probes returns the first bit of the cache line of a key and the two
+// hashes of its probes, probe i testing bit h1 + i*h2 of the line
+// (Kirsch–Mitzenmacher double hashing). The upper half of the 64-bit hash
+// picks the line, the lower half the bits within it.
+func (bf *BloomFilter) probes(key string) (line, h1, h2 uint32) {
+	h := hash64(key)
+	lines := uint64(bf.size / bloomLineBits)
+	line = uint32((h>>32)*lines>>32) * bloomLineBits
+	h1 = uint32(h)
+	// an odd step visits every bit of the line before repeating one
+	h2 = (h1>>17 | h1<<15) | 1
+	return line, h1, h2
+}
+
 func (bf *BloomFilter) getHashes(key string) []uint32 {
 	h := sha256.Sum256([]byte(key))
 	hashes := make([]uint32, bf.k)
@@ -56,6 +171,35 @@ func (bf *BloomFilter) getHashes(key string) []uint32 {
 	return hashes
 }
 
+// hash64 is MurmurHash64A of the key, a fast non-cryptographic hash.
+func hash64(key string) uint64 {
+	const m = 0xc6a4a7935bd1e995
+	const r = 47
+	h := uint64(0x8445d61a4e774912) ^ uint64(len(key))*m
+
+	for ; len(key) >= 8; key = key[8:] {
+		k := uint64(key[0]) | uint64(key[1])<<8 | uint64(key[2])<<16 | uint64(key[3])<<24 |
+			uint64(key[4])<<32 | uint64(key[5])<<40 | uint64(key[6])<<48 | uint64(key[7])<<56
+		k *= m
+		k ^= k >> r
+		k *= m
+		h ^= k
+		h *= m
+	}
+
+	if len(key) > 0 {
+		for i := len(key) - 1; i >= 0; i-- {
+			h ^= uint64(key[i]) << (8 * i)
+		}
+		h *= m
+	}
+
+	h ^= h >> r
+	h *= m
+	h ^= h >> r
+	return h
+}
+
 func (bf *BloomFilter) setBit(pos uint32) {
 	byteIndex := pos / 8
 	bit := pos % 8
@@ -76,18 +220,20 @@ func (bf *BloomFilter) Load(data []byte) {
 	copy(bf.bits, data)
 }
 
-func saveBloomFilter(filter *BloomFilter, path string) error {
-	return os.WriteFile(path, filter.Bytes(), 0644)
-}
-
+// LoadBloomFilter reads the Bloom filter at path with the format, size and
+// number of hash functions recorded in its header. Filters written before
+// the header are read with the given size and number of hash functions,
+// BOOM_BIT_SIZE and BOOM_HASH_COUNT when zero.
+// Filters built by other policies are read with LoadFilter.
+//
 // Parameters:
-// path: The path to the file where the Bloom filter will be saved.
-// size: The size of the Bloom filter in bits.
-// hashCount: The number of hash functions to use.
+// path: The path to the file the Bloom filter was saved to.
+// size: The size in bits of a filter written without a header.
+// hashCount: The number of hash functions of a filter written without a header.
 //
 // Returns:
 // A pointer to the BloomFilter object.
-// An error if the file could not be saved.
+// An error if the file could not be read.
 //
 // Definition:
 // Metric | Recommended Values
@@ -100,11 +246,34 @@ func saveBloomFilter(filter *BloomFilter, path string) error {
 //
 // k (hash functions) | ≈ (m / n) * ln(2)
 func LoadBloomFilter(path string, size uint32, hashCount uint8) (*BloomFilter, error) {
-	data, err := os.ReadFile(path)
+	return LoadBloomFilterFS(vfs.Default, path, size, hashCount)
+}
+
+// LoadBloomFilterFS is LoadBloomFilter on the given file system.
+func LoadBloomFilterFS(fs vfs.FS, path string, size uint32, hashCount uint8) (*BloomFilter, error) {
+	data, err := vfs.ReadFile(fs, path)
 	if err != nil {
 		return nil, err
 	}
-	filter := ApplyNewBloomFilter(size, hashCount)
-	filter.Load(data)
-	return filter, nil
+	sections, ok, err := readFilterSections(path, data)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return decodeBloomFilter(path, data, size, hashCount)
+	}
+	for _, s := range sections {
+		if s.kind != filterSectionKeys {
+			continue
+		}
+		if s.policy != (BloomFilterPolicy{}).Name() {
+			return nil, fmt.Errorf("filter %s: built by %q, not a bloom filter", path, s.policy)
+		}
+		bf, ok := bloomFromPolicyData(s.data)
+		if !ok {
+			return nil, fmt.Errorf("invalid bloom filter %s", path)
+		}
+		return bf, nil
+	}
+	return nil, fmt.Errorf("filter %s: no key filter", path)
 }
@@ -0,0 +1,208 @@
+// Copyright 2025 The QuellDB Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be found in
+// the LICENSE file.
+
+// compression codecs of SSStorage blocks
+package base
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/quellington/quelldb/constants"
+)
+
+// Compression selects the codec compressing the blocks of an SSStorage file.
+// The codec is recorded in the trailer of every block, so files written with
+// different codecs are read side by side.
+type Compression uint8
+
+const (
+	// DefaultCompression leaves the choice to the writer, Snappy unless
+	// configured otherwise.
+	DefaultCompression Compression = iota
+	// NoCompression stores blocks as they are.
+	NoCompression
+	// SnappyCompression compresses blocks with Snappy.
+	SnappyCompression
+	// ZstdCompression compresses blocks with Zstandard at the configured level.
+	ZstdCompression
+	// LZ4Compression compresses blocks with the LZ4 block format.
+	LZ4Compression
+)
+
+// String returns the name of the codec, as recorded in the table properties.
+func (c Compression) String() string {
+	switch c {
+	case DefaultCompression:
+		return "default"
+	case NoCompression:
+		return "none"
+	case SnappyCompression:
+		return "snappy"
+	case ZstdCompression:
+		return "zstd"
+	case LZ4Compression:
+		return "lz4"
+	}
+	return fmt.Sprintf("compression(%d)", uint8(c))
+}
+
+// Valid reports whether c is one of the codecs defined above.
+func (c Compression) Valid() bool {
+	return c <= LZ4Compression
+}
+
+// blockType returns the block type recorded for blocks compressed by c.
+func (c Compression) blockType() byte {
+	switch c {
+	case NoCompression:
+		return blockTypeNone
+	case ZstdCompression:
+		return blockTypeZstd
+	case LZ4Compression:
+		return blockTypeLZ4
+	}
+	return blockTypeSnappy
+}
+
+// compressBlock compresses a plain block with codec c and returns the
+// stored bytes and their block type. Blocks the codec does not shrink are
+// stored uncompressed. Unknown codecs are an error.
+func compressBlock(plain []byte, c Compression, level int) ([]byte, byte, error) {
+	if !c.Valid() {
+		return nil, 0, fmt.Errorf("unknown compression %s", c)
+	}
+	var data []byte
+	typ := c.blockType()
+	switch typ {
+	case blockTypeNone:
+		return plain, blockTypeNone, nil
+	case blockTypeSnappy:
+		data = snappy.Encode(nil, plain)
+	case blockTypeZstd:
+		enc, err := zstdEncoder(level)
+		if err != nil {
+			return nil, 0, err
+		}
+		data = enc.EncodeAll(plain, nil)
+	case blockTypeLZ4:
+		var err error
+		if data, err = lz4Encode(plain); err != nil {
+			return nil, 0, err
+		}
+	}
+	if data == nil || len(data) >= len(plain) {
+		return plain, blockTypeNone, nil
+	}
+	return data, typ, nil
+}
+
+// decompressBlock reverses compressBlock for a block of type typ.
+func decompressBlock(data []byte, typ byte) ([]byte, error) {
+	switch typ {
+	case blockTypeNone:
+		return data, nil
+	case blockTypeSnappy:
+		return snappy.Decode(nil, data)
+	case blockTypeZstd:
+		dec, err := zstdDecoder()
+		if err != nil {
+			return nil, err
+		}
+		return dec.DecodeAll(data, nil)
+	case blockTypeLZ4:
+		return lz4Decode(data)
+	}
+	return nil, fmt.Errorf("invalid SSStorage block: unknown block type %d", typ)
+}
+
+// Compress compresses data the way blocks are compressed and returns the
+// stored bytes together with the codec byte to record next to them, which
+// Decompress takes back. Data the codec does not shrink is stored as it is.
+func Compress(data []byte, c Compression, level int) ([]byte, byte, error) {
+	return compressBlock(data, c, level)
+}
+
+// Decompress reverses Compress for data recorded with the codec byte typ.
+func Decompress(data []byte, typ byte) ([]byte, error) {
+	return decompressBlock(data, typ)
+}
+
+// zstd encoders are safe for concurrent EncodeAll calls, so one is shared
+// per level by every writer.
+var zstdEncoders sync.Map // int -> *zstd.Encoder
+
+// zstdEncoder returns the shared encoder of a zstd level, the default level
+// when zero.
+func zstdEncoder(level int) (*zstd.Encoder, error) {
+	if level == 0 {
+		level = constants.ZSTD_LEVEL_DEFAULT
+	}
+	if enc, ok := zstdEncoders.Load(level); ok {
+		return enc.(*zstd.Encoder), nil
+	}
+	enc, err := zstd.NewWriter(nil,
+		zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)),
+		zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	actual, _ := zstdEncoders.LoadOrStore(level, enc)
+	return actual.(*zstd.Encoder), nil
+}
+
+var (
+	zstdDecoderOnce sync.Once
+	sharedZstd      *zstd.Decoder
+	zstdDecoderErr  error
+)
+
+// zstdDecoder returns the decoder shared by every reader.
+func zstdDecoder() (*zstd.Decoder, error) {
+	zstdDecoderOnce.Do(func() {
+		sharedZstd, zstdDecoderErr = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+	})
+	return sharedZstd, zstdDecoderErr
+}
+
+// lz4Compressors hold LZ4 compressors, reusing their hash tables between
+// blocks.
+var lz4Compressors = sync.Pool{New: func() any { return new(lz4.Compressor) }}
+
+// lz4Encode compresses src into an LZ4 block, prefixed with the uvarint
+// length of src, which the block format does not record itself. It returns
+// nil when src does not compress.
+func lz4Encode(src []byte) ([]byte, error) {
+	dst := make([]byte, binary.MaxVarintLen64+lz4.CompressBlockBound(len(src)))
+	n := binary.PutUvarint(dst, uint64(len(src)))
+	c := lz4Compressors.Get().(*lz4.Compressor)
+	m, err := c.CompressBlock(src, dst[n:])
+	lz4Compressors.Put(c)
+	if err != nil || m == 0 {
+		return nil, err
+	}
+	return dst[:n+m], nil
+}
+
+// lz4Decode decompresses a block written by lz4Encode.
+func lz4Decode(data []byte) ([]byte, error) {
+	size, n := binary.Uvarint(data)
+	// LZ4 expands data at most 255 times
+	if n <= 0 || size > uint64(len(data))*255 {
+		return nil, fmt.Errorf("invalid lz4 block: bad length")
+	}
+	dst := make([]byte, size)
+	m, err := lz4.UncompressBlock(data[n:], dst)
+	if err != nil {
+		return nil, fmt.Errorf("invalid lz4 block: %w", err)
+	}
+	if uint64(m) != size {
+		return nil, fmt.Errorf("invalid lz4 block: %d bytes, want %d", m, size)
+	}
+	return dst, nil
+}
@@ -0,0 +1,66 @@
+// Copyright 2025 The QuellDB Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be found in
+// the LICENSE file.
+
+// typed records shared by the memtable and the SSStorages
+package base
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	KindValue byte = iota
+	KindDelete
+	KindMerge
+)
+
+// Entry is a single record for a key.
+// A value entry holds the plain value, a delete entry is a tombstone that
+// hides older values and a merge entry holds unresolved merge operands,
+// oldest first.
+type Entry struct {
+	Kind     byte
+	Value    string
+	Operands []string
+}
+
+// EncodeOperands serializes merge operands as [count]([len][bytes])...
+func EncodeOperands(operands []string) []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, int32(len(operands)))
+	for _, op := range operands {
+		binary.Write(buf, binary.LittleEndian, int32(len(op)))
+		buf.WriteString(op)
+	}
+	return buf.Bytes()
+}
+
+// DecodeOperands reverses EncodeOperands.
+func DecodeOperands(data []byte) ([]string, error) {
+	buf := bytes.NewReader(data)
+	var count int32
+	if err := binary.Read(buf, binary.LittleEndian, &count); err != nil {
+		return nil, err
+	}
+	if count < 0 || int(count) > len(data) {
+		return nil, fmt.Errorf("invalid merge operand count %d", count)
+	}
+
+	operands := make([]string, 0, count)
+	for i := 0; i < int(count); i++ {
+		var n int32
+		if err := binary.Read(buf, binary.LittleEndian, &n); err != nil {
+			return nil, err
+		}
+		if n < 0 || int(n) > buf.Len() {
+			return nil, fmt.Errorf("invalid merge operand length %d", n)
+		}
+		op := make([]byte, n)
+		buf.Read(op)
+		operands = append(operands, string(op))
+	}
+	return operands, nil
+}
@@ -0,0 +1,348 @@
+// Copyright 2025 The QuellDB Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be found in
+// the LICENSE file.
+
+// filters of sorted string storage files
+package base
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/quellington/quelldb/constants"
+	"github.com/quellington/quelldb/vfs"
+)
+
+// filterFormatPolicy filters hold the data of the FilterPolicy named in
+// their header.
+const filterFormatPolicy uint8 = 4
+
+// filterFormatSections files hold several filters, each named by the
+// policy that built it: the key filter and the prefix filter.
+const filterFormatSections uint8 = 5
+
+// filter section kinds
+const (
+	filterSectionKeys byte = iota
+	filterSectionPrefixes
+)
+
+// FilterPolicy builds the filter of an SSStorage file, which rules out
+// most keys the file does not hold without reading it. The name of the
+// policy is recorded with every filter, so files built by different
+// policies can be read side by side.
+type FilterPolicy interface {
+	// Name identifies the policy. A policy changing its filter data must
+	// change its name too.
+	Name() string
+	// NewWriter returns a writer building the filter of one file.
+	NewWriter() FilterWriter
+	// MayContain reports whether a filter built by the policy may hold
+	// the key. It must never report false for a key that was added.
+	MayContain(filter []byte, key string) bool
+}
+
+// FilterWriter collects the keys of a file and builds its filter.
+type FilterWriter interface {
+	AddKey(key string)
+	Finish() []byte
+}
+
+// builtinFilterPolicies are the policies filters can always be read with.
+var builtinFilterPolicies = []FilterPolicy{BloomFilterPolicy{}, BinaryFuseFilterPolicy{}}
+
+// Filter is the loaded filter of an SSStorage file.
+type Filter struct {
+	policy FilterPolicy
+	data   []byte
+	// bloom holds the filters written before filter policies
+	bloom *BloomFilter
+}
+
+// MayContain reports whether the file may hold the key.
+func (f *Filter) MayContain(key string) bool {
+	if f.bloom != nil {
+		return f.bloom.Test(key)
+	}
+	return f.policy.MayContain(f.data, key)
+}
+
+// PolicyName returns the name of the policy that built the filter.
+func (f *Filter) PolicyName() string {
+	if f.bloom != nil {
+		return BloomFilterPolicy{}.Name()
+	}
+	return f.policy.Name()
+}
+
+// filterSection is a filter of a filter file, built by the named policy
+// over the keys, or over the prefixes taken by the named extractor.
+type filterSection struct {
+	kind      byte
+	policy    string
+	extractor string
+	data      []byte
+}
+
+// Size returns the number of bytes of the filter.
+func (f *Filter) Size() int {
+	if f.bloom != nil {
+		return len(f.bloom.bits)
+	}
+	return len(f.data)
+}
+
+// Bloom returns the Bloom filter of a filter built by BloomFilterPolicy or
+// written before filter policies, false for the filters of other policies.
+func (f *Filter) Bloom() (*BloomFilter, bool) {
+	if f.bloom != nil {
+		return f.bloom, true
+	}
+	if _, ok := f.policy.(BloomFilterPolicy); !ok {
+		return nil, false
+	}
+	return bloomFromPolicyData(f.data)
+}
+
+// saveFilters writes the filters of a file as
+// [magic][format][count] followed by every section as
+// [kind][len][policy][len][extractor][len][filter].
+func saveFilters(fs vfs.FS, path string, sections []filterSection) error {
+	data := append([]byte(constants.FILTER_MAGIC), filterFormatSections, byte(len(sections)))
+	for _, s := range sections {
+		data = append(data, s.kind)
+		for _, field := range [][]byte{[]byte(s.policy), []byte(s.extractor), s.data} {
+			data = binary.AppendUvarint(data, uint64(len(field)))
+			data = append(data, field...)
+		}
+	}
+	return writeSyncedFile(fs, path, data)
+}
+
+// readFilterSections reads the sections of a filter file. Files holding the
+// filter of a single policy read as a key filter section, older files
+// are not read.
+func readFilterSections(path string, data []byte) ([]filterSection, bool, error) {
+	if len(data) < 6 || string(data[:4]) != constants.FILTER_MAGIC {
+		return nil, false, nil
+	}
+	switch data[4] {
+	case filterFormatPolicy:
+		n := int(data[5])
+		if len(data) < 6+n {
+			return nil, false, fmt.Errorf("invalid filter %s: policy name out of range", path)
+		}
+		return []filterSection{{kind: filterSectionKeys, policy: string(data[6 : 6+n]), data: data[6+n:]}}, true, nil
+	case filterFormatSections:
+	default:
+		return nil, false, nil
+	}
+
+	count := int(data[5])
+	data = data[6:]
+	sections := make([]filterSection, 0, count)
+	for i := 0; i < count; i++ {
+		if len(data) == 0 {
+			return nil, false, fmt.Errorf("invalid filter %s: %d of %d sections", path, i, count)
+		}
+		s := filterSection{kind: data[0]}
+		data = data[1:]
+		var fields [3][]byte
+		for j := range fields {
+			n, read := binary.Uvarint(data)
+			if read <= 0 || n > uint64(len(data)-read) {
+				return nil, false, fmt.Errorf("invalid filter %s: section %d out of range", path, i)
+			}
+			fields[j] = data[read : read+int(n)]
+			data = data[read+int(n):]
+		}
+		s.policy, s.extractor, s.data = string(fields[0]), string(fields[1]), fields[2]
+		sections = append(sections, s)
+	}
+	return sections, true, nil
+}
+
+// findFilterPolicy looks a policy up by name among the given and the
+// builtin policies.
+func findFilterPolicy(name string, policies []FilterPolicy) FilterPolicy {
+	for _, p := range append(policies, builtinFilterPolicies...) {
+		if p != nil && p.Name() == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// LoadFilter reads the key filter at path. It is read with the policy
+// named in its header, looked up among the given policies and the builtin
+// ones. Filters written before filter policies are read as Bloom filters.
+func LoadFilter(path string, policies ...FilterPolicy) (*Filter, error) {
+	return LoadFilterFS(vfs.Default, path, policies...)
+}
+
+// LoadFilterFS is LoadFilter on the given file system.
+func LoadFilterFS(fs vfs.FS, path string, policies ...FilterPolicy) (*Filter, error) {
+	keys, _, err := LoadFiltersFS(fs, path, nil, policies...)
+	if err == nil && keys == nil {
+		err = fmt.Errorf("filter %s: no key filter of a known filter policy", path)
+	}
+	return keys, err
+}
+
+// LoadFilters reads the key filter and the prefix filter of the extractor
+// at path, see LoadFilter. A filter the file does not hold, or one built
+// by an unknown policy, is returned as nil.
+func LoadFilters(path string, extractor PrefixExtractor, policies ...FilterPolicy) (*Filter, *Filter, error) {
+	return LoadFiltersFS(vfs.Default, path, extractor, policies...)
+}
+
+// LoadFiltersFS is LoadFilters on the given file system.
+func LoadFiltersFS(fs vfs.FS, path string, extractor PrefixExtractor, policies ...FilterPolicy) (*Filter, *Filter, error) {
+	data, err := vfs.ReadFile(fs, path)
+	if err != nil {
+		return nil, nil, err
+	}
+	sections, ok, err := readFilterSections(path, data)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !ok {
+		bloom, err := decodeBloomFilter(path, data, 0, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &Filter{bloom: bloom}, nil, nil
+	}
+
+	var keys, prefixes *Filter
+	for _, s := range sections {
+		policy := findFilterPolicy(s.policy, policies)
+		if policy == nil {
+			continue
+		}
+		switch {
+		case s.kind == filterSectionKeys && keys == nil:
+			keys = &Filter{policy: policy, data: s.data}
+		case s.kind == filterSectionPrefixes && prefixes == nil &&
+			extractor != nil && s.extractor == extractor.Name():
+			prefixes = &Filter{policy: policy, data: s.data}
+		}
+	}
+	return keys, prefixes, nil
+}
+
+// BloomFilterPolicy builds cache-line blocked Bloom filters, sized by the
+// number of keys of a file.
+type BloomFilterPolicy struct {
+	// BitsPerKey is the number of bits spent per key,
+	// BLOOM_BITS_PER_KEY_DEFAULT when zero.
+	BitsPerKey float64
+	// Bits and HashCount fix the size and the number of hash functions of
+	// every filter when set.
+	Bits      uint32
+	HashCount uint8
+}
+
+// Name implements FilterPolicy.
+func (p BloomFilterPolicy) Name() string {
+	return "quelldb.BloomFilter"
+}
+
+// NewWriter implements FilterPolicy.
+func (p BloomFilterPolicy) NewWriter() FilterWriter {
+	return &bloomFilterWriter{policy: p}
+}
+
+// MayContain implements FilterPolicy. The filter data is
+// [hash count][bits], the bits filling whole cache lines.
+func (p BloomFilterPolicy) MayContain(filter []byte, key string) bool {
+	bf, ok := bloomFromPolicyData(filter)
+	if !ok {
+		// a damaged filter rules nothing out
+		return true
+	}
+	return bf.Test(key)
+}
+
+// bloomFromPolicyData returns the Bloom filter stored as BloomFilterPolicy
+// filter data, sharing its bits.
+func bloomFromPolicyData(filter []byte) (*BloomFilter, bool) {
+	if len(filter) < 1+bloomLineBits/8 || (len(filter)-1)%(bloomLineBits/8) != 0 {
+		return nil, false
+	}
+	k := filter[0]
+	if k == 0 || k > maxBloomHashCount {
+		return nil, false
+	}
+	bits := filter[1:]
+	return &BloomFilter{bits: bits, size: uint32(len(bits) * 8), k: k, format: filterFormatBlocked}, true
+}
+
+type bloomFilterWriter struct {
+	policy BloomFilterPolicy
+	keys   []string
+}
+
+func (w *bloomFilterWriter) AddKey(key string) {
+	w.keys = append(w.keys, key)
+}
+
+func (w *bloomFilterWriter) Finish() []byte {
+	p := w.policy
+	bitsPerKey := p.BitsPerKey
+	if bitsPerKey <= 0 {
+		bitsPerKey = constants.BLOOM_BITS_PER_KEY_DEFAULT
+	}
+	filter := NewBloomFilterForKeys(len(w.keys), bitsPerKey)
+	if p.Bits > 0 {
+		filter = ApplyNewBloomFilter(p.Bits, filter.k)
+	}
+	if p.HashCount > 0 {
+		filter.k = min(p.HashCount, maxBloomHashCount)
+	}
+	for _, key := range w.keys {
+		filter.Add(key)
+	}
+	return append([]byte{filter.k}, filter.bits...)
+}
+
+// decodeBloomFilter reads a Bloom filter of the formats written before
+// filter policies. A filter without a header has legacySize bits and
+// legacyHashCount hash functions, BOOM_BIT_SIZE and BOOM_HASH_COUNT when zero.
+func decodeBloomFilter(path string, data []byte, legacySize uint32, legacyHashCount uint8) (*BloomFilter, error) {
+	switch {
+	case len(data) >= filterHeaderLen && string(data[:4]) == constants.FILTER_MAGIC:
+		format, k := data[4], data[5]
+		size := binary.LittleEndian.Uint32(data[6:])
+		if format != filterFormatBlocked {
+			return nil, fmt.Errorf("invalid bloom filter %s: unknown format %d", path, format)
+		}
+		if k == 0 || k > maxBloomHashCount || size == 0 || size%bloomLineBits != 0 ||
+			len(data)-filterHeaderLen != int(size/8) {
+			return nil, fmt.Errorf("invalid bloom filter %s: %d bits, %d hashes", path, size, k)
+		}
+		filter := ApplyNewBloomFilter(size, k)
+		filter.Load(data[filterHeaderLen:])
+		return filter, nil
+
+	case len(data) >= bloomHeaderLenV2 && string(data[:4]) == constants.BLOOM_FILTER_MAGIC:
+		size := binary.LittleEndian.Uint32(data[4:])
+		k := data[8]
+		if k == 0 || k > maxSHA256HashCount || len(data)-bloomHeaderLenV2 != int(size/8+1) {
+			return nil, fmt.Errorf("invalid bloom filter %s: %d bits, %d hashes", path, size, k)
+		}
+		filter := newSHA256BloomFilter(size, k)
+		filter.Load(data[bloomHeaderLenV2:])
+		return filter, nil
+	}
+
+	if legacySize == 0 {
+		legacySize = constants.BOOM_BIT_SIZE
+	}
+	if legacyHashCount == 0 {
+		legacyHashCount = constants.BOOM_HASH_COUNT
+	}
+	filter := newSHA256BloomFilter(legacySize, min(legacyHashCount, maxSHA256HashCount))
+	filter.Load(data)
+	return filter, nil
+}
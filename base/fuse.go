@@ -0,0 +1,306 @@
+// Copyright 2025 The QuellDB Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be found in
+// the LICENSE file.
+
+// binary fuse filters
+package base
+
+import (
+	"encoding/binary"
+	"math"
+	"math/bits"
+)
+
+// fuseHeaderLen is the size of the header of a binary fuse filter:
+// [seed][segment length][segment count].
+const fuseHeaderLen = 16
+
+// fuseMaxIterations bounds the seeds tried to build a filter. A build
+// failing that often is far less likely than a hardware fault.
+const fuseMaxIterations = 100
+
+// BinaryFuseFilterPolicy builds 3-wise binary fuse filters with 8-bit
+// fingerprints (Graf and Lemire). They take about 9 bits per key for a
+// false positive rate of 0.4%, some 22% less than the 11.5 bits of a Bloom
+// filter of the same rate, at the price of a slower build.
+type BinaryFuseFilterPolicy struct{}
+
+// Name implements FilterPolicy.
+func (BinaryFuseFilterPolicy) Name() string {
+	return "quelldb.BinaryFuse8"
+}
+
+// NewWriter implements FilterPolicy.
+func (BinaryFuseFilterPolicy) NewWriter() FilterWriter {
+	return &fuseFilterWriter{}
+}
+
+// MayContain implements FilterPolicy.
+func (BinaryFuseFilterPolicy) MayContain(filter []byte, key string) bool {
+	f, ok := decodeFuseFilter(filter)
+	if !ok {
+		// a damaged filter rules nothing out
+		return true
+	}
+	hash := fuseMix(hash64(key), f.seed)
+	h0, h1, h2 := f.positions(hash)
+	fp := fuseFingerprint(hash) ^ f.fingerprints[h0] ^ f.fingerprints[h1] ^ f.fingerprints[h2]
+	return fp == 0
+}
+
+type fuseFilterWriter struct {
+	hashes []uint64
+}
+
+func (w *fuseFilterWriter) AddKey(key string) {
+	w.hashes = append(w.hashes, hash64(key))
+}
+
+func (w *fuseFilterWriter) Finish() []byte {
+	f := buildFuseFilter(w.hashes)
+	if f == nil {
+		// an empty filter rules nothing out
+		return nil
+	}
+	data := make([]byte, fuseHeaderLen, fuseHeaderLen+len(f.fingerprints))
+	binary.LittleEndian.PutUint64(data, f.seed)
+	binary.LittleEndian.PutUint32(data[8:], f.segmentLength)
+	binary.LittleEndian.PutUint32(data[12:], f.segmentCount)
+	return append(data, f.fingerprints...)
+}
+
+// fuseFilter is a binary fuse filter: every key maps to three fingerprints
+// in consecutive segments whose XOR is the fingerprint of the key.
+type fuseFilter struct {
+	seed               uint64
+	segmentLength      uint32
+	segmentLengthMask  uint32
+	segmentCount       uint32
+	segmentCountLength uint32
+	fingerprints       []byte
+}
+
+// decodeFuseFilter reads the filter written by fuseFilterWriter, sharing
+// its fingerprints.
+func decodeFuseFilter(data []byte) (*fuseFilter, bool) {
+	if len(data) < fuseHeaderLen {
+		return nil, false
+	}
+	f := &fuseFilter{
+		seed:          binary.LittleEndian.Uint64(data),
+		segmentLength: binary.LittleEndian.Uint32(data[8:]),
+		segmentCount:  binary.LittleEndian.Uint32(data[12:]),
+		fingerprints:  data[fuseHeaderLen:],
+	}
+	if f.segmentLength == 0 || f.segmentLength&(f.segmentLength-1) != 0 ||
+		uint64(len(f.fingerprints)) != (uint64(f.segmentCount)+2)*uint64(f.segmentLength) {
+		return nil, false
+	}
+	f.segmentLengthMask = f.segmentLength - 1
+	f.segmentCountLength = f.segmentCount * f.segmentLength
+	return f, true
+}
+
+// positions returns the three fingerprint positions of a hash.
+func (f *fuseFilter) positions(hash uint64) (uint32, uint32, uint32) {
+	hi, _ := bits.Mul64(hash, uint64(f.segmentCountLength))
+	h0 := uint32(hi)
+	h1 := h0 + f.segmentLength
+	h2 := h1 + f.segmentLength
+	h1 ^= uint32(hash>>18) & f.segmentLengthMask
+	h2 ^= uint32(hash) & f.segmentLengthMask
+	return h0, h1, h2
+}
+
+// initParameters sizes the filter for n keys.
+func (f *fuseFilter) initParameters(n uint32) {
+	f.segmentLength = 4
+	if n > 0 {
+		f.segmentLength = uint32(1) << int(math.Floor(math.Log(float64(n))/math.Log(3.33)+2.25))
+	}
+	if f.segmentLength > 262144 {
+		f.segmentLength = 262144
+	}
+	f.segmentLengthMask = f.segmentLength - 1
+
+	sizeFactor := 1.125
+	if n > 1 {
+		sizeFactor = math.Max(1.125, 0.875+0.25*math.Log(1000000)/math.Log(float64(n)))
+	}
+	capacity := uint32(0)
+	if n > 1 {
+		capacity = uint32(math.Round(float64(n) * sizeFactor))
+	}
+	segments := (capacity + f.segmentLength - 1) / f.segmentLength
+	if segments <= 2 {
+		f.segmentCount = 1
+	} else {
+		f.segmentCount = segments - 2
+	}
+	f.segmentCountLength = f.segmentCount * f.segmentLength
+	f.fingerprints = make([]byte, (f.segmentCount+2)*f.segmentLength)
+}
+
+// buildFuseFilter builds the filter of the key hashes, nil if it could not
+// be built. Duplicate hashes are added once.
+func buildFuseFilter(keys []uint64) *fuseFilter {
+	size := uint32(len(keys))
+	f := &fuseFilter{}
+	f.initParameters(size)
+	rng := uint64(1)
+	f.seed = splitmix64(&rng)
+	capacity := uint32(len(f.fingerprints))
+
+	alone := make([]uint32, capacity)
+	// the count of keys of a slot times 4, xor the positions of the keys
+	// within their triple
+	t2count := make([]uint8, capacity)
+	t2hash := make([]uint64, capacity)
+	reverseH := make([]uint8, size)
+	reverseOrder := make([]uint64, size+1)
+	reverseOrder[size] = 1
+
+	blockBits := 1
+	for (uint32(1) << blockBits) < f.segmentCount {
+		blockBits++
+	}
+
+	var h012 [5]uint32
+	for iteration := 0; ; iteration++ {
+		if iteration == fuseMaxIterations {
+			return nil
+		}
+		if iteration > 0 {
+			// reset and retry with the next seed
+			clear(reverseOrder[:size])
+			clear(t2count)
+			clear(t2hash)
+			f.seed = splitmix64(&rng)
+		}
+
+		// sort the hashes by segment, so the slots are visited in order
+		startPos := make([]uint32, 1<<blockBits)
+		for i := range startPos {
+			startPos[i] = uint32((uint64(i) * uint64(size)) >> blockBits)
+		}
+		for _, key := range keys {
+			hash := fuseMix(key, f.seed)
+			segment := hash >> (64 - blockBits)
+			for reverseOrder[startPos[segment]] != 0 {
+				segment = (segment + 1) & ((1 << blockBits) - 1)
+			}
+			reverseOrder[startPos[segment]] = hash
+			startPos[segment]++
+		}
+
+		failed := false
+		duplicates := uint32(0)
+		for i := uint32(0); i < size; i++ {
+			hash := reverseOrder[i]
+			h0, h1, h2 := f.positions(hash)
+			t2count[h0] += 4
+			t2hash[h0] ^= hash
+			t2count[h1] += 4
+			t2count[h1] ^= 1
+			t2hash[h1] ^= hash
+			t2count[h2] += 4
+			t2count[h2] ^= 2
+			t2hash[h2] ^= hash
+			// a duplicate hash cancels itself out of a slot it shares
+			if t2hash[h0]&t2hash[h1]&t2hash[h2] == 0 {
+				if (t2hash[h0] == 0 && t2count[h0] == 8) ||
+					(t2hash[h1] == 0 && t2count[h1] == 8) ||
+					(t2hash[h2] == 0 && t2count[h2] == 8) {
+					duplicates++
+					t2count[h0] -= 4
+					t2hash[h0] ^= hash
+					t2count[h1] -= 4
+					t2count[h1] ^= 1
+					t2hash[h1] ^= hash
+					t2count[h2] -= 4
+					t2count[h2] ^= 2
+					t2hash[h2] ^= hash
+				}
+			}
+			// the counter of a slot overflowed
+			if t2count[h0] < 4 || t2count[h1] < 4 || t2count[h2] < 4 {
+				failed = true
+			}
+		}
+		if failed {
+			continue
+		}
+
+		// peel the slots holding a single key
+		queued := 0
+		for i := uint32(0); i < capacity; i++ {
+			alone[queued] = i
+			if t2count[i]>>2 == 1 {
+				queued++
+			}
+		}
+		stacked := uint32(0)
+		for queued > 0 {
+			queued--
+			index := alone[queued]
+			if t2count[index]>>2 != 1 {
+				continue
+			}
+			hash := t2hash[index]
+			found := t2count[index] & 3
+			reverseH[stacked] = found
+			reverseOrder[stacked] = hash
+			stacked++
+
+			h0, h1, h2 := f.positions(hash)
+			h012[1], h012[2], h012[3], h012[4] = h1, h2, h0, h1
+			for j := uint8(1); j <= 2; j++ {
+				other := h012[found+j]
+				alone[queued] = other
+				if t2count[other]>>2 == 2 {
+					queued++
+				}
+				t2count[other] -= 4
+				t2count[other] ^= (found + j) % 3
+				t2hash[other] ^= hash
+			}
+		}
+		if stacked+duplicates == size {
+			size = stacked
+			break
+		}
+	}
+
+	// assign the fingerprints in the reverse peeling order
+	for i := int(size) - 1; i >= 0; i-- {
+		hash := reverseOrder[i]
+		h0, h1, h2 := f.positions(hash)
+		found := reverseH[i]
+		h012[0], h012[1], h012[2], h012[3], h012[4] = h0, h1, h2, h0, h1
+		f.fingerprints[h012[found]] = fuseFingerprint(hash) ^ f.fingerprints[h012[found+1]] ^ f.fingerprints[h012[found+2]]
+	}
+	return f
+}
+
+func fuseFingerprint(hash uint64) uint8 {
+	return uint8(hash ^ hash>>32)
+}
+
+// fuseMix mixes a key hash with the seed of a filter.
+func fuseMix(key, seed uint64) uint64 {
+	h := key + seed
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+func splitmix64(seed *uint64) uint64 {
+	*seed += 0x9e3779b97f4a7c15
+	z := *seed
+	z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+	z = (z ^ z>>27) * 0x94d049bb133111eb
+	return z ^ z>>31
+}
@@ -11,9 +11,11 @@ import (
 )
 
 type MemStorage struct {
-	data map[string]string
+	data map[string]Entry
 	mu   sync.RWMutex
 	ttl  map[string]time.Time
+	done chan struct{}
+	once sync.Once
 }
 
 // NewMemStorage creates a new instance of MemStorage.
@@ -21,8 +23,9 @@ type MemStorage struct {
 // The map is protected by a read-write mutex to allow concurrent access.
 func NewMemStorage() *MemStorage {
 	ms := &MemStorage{
-		data: make(map[string]string),
+		data: make(map[string]Entry),
 		ttl:  make(map[string]time.Time),
+		done: make(chan struct{}),
 	}
 	go ms.ttlEvictionLoop()
 	return ms
@@ -30,25 +33,37 @@ func NewMemStorage() *MemStorage {
 
 // Get retrieves the value associated with the given key.
 // It returns the value and a boolean indicating whether the key exists in the storage.
+// Deleted keys and keys holding unresolved merge operands are reported as missing,
+// use GetEntry to tell them apart.
 // The method uses a read lock to allow concurrent reads.
 func (m *MemStorage) Get(key string) (string, bool) {
+	entry, ok := m.GetEntry(key)
+	if !ok || entry.Kind != KindValue {
+		return "", false
+	}
+	return entry.Value, true
+}
+
+// GetEntry retrieves the record stored for the given key, including tombstones
+// and merge records. Expired keys are reported as missing.
+func (m *MemStorage) GetEntry(key string) (Entry, bool) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
-	val, ok := m.data[key]
+	entry, ok := m.data[key]
 
 	if !ok {
-		return "", false
+		return Entry{}, false
 	}
 
 	if exp, ok := m.ttl[key]; ok {
 		if time.Now().After(exp) {
 
 			// key expired
-			return "", false
+			return Entry{}, false
 		}
 	}
 
-	return val, true
+	return entry, true
 }
 
 // Put stores the key-value pair in the storage.
@@ -57,27 +72,50 @@ func (m *MemStorage) Get(key string) (string, bool) {
 func (m *MemStorage) Put(key, value string) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	m.data[key] = value
+	m.data[key] = Entry{Kind: KindValue, Value: value}
+	delete(m.ttl, key)
 }
 
 // PutTTL stores the key-value pair with a time-to-live (TTL).
 func (m *MemStorage) PutWithTTL(key, value string, duration time.Duration) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	m.data[key] = value
+	m.data[key] = Entry{Kind: KindValue, Value: value}
 	m.ttl[key] = time.Now().Add(duration)
 }
 
-// Delete removes the key-value pair associated with the given key.
+// Delete stores a tombstone for the given key, so older values of the key
+// in immutable memtables or SSStorages stay hidden.
 // The method uses a write lock to ensure exclusive access during the operation.
-// If the key does not exist, it does nothing.
 func (m *MemStorage) Delete(key string) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	delete(m.data, key)
+	m.data[key] = Entry{Kind: KindDelete}
+	delete(m.ttl, key)
+}
+
+// Apply atomically replaces the record of the given key with the result of fn.
+// fn receives the current record and whether one exists.
+// If fn returns an error the storage is left unchanged.
+func (m *MemStorage) Apply(key string, fn func(old Entry, ok bool) (Entry, error)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	old, ok := m.data[key]
+	if exp, hasTTL := m.ttl[key]; ok && hasTTL && time.Now().After(exp) {
+		old, ok = Entry{}, false
+	}
+	entry, err := fn(old, ok)
+	if err != nil {
+		return err
+	}
+	m.data[key] = entry
+	delete(m.ttl, key)
+	return nil
 }
 
-// All returns a copy of all key-value pairs in the storage.
+// All returns a copy of all live key-value pairs in the storage.
+// Tombstones and merge records are left out, use Entries to get them.
 // It uses a read lock to allow concurrent reads.
 // The returned map is a shallow copy, so modifications to it do not affect the original storage.
 // This method is useful for iterating over all entries without locking the storage.
@@ -87,12 +125,43 @@ func (m *MemStorage) All() map[string]string {
 	defer m.mu.RUnlock()
 
 	cloned := make(map[string]string)
+	for k, v := range m.data {
+		if v.Kind == KindValue {
+			cloned[k] = v.Value
+		}
+	}
+	return cloned
+}
+
+// Entries returns a copy of every record in the storage, tombstones and
+// merge records included.
+func (m *MemStorage) Entries() map[string]Entry {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	cloned := make(map[string]Entry, len(m.data))
 	for k, v := range m.data {
 		cloned[k] = v
 	}
 	return cloned
 }
 
+// Len returns the number of keys currently held in the storage.
+func (m *MemStorage) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.data)
+}
+
+// Close stops the TTL eviction loop of the storage.
+// The data stays readable, it is only no longer evicted.
+// It is safe to call Close more than once.
+func (m *MemStorage) Close() {
+	m.once.Do(func() {
+		close(m.done)
+	})
+}
+
 // SetTTL sets a time-to-live (TTL) for the given key.
 // The key will be automatically deleted after the specified duration.
 // The method uses a write lock to ensure exclusive access during the operation.
@@ -100,7 +169,12 @@ func (m *MemStorage) ttlEvictionLoop() {
 	ticker := time.NewTicker(1 * time.Second)
 	defer ticker.Stop()
 
-	for range ticker.C {
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C:
+		}
 		now := time.Now()
 
 		m.mu.Lock()
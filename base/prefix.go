@@ -0,0 +1,66 @@
+// Copyright 2025 The QuellDB Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be found in
+// the LICENSE file.
+
+// prefixes of keys
+package base
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PrefixExtractor maps keys to the prefixes the prefix filter of an
+// SSStorage file is built over. A prefix iterator skips files whose prefix
+// filter rules out its prefix. Every key extending a prefix the extractor
+// returns must have the same prefix.
+type PrefixExtractor interface {
+	// Name identifies the extractor. Prefix filters built by an extractor
+	// of another name are not used.
+	Name() string
+	// Prefix returns the prefix of the key, false for keys without one.
+	Prefix(key string) (string, bool)
+}
+
+type fixedPrefix int
+
+// FixedPrefix returns an extractor taking the first n bytes of a key as its
+// prefix. Shorter keys have no prefix.
+func FixedPrefix(n int) PrefixExtractor {
+	return fixedPrefix(n)
+}
+
+func (p fixedPrefix) Name() string {
+	return fmt.Sprintf("quelldb.FixedPrefix.%d", int(p))
+}
+
+func (p fixedPrefix) Prefix(key string) (string, bool) {
+	if len(key) < int(p) {
+		return "", false
+	}
+	return key[:p], true
+}
+
+type delimitedPrefix string
+
+// DelimitedPrefix returns an extractor taking a key up to and including the
+// first occurrence of delim as its prefix, "user:" for "user:42" with
+// delim ":". Keys without delim have no prefix.
+func DelimitedPrefix(delim string) PrefixExtractor {
+	return delimitedPrefix(delim)
+}
+
+func (p delimitedPrefix) Name() string {
+	return "quelldb.DelimitedPrefix." + string(p)
+}
+
+func (p delimitedPrefix) Prefix(key string) (string, bool) {
+	if p == "" {
+		return "", false
+	}
+	i := strings.Index(key, string(p))
+	if i < 0 {
+		return "", false
+	}
+	return key[:i+len(p)], true
+}
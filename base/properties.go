@@ -0,0 +1,181 @@
+// Copyright 2025 The QuellDB Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be found in
+// the LICENSE file.
+
+// meta blocks of sorted string storage files
+package base
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// names of the meta blocks, recorded in the metaindex
+const (
+	metaProperties = "properties"
+	metaKeyRange   = "keyrange"
+	// the filter meta blocks are named after their policy, and the prefix
+	// filters after their prefix extractor too
+	metaFilterPrefix       = "filter."
+	metaPrefixFilterPrefix = "prefixfilter."
+)
+
+// names of the properties
+const (
+	propNumEntries      = "num.entries"
+	propNumDeletions    = "num.deletions"
+	propNumMerges       = "num.merges"
+	propNumDataBlocks   = "num.data.blocks"
+	propRawKeySize      = "raw.key.size"
+	propRawValueSize    = "raw.value.size"
+	propFilterPolicy    = "filter.policy"
+	propPrefixExtractor = "prefix.extractor"
+	propCompression     = "compression"
+	propSmallestSeq     = "smallest.seq"
+	propLargestSeq      = "largest.seq"
+)
+
+// TableProperties describe the contents of an SSStorage file. They are
+// recorded in its properties meta block when it is written.
+type TableProperties struct {
+	NumEntries    uint64
+	NumDeletions  uint64
+	NumMerges     uint64
+	NumDataBlocks uint64
+	// RawKeySize and RawValueSize are the bytes of the keys and values
+	// before compression.
+	RawKeySize   uint64
+	RawValueSize uint64
+	// FilterPolicy and PrefixExtractor name what built the filters,
+	// PrefixExtractor is empty for files without a prefix filter.
+	FilterPolicy    string
+	PrefixExtractor string
+	// Compression names the codec the file was written with. Blocks
+	// a codec does not shrink are stored uncompressed.
+	Compression string
+	// SmallestSeq and LargestSeq bound the sequence numbers of the writes
+	// held by the file. Both are zero for files written without them.
+	SmallestSeq uint64
+	LargestSeq  uint64
+	// SmallestKey and LargestKey are the key range of the file.
+	SmallestKey string
+	LargestKey  string
+}
+
+// metaFilterName returns the name of the meta block of a key filter.
+func metaFilterName(policy string) string {
+	return metaFilterPrefix + policy
+}
+
+// metaPrefixFilterName returns the name of the meta block of a prefix filter.
+func metaPrefixFilterName(extractor, policy string) string {
+	return metaPrefixFilterPrefix + extractor + "." + policy
+}
+
+// encodeProperties serializes the properties as [len][name][len][value]
+// pairs, numbers as uvarints. Readers skip the properties they do not know.
+func encodeProperties(p TableProperties) []byte {
+	var buf bytes.Buffer
+	add := func(name string, value []byte) {
+		putBlockUvarint(&buf, uint64(len(name)))
+		buf.WriteString(name)
+		putBlockUvarint(&buf, uint64(len(value)))
+		buf.Write(value)
+	}
+	for _, n := range []struct {
+		name  string
+		value uint64
+	}{
+		{propNumEntries, p.NumEntries},
+		{propNumDeletions, p.NumDeletions},
+		{propNumMerges, p.NumMerges},
+		{propNumDataBlocks, p.NumDataBlocks},
+		{propRawKeySize, p.RawKeySize},
+		{propRawValueSize, p.RawValueSize},
+		{propSmallestSeq, p.SmallestSeq},
+		{propLargestSeq, p.LargestSeq},
+	} {
+		add(n.name, binary.AppendUvarint(nil, n.value))
+	}
+	add(propFilterPolicy, []byte(p.FilterPolicy))
+	if p.PrefixExtractor != "" {
+		add(propPrefixExtractor, []byte(p.PrefixExtractor))
+	}
+	add(propCompression, []byte(p.Compression))
+	return buf.Bytes()
+}
+
+// decodeProperties reverses encodeProperties.
+func decodeProperties(data []byte, p *TableProperties) error {
+	r := bytes.NewReader(data)
+	for r.Len() > 0 {
+		name, err := readBlockBytes(r)
+		if err != nil {
+			return err
+		}
+		value, err := readBlockBytes(r)
+		if err != nil {
+			return err
+		}
+
+		var num *uint64
+		switch string(name) {
+		case propNumEntries:
+			num = &p.NumEntries
+		case propNumDeletions:
+			num = &p.NumDeletions
+		case propNumMerges:
+			num = &p.NumMerges
+		case propNumDataBlocks:
+			num = &p.NumDataBlocks
+		case propRawKeySize:
+			num = &p.RawKeySize
+		case propRawValueSize:
+			num = &p.RawValueSize
+		case propSmallestSeq:
+			num = &p.SmallestSeq
+		case propLargestSeq:
+			num = &p.LargestSeq
+		case propFilterPolicy:
+			p.FilterPolicy = string(value)
+		case propPrefixExtractor:
+			p.PrefixExtractor = string(value)
+		case propCompression:
+			p.Compression = string(value)
+		}
+		if num != nil {
+			v, n := binary.Uvarint(value)
+			if n <= 0 {
+				return fmt.Errorf("invalid SSStorage properties: %s", name)
+			}
+			*num = v
+		}
+	}
+	return nil
+}
+
+// encodeKeyRange serializes the key range of a file as [len][min][len][max].
+func encodeKeyRange(minKey, maxKey string) []byte {
+	var buf bytes.Buffer
+	putBlockUvarint(&buf, uint64(len(minKey)))
+	buf.WriteString(minKey)
+	putBlockUvarint(&buf, uint64(len(maxKey)))
+	buf.WriteString(maxKey)
+	return buf.Bytes()
+}
+
+// decodeKeyRange reverses encodeKeyRange.
+func decodeKeyRange(data []byte, p *TableProperties) error {
+	r := bytes.NewReader(data)
+	minKey, err := readBlockBytes(r)
+	if err != nil {
+		return err
+	}
+	maxKey, err := readBlockBytes(r)
+	if err != nil {
+		return err
+	}
+	p.SmallestKey, p.LargestKey = string(minKey), string(maxKey)
+	return nil
+}
@@ -6,25 +6,105 @@
 package base
 
 import (
+	"bytes"
 	"encoding/binary"
-	"encoding/json"
 	"fmt"
-	"io"
-	"os"
+	"path/filepath"
 	"sort"
 
-	"github.com/golang/snappy"
 	"github.com/quellington/quelldb/constants"
-	"github.com/quellington/quelldb/utils"
+	"github.com/quellington/quelldb/vfs"
 )
 
+// WriterOptions configure how an SSStorage file is written.
+type WriterOptions struct {
+	// FilterPolicy builds the filter of the file. When nil, a Bloom filter
+	// is built as configured by the Bloom fields below.
+	FilterPolicy FilterPolicy
+
+	// BloomBitsPerKey sizes the bloom filter by the number of keys of the
+	// file, BLOOM_BITS_PER_KEY_DEFAULT when zero.
+	BloomBitsPerKey float64
+	// BloomBits and BloomHashCount fix the size and the number of hash
+	// functions of the bloom filter when set.
+	BloomBits      uint32
+	BloomHashCount uint8
+
+	// PrefixExtractor adds a second filter over the prefixes of the keys
+	// when set, built by the same policy.
+	PrefixExtractor PrefixExtractor
+
+	// Compression is the codec of the blocks of the file, Snappy when
+	// DefaultCompression. CompressionLevel is the zstd level,
+	// ZSTD_LEVEL_DEFAULT when zero.
+	Compression      Compression
+	CompressionLevel int
+
+	// SmallestSeq and LargestSeq bound the sequence numbers of the writes
+	// held by the file. They are recorded in its properties, so the order
+	// of the files can be recovered without the manifest.
+	SmallestSeq uint64
+	LargestSeq  uint64
+}
+
+// filterPolicy returns the policy building the filter of the file.
+func (o WriterOptions) filterPolicy() FilterPolicy {
+	if o.FilterPolicy != nil {
+		return o.FilterPolicy
+	}
+	return BloomFilterPolicy{BitsPerKey: o.BloomBitsPerKey, Bits: o.BloomBits, HashCount: o.BloomHashCount}
+}
+
+// compression returns the codec of the blocks of the file.
+func (o WriterOptions) compression() Compression {
+	if o.Compression == DefaultCompression {
+		return SnappyCompression
+	}
+	return o.Compression
+}
+
 // WriteSSStorage writes a map of strings to a file in a sorted string storage format.
-// Each key-value pair is compressed using snappy and optionally encrypted.
-// The keys and values are prefixed with their lengths to allow for easy reading.
+// The key-value pairs are grouped into blocks, each compressed using snappy
+// and optionally encrypted, see WriteSSStorageEntries.
 // The file is created if it doesn't exist, and overwritten if it does.
 // The path parameter specifies the file location, and the key parameter is used for encryption.
 // If the key is nil, the data will be stored unencrypted.
 func WriteSSStorage(path string, data map[string]string, key []byte) (string, string, error) {
+	return WriteSSStorageFS(vfs.Default, path, data, key)
+}
+
+// WriteSSStorageFS is WriteSSStorage on the given file system.
+func WriteSSStorageFS(fs vfs.FS, path string, data map[string]string, key []byte) (string, string, error) {
+	entries := make(map[string]Entry, len(data))
+	for k, v := range data {
+		entries[k] = Entry{Kind: KindValue, Value: v}
+	}
+	return WriteSSStorageEntriesFS(fs, path, entries, key, WriterOptions{})
+}
+
+// WriteSSStorageEntries writes typed records to a sorted string storage file.
+// Every record is prefixed with its kind, so tombstones and merge operands
+// survive a flush. Merge operands are stored as the record value.
+// The records are written in key order into blocks of about SSS_BLOCK_SIZE
+// bytes, each compressed with the codec of opts and optionally encrypted on
+// its own. The codec is recorded in the trailer of every block.
+// The meta blocks follow: the filter built by the filter policy of opts,
+// the filter over the prefixes of the keys when opts has a prefix
+// extractor, the table properties and the key range. Then come the
+// metaindex naming every meta block, the index naming the last key of every
+// data block and the footer
+// [metaindex offset][metaindex size][index offset][index size][magic].
+// The file is synced, together with the directory, before it returns.
+// At least one record must be given.
+func WriteSSStorageEntries(path string, data map[string]Entry, key []byte, opts WriterOptions) (string, string, error) {
+	return WriteSSStorageEntriesFS(vfs.Default, path, data, key, opts)
+}
+
+// WriteSSStorageEntriesFS is WriteSSStorageEntries on the given file system.
+func WriteSSStorageEntriesFS(fs vfs.FS, path string, data map[string]Entry, key []byte, opts WriterOptions) (string, string, error) {
+	if len(data) == 0 {
+		return "", "", fmt.Errorf("no records to write to %s", path)
+	}
 
 	keys := make([]string, 0, len(data))
 	for k := range data {
@@ -34,64 +114,107 @@ func WriteSSStorage(path string, data map[string]string, key []byte) (string, st
 	minKey := keys[0]
 	maxKey := keys[len(keys)-1]
 
-	file, err := os.Create(path)
-	if err != nil {
-		return "", "", err
-	}
-	defer file.Close()
+	var buf, block bytes.Buffer
+	var handles []blockHandle
 
-	offsets := make(map[string]int64)
+	policy := opts.filterPolicy()
+	filter := policy.NewWriter()
+	var prefixFilter FilterWriter
+	if opts.PrefixExtractor != nil {
+		prefixFilter = policy.NewWriter()
+	}
+	lastPrefix, hasPrefix := "", false
+	codec, level := opts.compression(), opts.CompressionLevel
+	props := TableProperties{
+		NumEntries:   uint64(len(keys)),
+		FilterPolicy: policy.Name(),
+		Compression:  codec.String(),
+		SmallestSeq:  opts.SmallestSeq,
+		LargestSeq:   opts.LargestSeq,
+	}
 
-	filter := ApplyNewBloomFilter(constants.BOOM_BIT_SIZE, constants.BOOM_HASH_COUNT)
+	for i, k := range keys {
+		filter.AddKey(k)
+		if prefixFilter != nil {
+			// the keys are sorted, so equal prefixes follow each other
+			if prefix, ok := opts.PrefixExtractor.Prefix(k); ok && (!hasPrefix || prefix != lastPrefix) {
+				prefixFilter.AddKey(prefix)
+				lastPrefix, hasPrefix = prefix, true
+			}
+		}
 
-	for k, v := range data {
+		entry := data[k]
+		switch entry.Kind {
+		case KindDelete:
+			props.NumDeletions++
+		case KindMerge:
+			props.NumMerges++
+		}
+		props.RawKeySize += uint64(len(k))
+		props.RawValueSize += uint64(len(entry.Value))
+		for _, op := range entry.Operands {
+			props.RawValueSize += uint64(len(op))
+		}
+		appendRecord(&block, k, entry)
+		if block.Len() < constants.SSS_BLOCK_SIZE && i < len(keys)-1 {
+			continue
+		}
 
-		// get current byte offset
-		pos, err := file.Seek(0, io.SeekCurrent)
+		stored, err := encodeBlock(block.Bytes(), key, codec, level)
 		if err != nil {
 			return "", "", err
 		}
-		offsets[k] = pos
+		handles = append(handles, blockHandle{lastKey: k, offset: uint64(buf.Len()), size: uint64(len(stored))})
+		buf.Write(stored)
+		block.Reset()
+	}
+	props.NumDataBlocks = uint64(len(handles))
 
-		filter.Add(k)
-		kb := snappy.Encode(nil, []byte(k))
-		vb := snappy.Encode(nil, []byte(v))
+	// the meta blocks, named in the metaindex in name order
+	metaBlocks := map[string][]byte{
+		metaFilterName(policy.Name()): filter.Finish(),
+		metaKeyRange:                  encodeKeyRange(minKey, maxKey),
+	}
+	if prefixFilter != nil {
+		props.PrefixExtractor = opts.PrefixExtractor.Name()
+		metaBlocks[metaPrefixFilterName(props.PrefixExtractor, policy.Name())] = prefixFilter.Finish()
+	}
+	metaBlocks[metaProperties] = encodeProperties(props)
 
-		if key != nil {
-			kb, err = utils.Encrypt(kb, key)
-			if err != nil {
-				return "", "", err
-			}
-			vb, err = utils.Encrypt(vb, key)
-			if err != nil {
-				return "", "", err
-			}
+	names := make([]string, 0, len(metaBlocks))
+	for name := range metaBlocks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var metaHandles []blockHandle
+	for _, name := range names {
+		stored, err := encodeBlock(metaBlocks[name], key, codec, level)
+		if err != nil {
+			return "", "", err
 		}
-
-		binary.Write(file, binary.LittleEndian, int32(len(kb)))
-		file.Write(kb)
-		binary.Write(file, binary.LittleEndian, int32(len(vb)))
-		file.Write(vb)
+		metaHandles = append(metaHandles, blockHandle{lastKey: name, offset: uint64(buf.Len()), size: uint64(len(stored))})
+		buf.Write(stored)
 	}
 
-	// serialize the index map
-	indexBytes, err := json.Marshal(offsets)
-	if err != nil {
-		return "", "", err
+	var footer [footerLenV4 - 4]byte
+	for i, index := range [][]blockHandle{metaHandles, handles} {
+		stored, err := encodeBlock(encodeIndex(index), key, codec, level)
+		if err != nil {
+			return "", "", err
+		}
+		binary.LittleEndian.PutUint64(footer[16*i:], uint64(buf.Len()))
+		binary.LittleEndian.PutUint64(footer[16*i+8:], uint64(len(stored)))
+		buf.Write(stored)
 	}
-	_, err = file.Write(indexBytes)
-	if err != nil {
+	buf.Write(footer[:])
+	buf.WriteString(constants.INDEX_FOOTER_NAME_V4)
+
+	if err := writeSyncedFile(fs, path, buf.Bytes()); err != nil {
 		return "", "", err
 	}
 
-	// write the length of index
-	binary.Write(file, binary.LittleEndian, int32(len(indexBytes)))
-
-	file.Write([]byte(constants.INDEX_FOOTER_NAME))
-
-	// Save bloom filter
-	err = saveBloomFilter(filter, path+constants.SSS_BOOM_FILTER_SUFFIX)
-	if err != nil {
+	// the file is only referenced once its directory entry is durable
+	if err := fs.Sync(filepath.Dir(path)); err != nil {
 		return "", "", err
 	}
 
@@ -99,112 +222,62 @@ func WriteSSStorage(path string, data map[string]string, key []byte) (string, st
 }
 
 // ReadSSStorage reads a sorted string storage file and returns a map of strings.
-// Each key-value pair is read from the file, and the values are decompressed using snappy.
+// Every block is decompressed with the codec recorded in its trailer.
 // If the key parameter is provided, the data will be decrypted using the key.
 // If the key is nil, the data will be read unencrypted.
-// Function also handles the case where the file is too small to contain a valid index.
-// Direct file seek instead of using a buffered reader to avoid memory overhead.
+// Deleted keys and unresolved merge records are left out, use
+// ReadSSStorageEntries to get them.
 func ReadSSStorage(path string, key []byte) (map[string]string, error) {
-	file, err := os.Open(path)
-	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
-
-	// load index footer
-	stat, _ := file.Stat()
-	if stat.Size() < 8 {
-		return nil, fmt.Errorf("file too small to contain index")
-	}
+	return ReadSSStorageFS(vfs.Default, path, key)
+}
 
-	// Seek to index footer
-	_, err = file.Seek(-8, io.SeekEnd)
+// ReadSSStorageFS is ReadSSStorage on the given file system.
+func ReadSSStorageFS(fs vfs.FS, path string, key []byte) (map[string]string, error) {
+	entries, err := ReadSSStorageEntriesFS(fs, path, key)
 	if err != nil {
 		return nil, err
 	}
-
-	var indexLen int32
-	err = binary.Read(file, binary.LittleEndian, &indexLen)
-	if err != nil {
-		return nil, err
+	result := make(map[string]string, len(entries))
+	for k, entry := range entries {
+		if entry.Kind == KindValue {
+			result[k] = entry.Value
+		}
 	}
+	return result, nil
+}
 
-	footer := make([]byte, 4)
-	_, err = file.Read(footer)
-	if err != nil || string(footer) != constants.INDEX_FOOTER_NAME {
-		return nil, fmt.Errorf("invalid SSStorage format: missing footer")
-	}
+// ReadSSStorageEntries reads every typed record of a sorted string storage file.
+// Files written before records were typed only hold values.
+func ReadSSStorageEntries(path string, key []byte) (map[string]Entry, error) {
+	return ReadSSStorageEntriesFS(vfs.Default, path, key)
+}
 
-	// seek to index and read it
-	_, err = file.Seek(-(int64(indexLen) + 8), io.SeekEnd)
+// ReadSSStorageEntriesFS is ReadSSStorageEntries on the given file system.
+func ReadSSStorageEntriesFS(fs vfs.FS, path string, key []byte) (map[string]Entry, error) {
+	t, err := OpenTableFS(fs, path, key, TableOptions{})
 	if err != nil {
 		return nil, err
 	}
+	defer t.Close()
+	return t.Entries()
+}
 
-	indexBytes := make([]byte, indexLen)
-	_, err = file.Read(indexBytes)
+// writeSyncedFile creates the file at path holding data and syncs it.
+// A file that could not be written completely is removed again.
+func writeSyncedFile(fs vfs.FS, path string, data []byte) error {
+	file, err := fs.Create(path)
 	if err != nil {
-		return nil, err
+		return err
 	}
-
-	offsetMap := map[string]int64{}
-	if err := json.Unmarshal(indexBytes, &offsetMap); err != nil {
-		return nil, err
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
 	}
-
-	// load all keys based on offsets
-	result := make(map[string]string)
-	for _, offset := range offsetMap {
-		_, err := file.Seek(offset, io.SeekStart)
-		if err != nil {
-			return nil, err
-		}
-
-		var kLen int32
-		err = binary.Read(file, binary.LittleEndian, &kLen)
-		if err != nil {
-			return nil, err
-		}
-
-		kb := make([]byte, kLen)
-		_, err = file.Read(kb)
-		if err != nil {
-			return nil, err
-		}
-		if key != nil {
-			kb, err = utils.Decrypt(kb, key)
-			if err != nil {
-				return nil, err
-			}
-		}
-		decodedKey, err := snappy.Decode(nil, kb)
-		if err != nil {
-			return nil, err
-		}
-
-		var vLen int32
-		err = binary.Read(file, binary.LittleEndian, &vLen)
-		if err != nil {
-			return nil, err
-		}
-		vb := make([]byte, vLen)
-		_, err = file.Read(vb)
-		if err != nil {
-			return nil, err
-		}
-		if key != nil {
-			vb, err = utils.Decrypt(vb, key)
-			if err != nil {
-				return nil, err
-			}
-		}
-		valDecoded, err := snappy.Decode(nil, vb)
-		if err != nil {
-			return nil, err
-		}
-
-		result[string(decodedKey)] = string(valDecoded)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
 	}
-
-	return result, nil
+	if err != nil {
+		fs.Remove(path)
+	}
+	return err
 }
@@ -0,0 +1,423 @@
+// Copyright 2025 The QuellDB Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be found in
+// the LICENSE file.
+
+// reading sorted string storage files
+package base
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/golang/snappy"
+	"github.com/quellington/quelldb/cache"
+	"github.com/quellington/quelldb/constants"
+	"github.com/quellington/quelldb/utils"
+	"github.com/quellington/quelldb/vfs"
+)
+
+// footerLen is the size of the footer of a block-based table without meta
+// blocks: [index offset][index size][magic].
+const footerLen = 20
+
+// footerLenV4 is the size of the footer of a table with meta blocks:
+// [metaindex offset][metaindex size][index offset][index size][magic].
+const footerLenV4 = 36
+
+// TableOptions configure how a table is read.
+type TableOptions struct {
+	// Cache holds the decoded blocks of the table, nil reads every block
+	// from the file. CacheID and FileNum key the blocks in the cache.
+	Cache   *cache.Cache
+	CacheID uint64
+	FileNum uint64
+}
+
+// Table is an open SSStorage file. A lookup reads a single block, through
+// the block cache when one is configured. Files written before the block
+// format are read record by record through their JSON index.
+// A Table is safe for concurrent use.
+type Table struct {
+	fs   vfs.FS
+	path string
+	file vfs.File
+	key  []byte
+	opts TableOptions
+
+	// blocks indexes the data blocks of a block-based table
+	blocks []blockHandle
+
+	// meta names the meta blocks, nil for tables written without them
+	meta  map[string]blockHandle
+	props TableProperties
+
+	// legacy tables keep an offset per key, typed ones a kind per record
+	legacy  bool
+	offsets map[string]int64
+	typed   bool
+	dataEnd int64
+}
+
+// OpenTable opens the SSStorage file at path and reads its index.
+// The key decrypts an encrypted file, nil reads it unencrypted.
+func OpenTable(path string, key []byte, opts TableOptions) (*Table, error) {
+	return OpenTableFS(vfs.Default, path, key, opts)
+}
+
+// OpenTableFS is OpenTable on the given file system.
+func OpenTableFS(fs vfs.FS, path string, key []byte, opts TableOptions) (*Table, error) {
+	file, err := fs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	t := &Table{fs: fs, path: path, file: file, key: key, opts: opts}
+	if err := t.readIndex(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// Close closes the file of the table.
+func (t *Table) Close() error {
+	return t.file.Close()
+}
+
+// readIndex reads the footer and the index of the table, and the metaindex
+// with the properties of tables holding meta blocks.
+func (t *Table) readIndex() error {
+	stat, err := t.file.Stat()
+	if err != nil {
+		return err
+	}
+	size := stat.Size()
+	if size < 8 {
+		return fmt.Errorf("file too small to contain index")
+	}
+
+	magic := make([]byte, 4)
+	if _, err := t.file.ReadAt(magic, size-4); err != nil {
+		return err
+	}
+	flen := int64(footerLen)
+	switch string(magic) {
+	case constants.INDEX_FOOTER_NAME_V4:
+		flen = footerLenV4
+	case constants.INDEX_FOOTER_NAME_V3:
+	case constants.INDEX_FOOTER_NAME, constants.INDEX_FOOTER_NAME_V2:
+		return t.readLegacyIndex(size, string(magic) == constants.INDEX_FOOTER_NAME_V2)
+	default:
+		return fmt.Errorf("invalid SSStorage format: missing footer")
+	}
+
+	if size < flen {
+		return fmt.Errorf("invalid SSStorage format: file too small for footer")
+	}
+	footer := make([]byte, flen-4)
+	if _, err := t.file.ReadAt(footer, size-flen); err != nil {
+		return err
+	}
+	dataEnd := uint64(size - flen)
+
+	if flen == footerLenV4 {
+		metaIndex, err := t.readIndexBlock(footer, dataEnd)
+		if err != nil {
+			return err
+		}
+		footer = footer[16:]
+		if err := t.readMeta(metaIndex); err != nil {
+			return err
+		}
+	}
+	t.blocks, err = t.readIndexBlock(footer, dataEnd)
+	return err
+}
+
+// readIndexBlock reads the index block the footer points to with
+// [offset][size], checking it against the end of the blocks.
+func (t *Table) readIndexBlock(footer []byte, dataEnd uint64) ([]blockHandle, error) {
+	offset := binary.LittleEndian.Uint64(footer)
+	size := binary.LittleEndian.Uint64(footer[8:])
+	if offset > dataEnd || size > dataEnd-offset {
+		return nil, fmt.Errorf("invalid SSStorage format: index at %d out of range", offset)
+	}
+
+	stored := make([]byte, size)
+	if _, err := t.file.ReadAt(stored, int64(offset)); err != nil {
+		return nil, err
+	}
+	index, err := decodeBlock(stored, t.key)
+	if err != nil {
+		return nil, err
+	}
+	return decodeIndex(index, offset)
+}
+
+// readMeta records the meta blocks named by the metaindex and reads the
+// properties and the key range.
+func (t *Table) readMeta(metaIndex []blockHandle) error {
+	t.meta = make(map[string]blockHandle, len(metaIndex))
+	for _, h := range metaIndex {
+		t.meta[h.lastKey] = h
+	}
+	for name, decode := range map[string]func([]byte, *TableProperties) error{
+		metaProperties: decodeProperties,
+		metaKeyRange:   decodeKeyRange,
+	} {
+		block, ok, err := t.readMetaBlock(name)
+		if err != nil {
+			return err
+		}
+		if ok {
+			if err := decode(block, &t.props); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readMetaBlock returns the decoded contents of the named meta block,
+// false if the table has none of that name.
+func (t *Table) readMetaBlock(name string) ([]byte, bool, error) {
+	h, ok := t.meta[name]
+	if !ok {
+		return nil, false, nil
+	}
+	block, err := t.readBlock(h, false)
+	if err != nil {
+		return nil, false, fmt.Errorf("meta block %s: %w", name, err)
+	}
+	return block, true, nil
+}
+
+// Properties returns the properties recorded in the table, false for
+// tables written before tables held them.
+func (t *Table) Properties() (TableProperties, bool) {
+	return t.props, t.meta != nil
+}
+
+// LoadFilters reads the key filter and the prefix filter of the extractor
+// of the table, from its meta blocks or, for tables written before filters
+// were embedded, from the filter file next to it, see LoadFilters.
+// A filter the table does not hold, or one built by an unknown policy, is
+// returned as nil.
+func (t *Table) LoadFilters(extractor PrefixExtractor, policies ...FilterPolicy) (*Filter, *Filter, error) {
+	if t.meta == nil {
+		return LoadFiltersFS(t.fs, t.path+constants.SSS_BOOM_FILTER_SUFFIX, extractor, policies...)
+	}
+
+	var keys, prefixes *Filter
+	for _, policy := range append(policies, builtinFilterPolicies...) {
+		if policy == nil {
+			continue
+		}
+		if keys == nil {
+			data, ok, err := t.readMetaBlock(metaFilterName(policy.Name()))
+			if err != nil {
+				return nil, nil, err
+			}
+			if ok {
+				keys = &Filter{policy: policy, data: data}
+			}
+		}
+		if prefixes == nil && extractor != nil {
+			data, ok, err := t.readMetaBlock(metaPrefixFilterName(extractor.Name(), policy.Name()))
+			if err != nil {
+				return nil, nil, err
+			}
+			if ok {
+				prefixes = &Filter{policy: policy, data: data}
+			}
+		}
+	}
+	return keys, prefixes, nil
+}
+
+// readLegacyIndex reads the JSON index of a table written before the block
+// format, [records][index][index length][magic].
+func (t *Table) readLegacyIndex(size int64, typed bool) error {
+	var lenBuf [4]byte
+	if _, err := t.file.ReadAt(lenBuf[:], size-8); err != nil {
+		return err
+	}
+	indexLen := int64(int32(binary.LittleEndian.Uint32(lenBuf[:])))
+	if indexLen < 0 || indexLen > size-8 {
+		return fmt.Errorf("invalid SSStorage format: index length %d out of range", indexLen)
+	}
+
+	indexBytes := make([]byte, indexLen)
+	if _, err := t.file.ReadAt(indexBytes, size-8-indexLen); err != nil {
+		return err
+	}
+	offsets := map[string]int64{}
+	if err := json.Unmarshal(indexBytes, &offsets); err != nil {
+		return err
+	}
+
+	t.legacy, t.offsets, t.typed = true, offsets, typed
+	t.dataEnd = size - 8 - indexLen
+	return nil
+}
+
+// Get returns the record of the key, if the table holds one.
+func (t *Table) Get(key string) (Entry, bool, error) {
+	if t.legacy {
+		offset, ok := t.offsets[key]
+		if !ok {
+			return Entry{}, false, nil
+		}
+		_, entry, err := t.readLegacyRecord(offset)
+		if err != nil {
+			return Entry{}, false, err
+		}
+		return entry, true, nil
+	}
+
+	// the first block whose last key is not smaller than the key
+	i := sort.Search(len(t.blocks), func(i int) bool {
+		return t.blocks[i].lastKey >= key
+	})
+	if i == len(t.blocks) {
+		return Entry{}, false, nil
+	}
+	block, err := t.readBlock(t.blocks[i], true)
+	if err != nil {
+		return Entry{}, false, err
+	}
+	return blockGet(block, key)
+}
+
+// Entries returns every record of the table. The blocks are read past the
+// block cache, so a full scan does not push out the blocks of lookups.
+func (t *Table) Entries() (map[string]Entry, error) {
+	return t.PrefixEntries("")
+}
+
+// PrefixEntries returns the records of the keys starting with prefix. Only
+// the blocks the index places such keys in are read, past the block cache.
+func (t *Table) PrefixEntries(prefix string) (map[string]Entry, error) {
+	result := make(map[string]Entry)
+	if t.legacy {
+		for k, offset := range t.offsets {
+			if !strings.HasPrefix(k, prefix) {
+				continue
+			}
+			key, entry, err := t.readLegacyRecord(offset)
+			if err != nil {
+				return nil, err
+			}
+			result[key] = entry
+		}
+		return result, nil
+	}
+
+	// the first block whose last key is not smaller than the prefix
+	i := sort.Search(len(t.blocks), func(i int) bool {
+		return t.blocks[i].lastKey >= prefix
+	})
+	for ; i < len(t.blocks); i++ {
+		h := t.blocks[i]
+		block, err := t.readBlock(h, false)
+		if err != nil {
+			return nil, err
+		}
+		if err := blockEntries(block, prefix, result); err != nil {
+			return nil, err
+		}
+		// the keys of the next blocks are larger than a last key past the prefix
+		if !strings.HasPrefix(h.lastKey, prefix) {
+			break
+		}
+	}
+	return result, nil
+}
+
+// readBlock returns the decoded contents of a data block, taken from and
+// added to the block cache when cached is set.
+func (t *Table) readBlock(h blockHandle, cached bool) ([]byte, error) {
+	c := t.opts.Cache
+	if cached && c != nil {
+		if block, ok := c.Get(t.opts.CacheID, t.opts.FileNum, h.offset); ok {
+			return block, nil
+		}
+	}
+
+	stored := make([]byte, h.size)
+	if _, err := t.file.ReadAt(stored, int64(h.offset)); err != nil {
+		return nil, err
+	}
+	block, err := decodeBlock(stored, t.key)
+	if err != nil {
+		return nil, err
+	}
+	if cached && c != nil {
+		c.Set(t.opts.CacheID, t.opts.FileNum, h.offset, block)
+	}
+	return block, nil
+}
+
+// readLegacyRecord reads the record at the offset of a table written before
+// the block format. Every key and value is compressed and encrypted on its
+// own there, and files written before records were typed only hold values.
+func (t *Table) readLegacyRecord(offset int64) (string, Entry, error) {
+	if offset < 0 || offset >= t.dataEnd {
+		return "", Entry{}, fmt.Errorf("invalid SSStorage format: record offset %d out of range", offset)
+	}
+	r := io.NewSectionReader(t.file, offset, t.dataEnd-offset)
+
+	kind := []byte{KindValue}
+	if t.typed {
+		if _, err := io.ReadFull(r, kind); err != nil {
+			return "", Entry{}, err
+		}
+	}
+
+	decodedKey, err := t.readLegacyField(r)
+	if err != nil {
+		return "", Entry{}, err
+	}
+	valDecoded, err := t.readLegacyField(r)
+	if err != nil {
+		return "", Entry{}, err
+	}
+
+	entry := Entry{Kind: kind[0]}
+	if entry.Kind == KindMerge {
+		entry.Operands, err = DecodeOperands(valDecoded)
+		if err != nil {
+			return "", Entry{}, err
+		}
+	} else {
+		entry.Value = string(valDecoded)
+	}
+	return string(decodedKey), entry, nil
+}
+
+// readLegacyField reads a length prefixed, compressed and optionally
+// encrypted key or value of a legacy record.
+func (t *Table) readLegacyField(r io.Reader) ([]byte, error) {
+	var n int32
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return nil, err
+	}
+	if n < 0 || int64(n) > t.dataEnd {
+		return nil, fmt.Errorf("invalid SSStorage format: record length %d out of range", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	if t.key != nil {
+		var err error
+		b, err = utils.Decrypt(b, t.key)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return snappy.Decode(nil, b)
+}
@@ -7,21 +7,34 @@ package base
 
 import (
 	"fmt"
-	"os"
+	"path/filepath"
 	"strings"
+
+	"github.com/quellington/quelldb/vfs"
 )
 
 type WAL struct {
-	file *os.File
+	file vfs.File
 }
 
 // NewWAL creates a new Write Ahead Log (WAL) at the specified path.
 // It opens the file for appending and creates it if it doesn't exist.
+// The directory is synced, so a log created here survives a crash once
+// its records are synced.
 func NewWAL(path string) (*WAL, error) {
-	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	return NewWALFS(vfs.Default, path)
+}
+
+// NewWALFS is NewWAL on the given file system.
+func NewWALFS(fs vfs.FS, path string) (*WAL, error) {
+	f, err := fs.OpenAppend(path)
 	if err != nil {
 		return nil, err
 	}
+	if err := fs.Sync(filepath.Dir(path)); err != nil {
+		f.Close()
+		return nil, err
+	}
 	return &WAL{file: f}, nil
 }
 
@@ -30,17 +43,22 @@ func NewWAL(path string) (*WAL, error) {
 // The entry is formatted as "op|key|value\n".
 func (w *WAL) Write(op, key, value string) error {
 	line := fmt.Sprintf("%s|%s|%s\n", op, key, value)
-	_, err := w.file.WriteString(line)
+	_, err := w.file.Write([]byte(line))
 	return err
 }
 
 // Write join a new lines to the WAL
 func (w *WAL) WriteLines(lines []string) error {
 	data := strings.Join(lines, "")
-	_, err := w.file.WriteString(data)
+	_, err := w.file.Write([]byte(data))
 	return err
 }
 
+// Sync flushes the written entries to stable storage.
+func (w *WAL) Sync() error {
+	return w.file.Sync()
+}
+
 // Read reads all log entries from the WAL.
 func (w *WAL) Close() error {
 	return w.file.Close()
@@ -5,36 +5,243 @@
 package quelldb
 
 import (
+	"context"
 	"fmt"
-	"os"
+	"io"
+	"log"
 	"path/filepath"
-	"strconv"
-	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/quellington/quelldb/base"
+	"github.com/quellington/quelldb/cache"
 	"github.com/quellington/quelldb/constants"
+	"github.com/quellington/quelldb/utils"
+	"github.com/quellington/quelldb/vfs"
 )
 
 type Options struct {
 	EncryptionKey []byte
 	CompactLimit  uint
+	// BoomBitSize and BoomHashCount fix the number of bits and of hash
+	// functions of every bloom filter. Unset, each filter is sized by the
+	// number of keys of its file, see BloomBitsPerKey.
 	BoomBitSize   uint
 	BoomHashCount uint
+
+	// BloomBitsPerKey is the number of bloom filter bits spent per key,
+	// BLOOM_BITS_PER_KEY_DEFAULT (about 1% false positives) when zero.
+	// BloomFalsePositiveRate derives it from a target false positive
+	// rate instead, such as 0.001.
+	BloomBitsPerKey        float64
+	BloomFalsePositiveRate float64
+
+	// FilterPolicy builds the filters of new SSS files, such as
+	// base.BinaryFuseFilterPolicy for smaller filters than the default Bloom
+	// filters. Files built by a policy this database does not know are
+	// read without their filter.
+	FilterPolicy base.FilterPolicy
+
+	// PrefixExtractor adds a filter over the key prefixes it extracts to
+	// every new SSS file, such as base.DelimitedPrefix(":"). A prefix
+	// iterator skips the files whose prefix filter rules its prefix out.
+	PrefixExtractor base.PrefixExtractor
+
+	// Compression is the codec of the blocks of new SSS files: none,
+	// Snappy (the default), zstd or LZ4. CompressionLevel is the zstd
+	// level, ZSTD_LEVEL_DEFAULT when zero. The records of the manifest are
+	// compressed with the same codec.
+	// BottommostCompression and BottommostCompressionLevel replace them
+	// for the output of compactions into the bottommost level, which holds
+	// most of the data and is rewritten least often, such as zstd at a
+	// higher level. Unset, they are the same as Compression and
+	// CompressionLevel. Open fails for a codec base does not define.
+	Compression                base.Compression
+	CompressionLevel           int
+	BottommostCompression      base.Compression
+	BottommostCompressionLevel int
+
+	// Write stall triggers. A zero value disables the trigger.
+	// Writes are slowed down once a slowdown trigger is reached and
+	// blocked once a stop trigger is reached. A blocked write flushes the
+	// immutable memtables or compacts level 0, whatever brings the
+	// database back under the limit, and fails with the error of that
+	// flush or compaction. The Context variants of the write methods stop
+	// waiting when their context is done.
+	L0SlowdownWritesTrigger         uint
+	L0StopWritesTrigger             uint
+	SoftPendingCompactionBytesLimit uint64
+	HardPendingCompactionBytesLimit uint64
+	MaxImmutableMemtables           uint
+
+	// OnWriteStall is called whenever the write stall condition changes.
+	// It is called from a single goroutine, one change after the other in
+	// the order they happened.
+	OnWriteStall func(WriteStallInfo)
+
+	// CompactionFilter is consulted for every record rewritten by Compact.
+	CompactionFilter CompactionFilter
+
+	// MergeOperator resolves the operands written with Merge.
+	MergeOperator MergeOperator
+
+	// MaxManifestFileSize is the size after which the manifest log is
+	// rolled over to a new file starting with a snapshot of all files.
+	MaxManifestFileSize int64
+
+	// ReadOnly opens the database for reading only. The manifest is loaded
+	// and the WALs are replayed into memory, but no file is created or
+	// written and every mutating method returns ErrReadOnly. No lock is
+	// taken on the directory, so a read-only open works next to a process
+	// that has the database open for writing.
+	ReadOnly bool
+
+	// Logger receives background messages such as the removal of obsolete
+	// files. The standard logger is used when it is nil.
+	Logger *log.Logger
+
+	// SyncWrites syncs the WAL before a write returns, so an acknowledged
+	// write survives a power loss. Without it a write survives a crash of
+	// the process, but may be lost with the machine until the next Flush.
+	SyncWrites bool
+
+	// MaxOpenFiles bounds the number of SSS files kept open together with
+	// their index and bloom filter, MAX_OPEN_FILES_DEFAULT when zero.
+	MaxOpenFiles int
+
+	// RowCacheBytes is the capacity of the cache holding the records Get
+	// reads from SSS files by key, for keys read far more often than they
+	// are written. Zero disables the row cache.
+	RowCacheBytes int64
+
+	// BlockCacheBytes is the capacity of the cache holding decoded SSS
+	// blocks, BLOCK_CACHE_DEFAULT_BYTES when zero.
+	BlockCacheBytes int64
+
+	// BlockCache is a block cache shared with other databases of the
+	// process, see cache.New. It takes precedence over BlockCacheBytes.
+	BlockCache *cache.Cache
+
+	// FS is the file system every file of the database is read from and
+	// written to. The operating system's file system is used when it is nil,
+	// vfs.NewMem keeps the whole database in memory.
+	FS vfs.FS
+}
+
+// frozenMemStorage is an immutable memtable waiting to be flushed,
+// together with the number of the WAL holding its records and the
+// sequence numbers of its writes.
+type frozenMemStorage struct {
+	mem         *base.MemStorage
+	wal         *base.WAL
+	walNum      int
+	smallestSeq uint64
+	largestSeq  uint64
+
+	// walOffset is how far a secondary has read the WAL
+	walOffset int64
 }
 
 type DB struct {
 	memStorage    *base.MemStorage
+	immStorages   []frozenMemStorage
 	wal           *base.WAL
+	walNum        int
 	basePath      string
+	fs            vfs.FS
 	key           []byte
 	compactLimit  uint
 	boomBitSize   uint
 	boomHashCount uint
-	manifestSSSs  []SSSMeta
 	subscribers   map[int]func(ChangeEvent)
 	subLock       sync.RWMutex
 	nextSubID     int
+
+	// bloomBitsPerKey sizes the bloom filters, zero for the default.
+	// filterPolicy replaces them when set.
+	bloomBitsPerKey float64
+	filterPolicy    base.FilterPolicy
+	prefixExtractor base.PrefixExtractor
+
+	// compression and bottommostCompression are the codecs of new SSS
+	// files, see Options.Compression.
+	compression                base.Compression
+	compressionLevel           int
+	bottommostCompression      base.Compression
+	bottommostCompressionLevel int
+
+	// current is the live file set, versions holds it together with every
+	// older version still pinned by a reader. obsoleteDeferred is set when
+	// files were kept only for those older versions. versionNum is the
+	// number of the current version.
+	current          *version
+	versions         map[*version]bool
+	versionNum       uint64
+	obsoleteDeferred bool
+
+	// manifest log state, see logAndApply
+	manifestFile vfs.File
+	manifestName string
+	// manifestDirty is set while a failed manifest write awaits a new
+	// manifest, see abandonManifest
+	manifestDirty   bool
+	manifestSize    int64
+	maxManifestSize int64
+	logNum          int
+	nextFileNum     int
+	seq             uint64
+	// memSmallestSeq is the first sequence number of the mutable memtable
+	memSmallestSeq uint64
+	// pendingOutputs holds the numbers of SSS files being written
+	pendingOutputs map[int]bool
+
+	// fallbackFiles and fallbackLogNum are the SSS files and the oldest
+	// WAL the fallback manifest refers to, kept on disk while Open may
+	// fall back to it. fallbackFiles is nil without a fallback.
+	fallbackFiles  map[string]bool
+	fallbackLogNum int
+
+	// mu guards the memtables, the WAL and the manifest state.
+	mu        sync.Mutex
+	flushMu   sync.Mutex
+	compactMu sync.Mutex
+
+	stall writeStall
+
+	// walErr is set once a WAL write failed, see writeWALLines
+	walErr     error
+	syncWrites bool
+
+	compactionFilter      CompactionFilter
+	compactionFilterStats CompactionFilterStats
+	mergeOperator         MergeOperator
+
+	logger *log.Logger
+
+	// tables keeps SSS files open for reads
+	tables *tableCache
+
+	// rows caches SSS lookups by key, nil when disabled
+	rows *rowCache
+
+	// blockCache holds decoded SSS blocks keyed under cacheID
+	blockCache *cache.Cache
+	cacheID    uint64
+
+	// lockFile holds the exclusive lock on the directory, nil when read-only
+	lockFile io.Closer
+	readOnly bool
+
+	// secondary is set for a secondary following a primary, see OpenSecondary
+	secondary bool
+
+	// closed is set once Close has started, handlers tracks the running
+	// subscriber handlers Close waits for
+	closed   atomic.Bool
+	handlers sync.WaitGroup
+	// released is set once Close let go of the manifest and the WAL, no
+	// edit is logged after that. Guarded by mu.
+	released bool
 }
 
 // Open initializes a new database at the specified path.
@@ -45,23 +252,35 @@ type DB struct {
 // If the key is not provided, the database will be unencrypted.
 // The function returns a pointer to the DB instance and an error if any occurs.
 func Open(path string, opts *Options) (*DB, error) {
-	os.MkdirAll(path, 0755)
-
-	var encryptionKey []byte
+	return open(path, opts, "")
+}
 
-	walLogPath := filepath.Join(path, constants.LOG_FILE)
-	wal, err := base.NewWAL(walLogPath)
-	if err != nil {
-		return nil, err
+// checkCompression rejects codecs outside the ones base defines.
+func checkCompression(opts *Options) error {
+	if !opts.Compression.Valid() {
+		return fmt.Errorf("unknown compression %s", opts.Compression)
+	}
+	if !opts.BottommostCompression.Valid() {
+		return fmt.Errorf("unknown bottommost compression %s", opts.BottommostCompression)
 	}
+	return nil
+}
+
+// open opens the database at path. With a secondary path the database is
+// opened as a read-only secondary following the primary at path, see
+// OpenSecondary.
+func open(path string, opts *Options, secondaryPath string) (_ *DB, err error) {
+	var encryptionKey []byte
 
 	db := &DB{
-		memStorage:    base.NewMemStorage(),
-		basePath:      path,
-		wal:           wal,
-		compactLimit:  constants.SSS_COMPACT_DEFAULT_LIMIT,
-		boomBitSize:   constants.BOOM_BIT_SIZE,
-		boomHashCount: constants.BOOM_HASH_COUNT,
+		memStorage:   base.NewMemStorage(),
+		basePath:     path,
+		fs:           vfs.Default,
+		compactLimit: constants.SSS_COMPACT_DEFAULT_LIMIT,
+
+		maxManifestSize: constants.MANIFEST_MAX_FILE_SIZE,
+		pendingOutputs:  make(map[int]bool),
+		logger:          log.Default(),
 	}
 
 	if opts != nil {
@@ -84,20 +303,211 @@ func Open(path string, opts *Options) (*DB, error) {
 		if opts.BoomHashCount > 0 {
 			db.boomHashCount = opts.BoomHashCount
 		}
+
+		switch {
+		case opts.BloomBitsPerKey > 0:
+			db.bloomBitsPerKey = opts.BloomBitsPerKey
+		case opts.BloomFalsePositiveRate > 0 && opts.BloomFalsePositiveRate < 1:
+			db.bloomBitsPerKey = base.BloomBitsPerKey(opts.BloomFalsePositiveRate)
+		}
+
+		db.filterPolicy = opts.FilterPolicy
+		db.prefixExtractor = opts.PrefixExtractor
+
+		if err := checkCompression(opts); err != nil {
+			return nil, err
+		}
+		db.compression = opts.Compression
+		db.compressionLevel = opts.CompressionLevel
+		db.bottommostCompression = opts.BottommostCompression
+		db.bottommostCompressionLevel = opts.BottommostCompressionLevel
+		if db.bottommostCompression == base.DefaultCompression {
+			db.bottommostCompression = db.compression
+		}
+		if db.bottommostCompressionLevel == 0 {
+			db.bottommostCompressionLevel = db.compressionLevel
+		}
+
+		db.stall.setOptions(opts)
+		db.compactionFilter = opts.CompactionFilter
+		db.mergeOperator = opts.MergeOperator
+
+		if opts.MaxManifestFileSize > 0 {
+			db.maxManifestSize = opts.MaxManifestFileSize
+		}
+
+		if opts.Logger != nil {
+			db.logger = opts.Logger
+		}
+
+		if opts.FS != nil {
+			db.fs = opts.FS
+		}
+
+		db.syncWrites = opts.SyncWrites
+
+		if opts.RowCacheBytes > 0 {
+			db.rows = newRowCache(opts.RowCacheBytes)
+		}
+
+		if opts.BlockCache != nil {
+			db.blockCache = opts.BlockCache
+		} else if opts.BlockCacheBytes > 0 {
+			db.blockCache = cache.New(opts.BlockCacheBytes)
+		}
+	}
+	if db.blockCache == nil {
+		db.blockCache = cache.New(constants.BLOCK_CACHE_DEFAULT_BYTES)
 	}
+	db.cacheID = db.blockCache.NewID()
+
+	maxOpenFiles := constants.MAX_OPEN_FILES_DEFAULT
+	if opts != nil && opts.MaxOpenFiles > 0 {
+		maxOpenFiles = opts.MaxOpenFiles
+	}
+	db.tables = newTableCache(db, maxOpenFiles)
+
+	if opts != nil {
+		db.readOnly = opts.ReadOnly
+	}
+	db.secondary = secondaryPath != ""
+	if db.secondary {
+		db.readOnly = true
+	}
+	if db.readOnly {
+		// nothing is created, the directory must already exist
+		if _, err := db.fs.Stat(path); err != nil {
+			return nil, err
+		}
+		if db.secondary {
+			// the secondary only locks its own directory
+			db.fs.MkdirAll(secondaryPath)
+			lock, err := lockDir(db.fs, secondaryPath)
+			if err != nil {
+				return nil, err
+			}
+			db.lockFile = lock
+		}
+	} else {
+		db.fs.MkdirAll(path)
+		lock, err := lockDir(db.fs, path)
+		if err != nil {
+			return nil, err
+		}
+		db.lockFile = lock
+	}
+
+	defer func() {
+		if err != nil && db.lockFile != nil {
+			db.lockFile.Close()
+		}
+	}()
 
 	// Load the manifest SSS files
-	mnfts, err := LoadManifest(path, encryptionKey)
+	state, manifestName, appendable, err := loadManifestState(db.fs, path, encryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	if manifestName == "" {
+		// SSS files without a manifest mean CURRENT and the manifests were lost
+		tables, err := listSSSFiles(db.fs, path)
+		if err != nil {
+			return nil, err
+		}
+		if len(tables) > 0 {
+			return nil, fmt.Errorf("no manifest found for %d SSS files, run Repair", len(tables))
+		}
+	}
+	db.installVersion(state.files)
+	db.logNum = state.logNumber
+	db.seq = state.lastSequence
+	db.memSmallestSeq = db.seq + 1
+
+	// file numbers must stay ahead of every file already on disk
+	db.nextFileNum = state.nextFileNumber
+	if next, err := utils.NextSSSIDFS(db.fs, path); err == nil && next > db.nextFileNum {
+		db.nextFileNum = next
+	}
+	if manifestName != "" && manifestFileNumber(manifestName) >= db.nextFileNum {
+		db.nextFileNum = manifestFileNumber(manifestName) + 1
+	}
+
+	if db.secondary {
+		// the WALs are tailed from now on, see TryCatchUpWithPrimary
+		db.manifestName = manifestName
+		if err := db.tailWALs(); err != nil {
+			return nil, fmt.Errorf("WAL replay failed: %w", err)
+		}
+		return db, nil
+	}
+
+	// replay every WAL that has not been flushed yet, oldest first
+	logNums, err := utils.LogNumbersFS(db.fs, path)
+	if err != nil {
+		return nil, err
+	}
+	db.walNum = db.logNum
+	walComplete := true
+	for _, num := range logNums {
+		if num >= db.nextFileNum {
+			db.nextFileNum = num + 1
+		}
+		if num < db.logNum {
+			// already flushed into an SSS file
+			continue
+		}
+		walComplete, err = db.replayWAL(filepath.Join(path, utils.LogFileName(num)))
+		if err != nil {
+			return nil, fmt.Errorf("WAL replay failed: %w", err)
+		}
+		db.walNum = num
+	}
+
+	db.manifestName = manifestName
+	if db.readOnly {
+		// the replayed WALs stay in memory, nothing is opened for writing
+		return db, nil
+	}
+
+	// keep appending to the newest WAL, unless it ends in a torn record
+	if !walComplete {
+		db.walNum = db.newFileNumber()
+	}
+	wal, err := base.NewWALFS(db.fs, filepath.Join(path, utils.LogFileName(db.walNum)))
 	if err != nil {
 		return nil, err
 	}
-	db.manifestSSSs = mnfts
+	db.wal = wal
 
-	// Check if the WAL file exists
-	if err := db.replayWAL(walLogPath); err != nil {
-		return nil, fmt.Errorf("WAL replay failed: %w", err)
+	// keep appending edits to an intact manifest log
+	if appendable {
+		f, err := db.fs.OpenAppend(filepath.Join(path, manifestName))
+		if err != nil {
+			return nil, err
+		}
+		stat, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		db.manifestFile, db.manifestSize = f, stat.Size()
 	}
 
+	db.mu.Lock()
+	if manifestName == "" {
+		// a fresh storage gets its manifest before the first SSS file
+		if err := db.logAndApply(&VersionEdit{}); err != nil {
+			db.mu.Unlock()
+			return nil, err
+		}
+	}
+	// a crash may have left files behind that no manifest refers to
+	db.loadFallback()
+	db.advanceFallback()
+	db.collectObsoleteFiles()
+	db.updateWriteStall()
+	db.mu.Unlock()
+
 	return db, nil
 }
 
@@ -107,7 +517,35 @@ func Open(path string, opts *Options) (*DB, error) {
 // If the key already exists, it will be updated with the new value.
 // The value is stored in plaintext, and if encryption is enabled, it will be encrypted before writing to the WAL.
 func (db *DB) Put(key, value string) error {
-	db.memStorage.Put(key, value)
+	return db.PutContext(context.Background(), key, value)
+}
+
+// PutContext stores a key-value pair in the database like Put.
+// If writes are stalled because compaction is falling behind, PutContext
+// waits until the stall clears or the context is done, whichever comes first.
+func (db *DB) PutContext(ctx context.Context, key, value string) error {
+	if err := db.writable(); err != nil {
+		return err
+	}
+	if err := db.waitForWriteRoom(ctx); err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	if db.closed.Load() {
+		db.mu.Unlock()
+		return ErrClosed
+	}
+	// the WAL comes first, a write it does not hold never reaches the memtable
+	err := db.writeWAL(constants.PUT, key, value)
+	if err == nil {
+		db.seq++
+		db.memStorage.Put(key, value)
+	}
+	db.mu.Unlock()
+	if err != nil {
+		return err
+	}
 
 	// Publish to subscribers
 	db.publish(ChangeEvent{
@@ -116,74 +554,143 @@ func (db *DB) Put(key, value string) error {
 		Value: value,
 	})
 
-	return db.wal.Write(constants.PUT, key, value)
+	return nil
 }
 
 // PutBatch stores multiple key-value pairs in the database.
 // It first stores the pairs in memory and then writes them to the WAL.
 // If the key already exists, it will be updated with the new value.
 func (db *DB) PutBatch(kvs map[string]string) error {
+	return db.PutBatchContext(context.Background(), kvs)
+}
+
+// PutBatchContext stores multiple key-value pairs like PutBatch, waiting
+// for a write stall to clear like PutContext.
+func (db *DB) PutBatchContext(ctx context.Context, kvs map[string]string) error {
+	if err := db.writable(); err != nil {
+		return err
+	}
 	if len(kvs) == 0 {
 		return nil
 	}
 
+	if err := db.waitForWriteRoom(ctx); err != nil {
+		return err
+	}
+
 	var wls []string
 
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed.Load() {
+		return ErrClosed
+	}
 	for key, value := range kvs {
-		db.memStorage.Put(key, value)
 		wls = append(wls, fmt.Sprintf("%s|%s|%s\n", constants.PUT, key, value))
 	}
+	if err := db.writeWALLines(wls); err != nil {
+		return err
+	}
 
-	return db.wal.WriteLines(wls)
+	db.seq += uint64(len(kvs))
+	for key, value := range kvs {
+		db.memStorage.Put(key, value)
+	}
+	return nil
 }
 
 // Get retrieves the value associated with the given key.
-// It first checks the in-memory storage and then searches through the SSS files in reverse order.
+// It first checks the in-memory storage and then searches through the SSS files level by level,
+// newest level 0 file first.
 // The function returns the value and error whether the key was found.
 // If the key is not found in memory or in any SSS files, it returns an empty string and false.
 // If the key is found, the value is returned in plaintext.
 // If encryption is enabled, the value will be decrypted before returning.
 // The function also handles the case where the key is not found in any SSS files.
 // If the key is found in memory, it will be returned immediately without checking the SSS files.
+// Merge operands found on the way are collected until a value or tombstone
+// is reached and then resolved through the merge operator.
 func (db *DB) Get(key string) (string, error) {
-	// check MemS first
-	if val, ok := db.memStorage.Get(key); ok {
-		return val, nil
-	}
-
-	// check from newest SSS to oldest
-	files, _ := os.ReadDir(db.basePath)
-	for i := len(files) - 1; i >= 0; i-- {
-		f := files[i]
-		if strings.HasPrefix(f.Name(), constants.SSS_PREFIX) {
-			path := filepath.Join(db.basePath, f.Name())
-
-			// check bloom filter
-			// if the bloom filter is not found, skip this file
-			filter, err := base.LoadBloomFilter(path+constants.SSS_BOOM_FILTER_SUFFIX, constants.BOOM_BIT_SIZE, constants.BOOM_HASH_COUNT)
-			if err == nil && !filter.Test(key) {
-				// key not in bloom filter, skip this file
-				continue
-			}
+	if db.closed.Load() {
+		return "", ErrClosed
+	}
+	var merges []base.Entry
 
-			data, _ := base.ReadSSStorage(path, db.key)
-			if val, ok := data[key]; ok {
-				return val, nil
+	mems, v := db.readState()
+	defer db.releaseVersion(v)
+
+	// check MemS first, then the memtables waiting to be flushed
+	for _, ms := range mems {
+		if entry, ok := ms.GetEntry(key); ok {
+			if entry.Kind != base.KindMerge {
+				return db.getResult(key, entry, merges)
 			}
+			merges = append(merges, entry)
+		}
+	}
+
+	entry, sssMerges, err := db.sssGet(v, key)
+	if err != nil {
+		return "", err
+	}
+	return db.getResult(key, entry, append(merges, sssMerges...))
+}
+
+// getResult stacks the merge records collected by Get, newest first,
+// on top of the record found below them.
+func (db *DB) getResult(key string, entry base.Entry, merges []base.Entry) (string, error) {
+	var err error
+	for i := len(merges) - 1; i >= 0; i-- {
+		entry, err = db.combineEntries(key, entry, merges[i])
+		if err != nil {
+			return "", err
 		}
 	}
-	return "", fmt.Errorf("key not found")
 
+	val, ok, err := db.resolveEntry(key, entry)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", fmt.Errorf("key not found")
+	}
+	return val, nil
 }
 
 // Delete removes the key-value pair associated with the given key.
-// It first deletes the pair from memory and then writes the delete operation to the WAL.
+// It first stores a tombstone for the key in memory and then writes the delete operation to the WAL.
+// The tombstone hides older values of the key in the SSS files until compaction drops them.
 // The function returns an error if any occurs during the write operation.
 // If the key does not exist, it will not raise an error.
 // The function does not check the SSS files for the key before deleting it from memory.
-// If the key is found in memory, it will be deleted immediately.
 func (db *DB) Delete(key string) error {
-	db.memStorage.Delete(key)
+	return db.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext removes the key like Delete, waiting for a write stall to
+// clear like PutContext.
+func (db *DB) DeleteContext(ctx context.Context, key string) error {
+	if err := db.writable(); err != nil {
+		return err
+	}
+	if err := db.waitForWriteRoom(ctx); err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	if db.closed.Load() {
+		db.mu.Unlock()
+		return ErrClosed
+	}
+	err := db.writeWAL(constants.DELETE, key, "")
+	if err == nil {
+		db.seq++
+		db.memStorage.Delete(key)
+	}
+	db.mu.Unlock()
+	if err != nil {
+		return err
+	}
 
 	// Publish to subscribers
 	db.publish(ChangeEvent{
@@ -191,51 +698,133 @@ func (db *DB) Delete(key string) error {
 		Key:  key,
 	})
 
-	return db.wal.Write(constants.DELETE, key, "")
+	return nil
 }
 
 // Flush writes the in-memory data to a new SSS file.
-// It generates a new filename based on the highest existing SSS file number.
+// The current MemStorage is frozen as an immutable memtable and a fresh
+// MemStorage and WAL take over new writes while the frozen one is written.
+// Frozen memtables left behind by an earlier failed flush are written first.
 // The new file will be named with the format "sss_00001.qldb".
+// Once the manifest records the file the WAL of the frozen memtable is removed.
 // The function returns an error if any occurs during the write operation.
 func (db *DB) Flush() error {
-	files, _ := os.ReadDir(db.basePath)
-	id := 0
-	for _, f := range files {
-		if strings.HasPrefix(f.Name(), constants.SSS_PREFIX) {
-			numStr := strings.TrimSuffix(strings.TrimPrefix(f.Name(), constants.SSS_PREFIX), constants.SSS_SUFFIX)
-			num, _ := strconv.Atoi(numStr)
-			if num >= id {
-				id = num + 1
-			}
+	if err := db.writable(); err != nil {
+		return err
+	}
+	return db.flush()
+}
+
+// flush freezes the mutable memtable and writes every pending frozen
+// memtable to an SSS file, see Flush.
+func (db *DB) flush() error {
+	db.flushMu.Lock()
+	defer db.flushMu.Unlock()
+
+	db.mu.Lock()
+	// a WAL that failed a write is replaced even without records to flush
+	if db.memStorage.Len() > 0 || db.walErr != nil {
+		newWALNum := db.newFileNumber()
+		newWAL, err := base.NewWALFS(db.fs, filepath.Join(db.basePath, utils.LogFileName(newWALNum)))
+		if err != nil {
+			db.mu.Unlock()
+			return err
+		}
+		if db.memStorage.Len() > 0 {
+			db.immStorages = append(db.immStorages, frozenMemStorage{
+				mem:         db.memStorage,
+				wal:         db.wal,
+				walNum:      db.walNum,
+				smallestSeq: db.memSmallestSeq,
+				largestSeq:  db.seq,
+			})
+			db.memStorage = base.NewMemStorage()
+			db.memSmallestSeq = db.seq + 1
+		} else {
+			db.wal.Close()
 		}
+		db.wal, db.walNum, db.walErr = newWAL, newWALNum, nil
+		db.updateWriteStall()
 	}
+	pending := append([]frozenMemStorage(nil), db.immStorages...)
+	db.mu.Unlock()
+
+	for _, imm := range pending {
+		if err := db.flushMemStorage(imm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	filename := fmt.Sprintf("%s%05d%s", constants.SSS_PREFIX, id, constants.SSS_SUFFIX)
-	path := filepath.Join(db.basePath, filename)
+// flushMemStorage writes a frozen memtable to a new level 0 SSS file and
+// records it in the manifest. A memtable whose records have all expired
+// since it was frozen is dropped without writing a file.
+func (db *DB) flushMemStorage(imm frozenMemStorage) error {
+	edit := &VersionEdit{}
+	entries := imm.mem.Entries()
+	if len(entries) > 0 {
+		db.mu.Lock()
+		id := db.newFileNumber()
+		db.addPendingOutput(id)
+		db.mu.Unlock()
+		defer func() {
+			db.mu.Lock()
+			db.removePendingOutput(id)
+			db.mu.Unlock()
+		}()
+
+		filename := fmt.Sprintf("%s%05d%s", constants.SSS_PREFIX, id, constants.SSS_SUFFIX)
+		path := filepath.Join(db.basePath, filename)
+
+		opts := db.writerOptions(false)
+		opts.SmallestSeq, opts.LargestSeq = imm.smallestSeq, imm.largestSeq
+		minKey, maxKey, err := base.WriteSSStorageEntriesFS(db.fs, path, entries, db.key, opts)
+		if err != nil {
+			return err
+		}
+		meta, err := newSSSMeta(db.fs, db.basePath, filename, 0, entries, minKey, maxKey, imm.smallestSeq, imm.largestSeq)
+		if err != nil {
+			return err
+		}
+		edit.AddFile(meta)
+	}
 
-	minKey, maxKey, err := base.WriteSSStorage(path, db.memStorage.All(), db.key)
+	db.mu.Lock()
+	db.removeImmStorage(imm.mem)
 
+	// WALs older than the oldest memtable still in memory are obsolete
+	logNum := db.walNum
+	if len(db.immStorages) > 0 {
+		logNum = db.immStorages[0].walNum
+	}
+	edit.SetLogNumber(logNum)
+	err := db.logAndApply(edit)
+	if err != nil {
+		// keep the memtable around for the next flush
+		db.immStorages = append([]frozenMemStorage{imm}, db.immStorages...)
+	}
+	db.updateWriteStall()
+	db.mu.Unlock()
 	if err != nil {
 		return err
 	}
 
-	db.manifestSSSs = append(db.manifestSSSs, SSSMeta{
-		Filename: filename,
-		MinKey:   minKey,
-		MaxKey:   maxKey,
-	})
+	// frozen data is now in the SSS file, its WAL fell behind the log
+	// number and was removed by the obsolete file collection
+	imm.mem.Close()
+	imm.wal.Close()
 
-	return SaveManifest(db.basePath, db.manifestSSSs, db.key)
+	return nil
 }
 
-// Close closes the database and the WAL.
-// It ensures that all data is flushed to the SSS files and the WAL is closed properly.
-// The function returns an error if any occurs during the close operation.
-// It is important to call this function when you are done using the database to ensure data integrity.
-// The function does not delete any SSS files or the WAL file.
-// It only closes the file handles and ensures that all data is written to disk.
-// After calling this function, the database instance should not be used anymore.
-func (db *DB) Close() error {
-	return db.wal.Close()
+// removeImmStorage drops a flushed memtable from the immutable list.
+// The caller must hold db.mu.
+func (db *DB) removeImmStorage(imm *base.MemStorage) {
+	for i, frozen := range db.immStorages {
+		if frozen.mem == imm {
+			db.immStorages = append(db.immStorages[:i], db.immStorages[i+1:]...)
+			return
+		}
+	}
 }
@@ -0,0 +1,45 @@
+// Copyright 2025 The QuellDB Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be found in
+// the LICENSE file.
+
+package quelldb
+
+import (
+	"github.com/quellington/quelldb/base"
+	"github.com/quellington/quelldb/cache"
+)
+
+// writerOptions returns how SSS files are written, with the bottommost
+// codec for files written into the bottommost level.
+func (db *DB) writerOptions(bottommost bool) base.WriterOptions {
+	opts := base.WriterOptions{
+		FilterPolicy:     db.filterPolicy,
+		PrefixExtractor:  db.prefixExtractor,
+		BloomBitsPerKey:  db.bloomBitsPerKey,
+		BloomBits:        uint32(db.boomBitSize),
+		BloomHashCount:   uint8(min(db.boomHashCount, 255)),
+		Compression:      db.compression,
+		CompressionLevel: db.compressionLevel,
+	}
+	if bottommost {
+		opts.Compression = db.bottommostCompression
+		opts.CompressionLevel = db.bottommostCompressionLevel
+	}
+	return opts
+}
+
+// tableOptions returns how the SSS file is read.
+func (db *DB) tableOptions(meta SSSMeta) base.TableOptions {
+	return base.TableOptions{
+		Cache:   db.blockCache,
+		CacheID: db.cacheID,
+		FileNum: uint64(sssFileNumber(meta.Filename)),
+	}
+}
+
+// BlockCacheStats returns the hit, miss and eviction counts and the usage of
+// the block cache. A cache shared through Options.BlockCache counts the
+// blocks of every database using it.
+func (db *DB) BlockCacheStats() cache.Stats {
+	return db.blockCache.Stats()
+}
@@ -0,0 +1,171 @@
+// Copyright 2025 The QuellDB Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be found in
+// the LICENSE file.
+
+// Package cache implements the block cache holding decoded SSS blocks.
+// A single cache can be shared by several databases of one process, each
+// database keys its blocks under its own ID.
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// numShards is the number of independently locked LRU lists.
+const numShards = 16
+
+// blockKey identifies a block by the owner ID, the file number and the
+// offset of the block in the file.
+type blockKey struct {
+	id, fileNum, offset uint64
+}
+
+type cacheEntry struct {
+	key   blockKey
+	value []byte
+}
+
+// shard is an LRU list of blocks, most recently used first.
+type shard struct {
+	mu       sync.Mutex
+	capacity int64
+	size     int64
+	lru      *list.List
+	items    map[blockKey]*list.Element
+}
+
+// Cache is a sharded LRU cache of decoded blocks, bounded by the total size
+// of the blocks it holds. It is safe for concurrent use.
+type Cache struct {
+	shards   [numShards]shard
+	capacity int64
+	nextID   atomic.Uint64
+
+	hits, misses, inserts, evictions atomic.Uint64
+}
+
+// Stats is a snapshot of the counters of a Cache.
+type Stats struct {
+	Hits      uint64
+	Misses    uint64
+	Inserts   uint64
+	Evictions uint64
+	// Entries and Size are the number and the total bytes of the blocks
+	// held, Capacity is the most the cache holds.
+	Entries  int
+	Size     int64
+	Capacity int64
+}
+
+// New returns a cache holding up to capacity bytes of blocks.
+func New(capacity int64) *Cache {
+	c := &Cache{capacity: capacity}
+	for i := range c.shards {
+		c.shards[i] = shard{
+			capacity: capacity / numShards,
+			lru:      list.New(),
+			items:    make(map[blockKey]*list.Element),
+		}
+	}
+	return c
+}
+
+// NewID returns an ID no other user of the cache has, to key the blocks
+// of one database by.
+func (c *Cache) NewID() uint64 {
+	return c.nextID.Add(1)
+}
+
+func (c *Cache) shard(k blockKey) *shard {
+	h := k.id*0x9e3779b97f4a7c15 ^ k.fileNum*0xc2b2ae3d27d4eb4f ^ k.offset
+	h ^= h >> 29
+	return &c.shards[h%numShards]
+}
+
+// Get returns the block at the offset of a file and marks it as recently used.
+func (c *Cache) Get(id, fileNum, offset uint64) ([]byte, bool) {
+	k := blockKey{id, fileNum, offset}
+	s := c.shard(k)
+	s.mu.Lock()
+	e, ok := s.items[k]
+	if ok {
+		s.lru.MoveToFront(e)
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.hits.Add(1)
+	return e.Value.(*cacheEntry).value, true
+}
+
+// Set stores the block at the offset of a file, evicting the least recently
+// used blocks of its shard to make room. The value must not be modified
+// afterwards. Blocks larger than a shard are not cached.
+func (c *Cache) Set(id, fileNum, offset uint64, value []byte) {
+	k := blockKey{id, fileNum, offset}
+	s := c.shard(k)
+	charge := int64(len(value))
+	if charge > s.capacity {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.items[k]; ok {
+		s.size -= int64(len(e.Value.(*cacheEntry).value))
+		s.lru.Remove(e)
+	}
+	s.items[k] = s.lru.PushFront(&cacheEntry{key: k, value: value})
+	s.size += charge
+	c.inserts.Add(1)
+
+	for s.size > s.capacity {
+		c.evictions.Add(1)
+		s.remove(s.lru.Back())
+	}
+}
+
+// EvictFile drops every block of a file, once the file is deleted.
+func (c *Cache) EvictFile(id, fileNum uint64) {
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		for k, e := range s.items {
+			if k.id == id && k.fileNum == fileNum {
+				s.remove(e)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// remove drops an entry. The caller must hold s.mu.
+func (s *shard) remove(e *list.Element) {
+	entry := s.lru.Remove(e).(*cacheEntry)
+	delete(s.items, entry.key)
+	s.size -= int64(len(entry.value))
+}
+
+// Stats returns the counters of the cache, summed over every user.
+func (c *Cache) Stats() Stats {
+	stats := Stats{
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Inserts:   c.inserts.Load(),
+		Evictions: c.evictions.Load(),
+		Capacity:  c.capacity,
+	}
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		stats.Entries += len(s.items)
+		stats.Size += s.size
+		s.mu.Unlock()
+	}
+	return stats
+}
@@ -0,0 +1,125 @@
+// Copyright 2025 The QuellDB Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be found in
+// the LICENSE file.
+
+package quelldb
+
+import "context"
+
+// CloseOptions controls CloseContext.
+type CloseOptions struct {
+	// Flush writes the memtables to SSS files before closing, so the next
+	// Open has no WAL to replay. Without it unflushed writes are recovered
+	// from the WAL.
+	Flush bool
+}
+
+// Close closes the database like CloseContext without a deadline and
+// without flushing. Unflushed writes stay in the WAL and are replayed by
+// the next Open.
+func (db *DB) Close() error {
+	return db.CloseContext(context.Background(), nil)
+}
+
+// CloseContext closes the database. New calls are refused with ErrClosed
+// right away, writers blocked by a write stall give up, no change event is
+// published any more, and the memtables are flushed first if requested. It
+// then waits for a running flush or compaction, for the write stall and
+// subscriber handlers still running, stops the TTL eviction of every
+// memtable and releases the WAL, the manifest and the directory lock.
+// When the context is done before the running work finished, the WAL and
+// the manifest are released anyway and the context error is returned. The
+// running work can no longer log an edit to the manifest, and the
+// directory stays locked until it stopped.
+// Only the first call closes the database, later calls return ErrClosed.
+func (db *DB) CloseContext(ctx context.Context, opts *CloseOptions) error {
+	db.mu.Lock()
+	if db.closed.Load() {
+		db.mu.Unlock()
+		return ErrClosed
+	}
+	db.closed.Store(true)
+	// wake writers waiting for a stall to clear, they see the database closed
+	if db.stall.changed != nil {
+		close(db.stall.changed)
+		db.stall.changed = nil
+	}
+	db.mu.Unlock()
+
+	// a publish that did not see the database closed has added its
+	// handlers once the subscriber lock is free
+	db.subLock.Lock()
+	db.subLock.Unlock()
+
+	var err error
+	if opts != nil && opts.Flush && !db.readOnly {
+		err = db.flush()
+	}
+
+	// wait for background work, stall handlers and subscriber handlers
+	stopped := make(chan struct{})
+	idle := make(chan struct{})
+	go func() {
+		db.stall.work.Wait()
+		db.flushMu.Lock()
+		db.compactMu.Lock()
+		close(stopped)
+		db.handlers.Wait()
+		db.compactMu.Unlock()
+		db.flushMu.Unlock()
+		close(idle)
+	}()
+	select {
+	case <-idle:
+	case <-ctx.Done():
+		if err == nil {
+			err = ctx.Err()
+		}
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.released = true
+	db.memStorage.Close()
+	for _, imm := range db.immStorages {
+		imm.mem.Close()
+		if imm.wal != nil {
+			imm.wal.Close()
+		}
+	}
+	db.tables.close()
+	if db.manifestFile != nil {
+		db.manifestFile.Close()
+		db.manifestFile = nil
+	}
+	if db.wal != nil {
+		if walErr := db.wal.Close(); err == nil {
+			err = walErr
+		}
+	}
+	if lock := db.lockFile; lock != nil {
+		db.lockFile = nil
+		select {
+		case <-stopped:
+			lock.Close()
+		default:
+			// a flush or compaction may still write files
+			go func() {
+				<-stopped
+				lock.Close()
+			}()
+		}
+	}
+	return err
+}
+
+// writable reports why the database refuses writes, if it does.
+func (db *DB) writable() error {
+	if db.closed.Load() {
+		return ErrClosed
+	}
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	return nil
+}
@@ -6,75 +6,206 @@ package quelldb
 
 import (
 	"fmt"
-	"os"
 	"path/filepath"
 
 	"github.com/quellington/quelldb/base"
 	"github.com/quellington/quelldb/constants"
-	"github.com/quellington/quelldb/utils"
 )
 
 // Compact merges multiple SSStorage into a single one.
-// It reads all SSStorages in the base path, merges them into a single map,
-// and writes the merged data into a new SSStorage file.
-// The old SSStorage files are deleted after the merge.
+// Once the number of level 0 SSStorages reaches the compact limit, it
+// merges all of them together with every deeper SSStorage overlapping
+// their key ranges into a single map,
+// and writes the merged data into a new SSStorage file on level 1 or below.
+// The old SSStorage files are deleted once the manifest records the merge.
 func (db *DB) Compact() error {
+	if err := db.writable(); err != nil {
+		return err
+	}
+	return db.compact(int(db.compactLimit))
+}
+
+// compact compacts the level 0 SSS files once there are at least limit of
+// them, see Compact.
+func (db *DB) compact(limit int) error {
+	db.compactMu.Lock()
+	defer db.compactMu.Unlock()
+	if db.closed.Load() {
+		return ErrClosed
+	}
+
+	// the inputs stay on disk until the compaction is done with them
+	v := db.pinVersion()
+	defer db.releaseVersion(v)
+	current := v.files
 
-	if len(db.manifestSSSs) < int(db.compactLimit) {
+	l0 := filesAtLevel(current, 0)
+	if len(l0) < limit || len(l0) == 0 {
 		return nil
 	}
 
-	var toCompact []SSSMeta
-	basep := db.manifestSSSs[0]
-	toCompact = append(toCompact, basep)
 	// select overlapping SSTs for compaction
-	for _, sst := range db.manifestSSSs[1:] {
-		if overlapsAny(sst, toCompact) {
-			toCompact = append(toCompact, sst)
+	toCompact := expandOverlapping(l0, current)
+
+	// never move data up, output goes to the deepest input level
+	level := 1
+	for _, f := range toCompact {
+		if f.Level > level {
+			level = f.Level
 		}
 	}
 
-	// if not enough overlapping SSTs to trigger compaction
-	if uint(len(toCompact)) < db.compactLimit {
-		return nil
+	merged, err := db.mergeSSSFiles(toCompact, current, CompactionFilterContext{
+		Level:      level,
+		InputFiles: len(toCompact),
+	}, nil)
+	if err != nil {
+		return err
 	}
 
-	merged := make(map[string]string)
+	// write merged SSStorage, unless nothing is left
+	output, err := db.writeCompactionOutput(toCompact, current, merged, level)
+	if err != nil {
+		return err
+	}
 
-	for _, f := range toCompact {
-		fullPath := filepath.Join(db.basePath, f.Filename)
-		data, err := base.ReadSSStorage(fullPath, db.key)
+	// update manifest, flushes may have added files in the meantime.
+	// The inputs are deleted by the obsolete file collection once the
+	// manifest no longer refers to them.
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	err = db.logAndApply(compactionEdit(toCompact, output))
+	db.releaseOutputs(output)
+	db.updateWriteStall()
+	return err
+}
+
+// compactionEdit records the replacement of the compaction inputs by its outputs.
+func compactionEdit(inputs, outputs []SSSMeta) *VersionEdit {
+	edit := &VersionEdit{}
+	for _, f := range inputs {
+		edit.DeleteFile(f)
+	}
+	for _, f := range outputs {
+		edit.AddFile(f)
+	}
+	return edit
+}
+
+// mergeSSSFiles reads the records of the given SSS files, oldest first, and
+// stacks them into a single map. When the output goes to the bottommost
+// level, see isBottommostLevel, tombstones are dropped and merge operands
+// fully resolved.
+// The compaction filter runs over the merged values and onRead, if set,
+// is called after each input file has been read.
+func (db *DB) mergeSSSFiles(inputs, current []SSSMeta, ctx CompactionFilterContext, onRead func(SSSMeta)) (map[string]base.Entry, error) {
+	merged := make(map[string]base.Entry)
+
+	ordered := readOrder(inputs)
+	for i := len(ordered) - 1; i >= 0; i-- {
+		fullPath := filepath.Join(db.basePath, ordered[i].Filename)
+		data, err := base.ReadSSStorageEntriesFS(db.fs, fullPath, db.key)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		for k, v := range data {
-			merged[k] = v
+		for k, entry := range data {
+			if older, ok := merged[k]; ok {
+				entry, err = db.combineEntries(k, older, entry)
+				if err != nil {
+					return nil, err
+				}
+			}
+			merged[k] = entry
+		}
+		if onRead != nil {
+			onRead(ordered[i])
+		}
+	}
+
+	// tombstones are kept until they reach the bottommost level, the same
+	// one the bottommost codec is picked for
+	ctx.Bottommost = isBottommostLevel(inputs, current, ctx.Level)
+	if ctx.Bottommost {
+		for k, entry := range merged {
+			val, ok, err := db.resolveEntry(k, entry)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				delete(merged, k)
+				continue
+			}
+			merged[k] = base.Entry{Kind: base.KindValue, Value: val}
 		}
-		os.Remove(fullPath)
-		os.Remove(fullPath + constants.SSS_BOOM_FILTER_SUFFIX)
 	}
 
-	// if there are less than 2 SSStorages, no need to merge
-	// if uint(len(sstPaths)) < db.compactLimit {
-	// 	return nil
-	// }
+	return db.filterCompaction(ctx, merged), nil
+}
 
-	// write merged SSStorage
-	id, _ := utils.NextSSSID(db.basePath)
+// writeCompactionOutput writes the merged records of the inputs into a new
+// SSS file on the given level. Nothing is written when every record was dropped.
+// An output into the bottommost level of current is written with the
+// bottommost codec.
+// The outputs stay pending, and out of reach of the obsolete file
+// collection, until the caller releases them with releaseOutputs.
+func (db *DB) writeCompactionOutput(inputs, current []SSSMeta, merged map[string]base.Entry, level int) (outputs []SSSMeta, err error) {
+	if len(merged) == 0 {
+		return nil, nil
+	}
+
+	db.mu.Lock()
+	id := db.newFileNumber()
+	db.addPendingOutput(id)
+	db.mu.Unlock()
+	defer func() {
+		if err != nil {
+			db.mu.Lock()
+			db.removePendingOutput(id)
+			db.mu.Unlock()
+		}
+	}()
 	newSSSFile := fmt.Sprintf(constants.SSS_PREFIX+"%05d"+constants.SSS_SUFFIX, id)
 	newPath := filepath.Join(db.basePath, newSSSFile)
-	minKey, maxKey, err := base.WriteSSStorage(newPath, merged, db.key)
+
+	// the output holds the writes of all of its inputs
+	var smallestSeq, largestSeq uint64
+	for i, f := range inputs {
+		if i == 0 || f.SmallestSeq < smallestSeq {
+			smallestSeq = f.SmallestSeq
+		}
+		if f.LargestSeq > largestSeq {
+			largestSeq = f.LargestSeq
+		}
+	}
+	opts := db.writerOptions(isBottommostLevel(inputs, current, level))
+	opts.SmallestSeq, opts.LargestSeq = smallestSeq, largestSeq
+	minKey, maxKey, err := base.WriteSSStorageEntriesFS(db.fs, newPath, merged, db.key, opts)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	meta, err := newSSSMeta(db.fs, db.basePath, newSSSFile, level, merged, minKey, maxKey, smallestSeq, largestSeq)
+	if err != nil {
+		return nil, err
 	}
+	return []SSSMeta{meta}, nil
+}
 
-	// update manifest
-	db.manifestSSSs = removeCompactedSSSs(db.manifestSSSs, toCompact)
-	db.manifestSSSs = append(db.manifestSSSs, SSSMeta{
-		Filename: newSSSFile,
-		MinKey:   minKey,
-		MaxKey:   maxKey,
-	})
+// isBottommostLevel reports whether a compaction of the inputs writes into
+// the bottommost level, with no file outside the inputs on a deeper level.
+func isBottommostLevel(inputs, current []SSSMeta, level int) bool {
+	for _, f := range removeCompactedSSSs(current, inputs) {
+		if f.Level > level {
+			return false
+		}
+	}
+	return true
+}
 
-	return SaveManifest(db.basePath, db.manifestSSSs, db.key)
+// releaseOutputs drops compaction outputs from the pending set once the
+// manifest edit recording them has been attempted.
+// The caller must hold db.mu.
+func (db *DB) releaseOutputs(outputs []SSSMeta) {
+	for _, f := range outputs {
+		db.removePendingOutput(sssFileNumber(f.Filename))
+	}
 }
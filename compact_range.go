@@ -0,0 +1,147 @@
+// Copyright 2025 The QuellDB Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be found in
+// the LICENSE file.
+
+package quelldb
+
+import (
+	"fmt"
+
+	"github.com/quellington/quelldb/constants"
+)
+
+// CompactRangeOptions controls a manual CompactRange.
+type CompactRangeOptions struct {
+	// Exclusive makes CompactRange wait for a running compaction to finish
+	// and keeps other compactions out until it returns. Without it
+	// CompactRange fails right away when another compaction is running.
+	Exclusive bool
+
+	// TargetLevel is the level the rewritten files are written to.
+	// Zero selects the bottom level.
+	TargetLevel int
+
+	// OnProgress receives an event for every step of the compaction, from
+	// started to completed. Nothing is reported when CompactRange fails
+	// before the compaction started, such as on the initial flush.
+	OnProgress func(CompactRangeEvent)
+}
+
+// Stages reported in CompactRangeEvent.
+const (
+	CompactRangeStarted       = "started"
+	CompactRangeFileRead      = "file-read"
+	CompactRangeOutputWritten = "output-written"
+	CompactRangeCompleted     = "completed"
+)
+
+// CompactRangeEvent reports the progress of a CompactRange call.
+type CompactRangeEvent struct {
+	Stage       string
+	Start       string
+	End         string
+	TargetLevel int
+	InputFiles  int
+	FilesRead   int
+	OutputFiles int
+	Filename    string
+	Err         error
+}
+
+// CompactRange rewrites every SSS file overlapping the key interval
+// [start, end] into the target level, the bottom level by default.
+// An empty start or end leaves that side of the interval open.
+// Files overlapping the rewritten ones are pulled in as well, so no older
+// version of a key survives next to the output and tombstones in the
+// range are dropped for good. Unflushed memtable data is flushed first.
+func (db *DB) CompactRange(start, end string, opts *CompactRangeOptions) (err error) {
+	if err := db.writable(); err != nil {
+		return err
+	}
+	if opts == nil {
+		opts = &CompactRangeOptions{}
+	}
+	level := opts.TargetLevel
+	if level == 0 {
+		level = constants.NUM_LEVELS - 1
+	}
+	if level < 0 || level >= constants.NUM_LEVELS {
+		return fmt.Errorf("target level %d out of range", opts.TargetLevel)
+	}
+	if start != "" && end != "" && start > end {
+		return fmt.Errorf("invalid range: start %q after end %q", start, end)
+	}
+
+	event := CompactRangeEvent{Start: start, End: end, TargetLevel: level}
+	progress := func(stage string) {
+		if opts.OnProgress != nil {
+			event.Stage = stage
+			opts.OnProgress(event)
+		}
+	}
+	if err := db.Flush(); err != nil {
+		return err
+	}
+
+	if opts.Exclusive {
+		db.compactMu.Lock()
+	} else if !db.compactMu.TryLock() {
+		return fmt.Errorf("another compaction is running")
+	}
+	defer db.compactMu.Unlock()
+
+	// the inputs stay on disk until the compaction is done with them
+	v := db.pinVersion()
+	defer db.releaseVersion(v)
+	current := v.files
+
+	var seed []SSSMeta
+	for _, f := range current {
+		if !(f.MaxKey < start || (end != "" && f.MinKey > end)) {
+			seed = append(seed, f)
+		}
+	}
+	toCompact := expandOverlapping(seed, current)
+	event.InputFiles = len(toCompact)
+	progress(CompactRangeStarted)
+	defer func() {
+		event.Err = err
+		progress(CompactRangeCompleted)
+	}()
+	if len(toCompact) == 0 {
+		return nil
+	}
+
+	merged, err := db.mergeSSSFiles(toCompact, current, CompactionFilterContext{
+		Level:      level,
+		InputFiles: len(toCompact),
+		IsManual:   true,
+	}, func(f SSSMeta) {
+		event.FilesRead++
+		event.Filename = f.Filename
+		progress(CompactRangeFileRead)
+	})
+	if err != nil {
+		return err
+	}
+
+	output, err := db.writeCompactionOutput(toCompact, current, merged, level)
+	if err != nil {
+		return err
+	}
+	event.OutputFiles = len(output)
+	event.Filename = ""
+	if len(output) > 0 {
+		event.Filename = output[0].Filename
+	}
+	progress(CompactRangeOutputWritten)
+
+	// inputs are removed by the obsolete file collection once the
+	// manifest no longer refers to them
+	db.mu.Lock()
+	err = db.logAndApply(compactionEdit(toCompact, output))
+	db.releaseOutputs(output)
+	db.updateWriteStall()
+	db.mu.Unlock()
+	return err
+}
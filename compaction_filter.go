@@ -0,0 +1,101 @@
+// Copyright 2025 The QuellDB Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be found in
+// the LICENSE file.
+
+package quelldb
+
+import "github.com/quellington/quelldb/base"
+
+// CompactionDecision tells Compact what to do with a record.
+type CompactionDecision int
+
+const (
+	// CompactionKeep writes the record unchanged.
+	CompactionKeep CompactionDecision = iota
+	// CompactionRemove drops the record from the compaction output.
+	CompactionRemove
+	// CompactionChangeValue writes the record with the value returned by the filter.
+	CompactionChangeValue
+)
+
+// CompactionFilterContext describes the compaction a record passes through.
+type CompactionFilterContext struct {
+	// Level is the level the compaction output is written to.
+	Level int
+	// InputFiles is the number of SSS files merged by the compaction.
+	InputFiles int
+	// Bottommost is true when no older data exists below the compaction output.
+	Bottommost bool
+	// IsManual is true for compactions requested through CompactRange.
+	IsManual bool
+}
+
+// CompactionFilter lets the application drop or rewrite records while
+// they are merged by Compact, without issuing deletes or puts.
+// Filter is called once per key and must be safe to call from the
+// goroutine running the compaction.
+type CompactionFilter interface {
+	Name() string
+	Filter(ctx CompactionFilterContext, key, value string) (decision CompactionDecision, newValue string)
+}
+
+// CompactionFilterStats holds the accumulated decisions of the compaction filter.
+type CompactionFilterStats struct {
+	Compactions uint64
+	Records     uint64
+	Kept        uint64
+	Removed     uint64
+	Changed     uint64
+}
+
+// CompactionFilterStats returns how many records the configured compaction
+// filter has seen, kept, removed and changed since the database was opened.
+func (db *DB) CompactionFilterStats() CompactionFilterStats {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.compactionFilterStats
+}
+
+// filterCompaction runs the compaction filter over the merged values and
+// returns the records that should be written to the compaction output.
+// Tombstones and merge records are passed through untouched.
+func (db *DB) filterCompaction(ctx CompactionFilterContext, merged map[string]base.Entry) map[string]base.Entry {
+	if db.compactionFilter == nil {
+		return merged
+	}
+
+	var stats CompactionFilterStats
+	stats.Compactions = 1
+	for k, entry := range merged {
+		if entry.Kind != base.KindValue {
+			continue
+		}
+		stats.Records++
+		decision, newValue := db.compactionFilter.Filter(ctx, k, entry.Value)
+		switch decision {
+		case CompactionRemove:
+			// older values may still live outside this compaction
+			if ctx.Bottommost {
+				delete(merged, k)
+			} else {
+				merged[k] = base.Entry{Kind: base.KindDelete}
+			}
+			stats.Removed++
+		case CompactionChangeValue:
+			merged[k] = base.Entry{Kind: base.KindValue, Value: newValue}
+			stats.Changed++
+		default:
+			stats.Kept++
+		}
+	}
+
+	db.mu.Lock()
+	db.compactionFilterStats.Compactions += stats.Compactions
+	db.compactionFilterStats.Records += stats.Records
+	db.compactionFilterStats.Kept += stats.Kept
+	db.compactionFilterStats.Removed += stats.Removed
+	db.compactionFilterStats.Changed += stats.Changed
+	db.mu.Unlock()
+
+	return merged
+}
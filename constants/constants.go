@@ -6,24 +6,67 @@ package constants
 
 const (
 	LOG_FILE                  = "00000.log"
+	LOG_FILE_SUFFIX           = ".log"
+	TEMP_FILE_SUFFIX          = ".tmp"
 	SSS_MERGE_FILE_NAME       = "sss-merged"
 	SSS_PREFIX                = "sss-"
 	SSS_SUFFIX                = ".qldb"
 	SSS_BOOM_FILTER_SUFFIX    = ".filter"
 	INDEX_FOOTER_NAME         = "QIDX"
+	INDEX_FOOTER_NAME_V2      = "QIX2"
+	INDEX_FOOTER_NAME_V3      = "QIX3"
+	INDEX_FOOTER_NAME_V4      = "QIX4"
+	SSS_BLOCK_SIZE            = 4 << 10
 	SSS_COMPACT_DEFAULT_LIMIT = 10
 	BOOM_BIT_SIZE             = 8000
 	BOOM_HASH_COUNT           = 4
+	NUM_LEVELS                = 7
+
+	// BLOOM FILTER
+	BLOOM_FILTER_MAGIC         = "QBF2"
+	FILTER_MAGIC               = "QFLT"
+	BLOOM_BITS_PER_KEY_DEFAULT = 10
+
+	// COMPRESSION
+	ZSTD_LEVEL_DEFAULT = 3
 
 	// KEY
 	PUT    = "PUT"
 	DELETE = "DEL"
 	GET    = "GET"
+	MERGE  = "MRG"
 	ALL    = "ALL"
 
+	// WRITE STALL
+	WRITE_STALL_SLOWDOWN_DELAY_MS = 1
 
 	// MANIFEST
 	CURRENT_MANIFEST_FILE = "CURRENT"
 	MANIFEST_FILE_PREFIX  = "MANIFEST"
 	MANIFEST_FILE_SUFFIX  = ".qmf"
+
+	MANIFEST_VERSION_MARKER  = -1
+	MANIFEST_LOG_MAGIC       = "QMFL"
+	MANIFEST_LOG_CRC_MAGIC   = "QMFC"
+	MANIFEST_LOG_CODEC_MAGIC = "QMFZ"
+	MANIFEST_MAX_FILE_SIZE   = 4 << 20
+
+	// REPAIR
+	LOST_DIR = "lost"
+
+	// LOCK
+	LOCK_FILE = "LOCK"
+
+	// BLOCK CACHE
+	BLOCK_CACHE_DEFAULT_BYTES = 8 << 20
+
+	// TABLE CACHE
+	MAX_OPEN_FILES_DEFAULT = 1000
+
+	// ROW CACHE
+	// number of versions whose changed files the row cache remembers
+	ROW_CACHE_VERSION_HISTORY = 64
+
+	// SECONDARY
+	SECONDARY_CATCH_UP_ATTEMPTS = 3
 )
@@ -0,0 +1,24 @@
+// Copyright 2025 The QuellDB Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be found in
+// the LICENSE file.
+
+package quelldb
+
+import "errors"
+
+var (
+	// ErrLocked is returned by Open when another process holds the lock on
+	// the database directory.
+	ErrLocked = errors.New("quelldb: database directory is locked by another process")
+
+	// ErrReadOnly is returned by every mutating method of a database
+	// opened with Options.ReadOnly.
+	ErrReadOnly = errors.New("quelldb: database is open read-only")
+
+	// ErrClosed is returned by every method of a database after Close.
+	ErrClosed = errors.New("quelldb: database is closed")
+
+	// ErrCatchUpIncomplete is returned by TryCatchUpWithPrimary when the
+	// primary kept installing new manifests while the secondary caught up.
+	ErrCatchUpIncomplete = errors.New("quelldb: primary changed during every catch up attempt")
+)
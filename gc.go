@@ -0,0 +1,188 @@
+// Copyright 2025 The QuellDB Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be found in
+// the LICENSE file.
+
+package quelldb
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/quellington/quelldb/constants"
+	"github.com/quellington/quelldb/utils"
+	"github.com/quellington/quelldb/vfs"
+)
+
+// collectObsoleteFiles deletes the files of the storage directory that no
+// live version refers to: SSS files and bloom filters named by no
+// version, WALs older than the log number, manifests other than the current
+// one and its fallback, and temporary files left by an interrupted write.
+// The SSS files and WALs the fallback manifest refers to are kept, so
+// Open can still fall back to it, see advanceFallback.
+// SSS files still being written by a flush or compaction are kept.
+// Files the database does not own are never touched.
+// The caller must hold db.mu.
+func (db *DB) collectObsoleteFiles() {
+	if db.manifestDirty {
+		return
+	}
+	files, err := db.fs.List(db.basePath)
+	if err != nil {
+		db.logger.Printf("quelldb: listing %s for obsolete files: %v", db.basePath, err)
+		return
+	}
+
+	// files of older versions still pinned by readers are kept, and
+	// collected once the last of those versions is released
+	live := db.liveFiles()
+	db.obsoleteDeferred = len(db.versions) > 1
+	fallback := fallbackManifest(listManifests(db.fs, db.basePath), db.manifestName)
+
+	for _, name := range files {
+		if !db.isObsoleteFile(name, live, fallback) {
+			continue
+		}
+		if err := db.fs.Remove(filepath.Join(db.basePath, name)); err != nil {
+			db.logger.Printf("quelldb: removing obsolete file %s: %v", name, err)
+			continue
+		}
+		if strings.HasSuffix(name, constants.SSS_SUFFIX) {
+			num := sssFileNumber(name)
+			db.tables.evict(num)
+			db.blockCache.EvictFile(db.cacheID, uint64(num))
+		}
+		db.logger.Printf("quelldb: removed obsolete file %s", name)
+	}
+}
+
+// isObsoleteFile reports whether a file of the storage directory may be deleted.
+func (db *DB) isObsoleteFile(name string, live map[string]bool, fallback string) bool {
+	switch {
+	case strings.HasSuffix(name, constants.TEMP_FILE_SUFFIX):
+		// only the temporary files of CURRENT and the manifests are ours
+		target := strings.TrimSuffix(name, constants.TEMP_FILE_SUFFIX)
+		return target == constants.CURRENT_MANIFEST_FILE ||
+			strings.HasPrefix(target, constants.MANIFEST_FILE_PREFIX+"-") && strings.HasSuffix(target, constants.MANIFEST_FILE_SUFFIX)
+	case strings.HasPrefix(name, constants.SSS_PREFIX):
+		sss := strings.TrimSuffix(name, constants.SSS_BOOM_FILTER_SUFFIX)
+		if !strings.HasSuffix(sss, constants.SSS_SUFFIX) {
+			return false
+		}
+		return !live[sss] && !db.fallbackFiles[sss] && !db.pendingOutputs[sssFileNumber(sss)]
+	case strings.HasSuffix(name, constants.LOG_FILE_SUFFIX):
+		num, err := strconv.Atoi(strings.TrimSuffix(name, constants.LOG_FILE_SUFFIX))
+		if err != nil || (db.fallbackFiles != nil && num >= db.fallbackLogNum) {
+			return false
+		}
+		return num < db.logNum
+	case strings.HasPrefix(name, constants.MANIFEST_FILE_PREFIX+"-") && strings.HasSuffix(name, constants.MANIFEST_FILE_SUFFIX):
+		// without a manifest in use there is nothing to compare against
+		return db.manifestName != "" && name != db.manifestName && name != fallback
+	}
+	return false
+}
+
+// fallbackManifest returns the newest manifest older than the current one,
+// which Open falls back to when the current manifest is unreadable.
+// The manifests are listed newest first.
+func fallbackManifest(manifests []string, current string) string {
+	for _, name := range manifests {
+		if manifestFileNumber(name) < manifestFileNumber(current) {
+			return name
+		}
+	}
+	return ""
+}
+
+// loadFallback reads the state the fallback manifest of the current one
+// ends in, see keepFallback. A fallback that cannot be read could not be
+// opened either, so nothing is kept for it.
+// The caller must hold db.mu.
+func (db *DB) loadFallback() {
+	db.fallbackFiles = nil
+	name := fallbackManifest(listManifests(db.fs, db.basePath), db.manifestName)
+	if name == "" {
+		return
+	}
+	data, err := vfs.ReadFile(db.fs, filepath.Join(db.basePath, name))
+	if err != nil {
+		return
+	}
+	state, _, err := decodeManifestState(data, db.key)
+	if err != nil {
+		return
+	}
+	db.keepFallback(state)
+}
+
+// keepFallback records the state the fallback manifest ends in. Its SSS
+// files and the WALs from its log number on stay on disk until
+// advanceFallback rewrites it or another manifest replaces it as the
+// fallback.
+// The caller must hold db.mu.
+func (db *DB) keepFallback(state *manifestState) {
+	db.fallbackFiles = make(map[string]bool, len(state.files))
+	for _, f := range state.files {
+		db.fallbackFiles[f.Filename] = true
+	}
+	db.fallbackLogNum = state.logNumber
+}
+
+// advanceFallback rewrites the fallback manifest with a snapshot of the
+// current state once it refers to SSS files or WALs the current version no
+// longer needs, so they can be collected right away rather than after the
+// next manifest roll. When the rewrite fails the old fallback is kept as it is.
+// The caller must hold db.mu.
+func (db *DB) advanceFallback() {
+	if db.fallbackFiles == nil || db.manifestDirty || !db.fallbackStale() {
+		return
+	}
+	name := fallbackManifest(listManifests(db.fs, db.basePath), db.manifestName)
+	if name == "" {
+		db.fallbackFiles = nil
+		return
+	}
+	state := db.manifestState()
+	data, err := encodeManifestFile(state, db.key, db.compression, db.compressionLevel)
+	if err == nil {
+		err = utils.WriteFileAtomicFS(db.fs, filepath.Join(db.basePath, name), data)
+	}
+	if err != nil {
+		db.logger.Printf("quelldb: advancing fallback manifest %s: %v", name, err)
+		return
+	}
+	db.keepFallback(state)
+}
+
+// fallbackStale reports whether the fallback manifest keeps a file the
+// current version does not refer to.
+// The caller must hold db.mu.
+func (db *DB) fallbackStale() bool {
+	if db.fallbackLogNum < db.logNum {
+		return true
+	}
+	current := make(map[string]bool, len(db.current.files))
+	for _, f := range db.current.files {
+		current[f.Filename] = true
+	}
+	for name := range db.fallbackFiles {
+		if !current[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// addPendingOutput keeps a file number being written out of reach of
+// collectObsoleteFiles until it is recorded in the manifest.
+// The caller must hold db.mu.
+func (db *DB) addPendingOutput(num int) {
+	db.pendingOutputs[num] = true
+}
+
+// removePendingOutput releases a file number added with addPendingOutput.
+// The caller must hold db.mu.
+func (db *DB) removePendingOutput(num int) {
+	delete(db.pendingOutputs, num)
+}
@@ -2,4 +2,8 @@ module github.com/quellington/quelldb
 
 go 1.24.1
 
-require github.com/golang/snappy v1.0.0
+require (
+	github.com/golang/snappy v1.0.0
+	github.com/klauspost/compress v1.18.0
+	github.com/pierrec/lz4/v4 v4.1.33
+)
@@ -5,18 +5,23 @@
 package quelldb
 
 import (
+	"fmt"
 	"sort"
 	"strings"
+
+	"github.com/quellington/quelldb/base"
 )
 
 type Iterator struct {
 	keys   []string
 	values map[string]string
 	index  int
+	err    error
 }
 
 // NewIterator creates a new iterator for the database.
-// It retrieves all keys from the in-memory storage, sorts them,
+// It collects all keys from the SSS files and the in-memory storages, resolves
+// tombstones and merge operands, sorts them,
 // and initializes the iterator with the sorted keys and their corresponding values.
 // The iterator starts at index -1, indicating that it is before the first element.
 // The caller can use the Next() method to advance the iterator and access keys and values.
@@ -24,31 +29,25 @@ type Iterator struct {
 // The caller is responsible for closing the iterator when done.
 // The iterator does not require any additional resources to be closed.
 func (db *DB) Iterator() *Iterator {
-	all := db.memStorage.All()
-	keys := make([]string, 0, len(all))
-	for k := range all {
-		keys = append(keys, k)
-	}
-	sort.Strings(keys)
-
-	return &Iterator{
-		keys:   keys,
-		values: all,
-		index:  -1,
-	}
+	return db.PrefixIterator("")
 }
 
-
 // NewPrefixIterator creates a new iterator for the database with a specific prefix.
-// It retrieves all keys from the in-memory storage that start with the given prefix,
+// It collects all keys that start with the given prefix,
 // sorts them, and initializes the iterator with the sorted keys and their corresponding values.
+// SSS files whose key range, or prefix filter (see Options.PrefixExtractor),
+// rules the prefix out are not read, nor are the blocks of a file outside it.
+// When an SSS file cannot be read, or the database is closed, the iterator
+// holds no keys and Err reports why.
 func (db *DB) PrefixIterator(prefix string) *Iterator {
-	all := db.memStorage.All()
-	filtered := make(map[string]string)
-	for k, v := range all {
-		if strings.HasPrefix(k, prefix) {
-			filtered[k] = v
-		}
+	if db.closed.Load() {
+		// a closed database iterates nothing
+		return &Iterator{index: -1, err: ErrClosed}
+	}
+	filtered, err := db.collect(prefix)
+	if err != nil {
+		db.logger.Printf("quelldb: iterating %q: %v", prefix, err)
+		return &Iterator{index: -1, err: err}
 	}
 	keys := make([]string, 0, len(filtered))
 	for k := range filtered {
@@ -63,6 +62,61 @@ func (db *DB) PrefixIterator(prefix string) *Iterator {
 	}
 }
 
+// collect stacks the records of every SSS file and memtable, oldest first,
+// and returns the resolved values of the keys starting with prefix.
+// Keys whose merge operands cannot be resolved are left out, while an SSS
+// file that cannot be read fails the whole collection.
+func (db *DB) collect(prefix string) (map[string]string, error) {
+	var sources []map[string]base.Entry
+
+	memStorages, v := db.readState()
+	defer db.releaseVersion(v)
+
+	ssss := readOrder(v.files)
+	for i := len(ssss) - 1; i >= 0; i-- {
+		data, err := db.tablePrefixEntries(ssss[i], prefix)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", ssss[i].Filename, err)
+		}
+		if data != nil {
+			sources = append(sources, data)
+		}
+	}
+	for i := len(memStorages) - 1; i >= 0; i-- {
+		sources = append(sources, memStorages[i].Entries())
+	}
+
+	stacked := make(map[string]base.Entry)
+	broken := make(map[string]bool)
+	for _, data := range sources {
+		for k, entry := range data {
+			if !strings.HasPrefix(k, prefix) {
+				continue
+			}
+			if older, ok := stacked[k]; ok {
+				combined, err := db.combineEntries(k, older, entry)
+				if err != nil {
+					broken[k] = true
+					continue
+				}
+				entry = combined
+			}
+			stacked[k] = entry
+			delete(broken, k)
+		}
+	}
+
+	result := make(map[string]string, len(stacked))
+	for k, entry := range stacked {
+		if broken[k] {
+			continue
+		}
+		if val, ok, err := db.resolveEntry(k, entry); err == nil && ok {
+			result[k] = val
+		}
+	}
+	return result, nil
+}
 
 // Next advances the iterator to the next key-value pair.
 func (it *Iterator) Next() bool {
@@ -77,3 +131,9 @@ func (it *Iterator) Key() string {
 func (it *Iterator) Value() string {
 	return it.values[it.keys[it.index]]
 }
+
+// Err returns the error that kept the iterator from reading the database,
+// if any. An iterator with an error holds no keys.
+func (it *Iterator) Err() error {
+	return it.err
+}
@@ -0,0 +1,24 @@
+// Copyright 2025 The QuellDB Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be found in
+// the LICENSE file.
+
+package quelldb
+
+import (
+	"errors"
+	"io"
+	"path/filepath"
+
+	"github.com/quellington/quelldb/constants"
+	"github.com/quellington/quelldb/vfs"
+)
+
+// lockDir takes the exclusive lock on the LOCK file of the database
+// directory. It fails with ErrLocked while another process holds it.
+func lockDir(fs vfs.FS, path string) (io.Closer, error) {
+	lock, err := fs.Lock(filepath.Join(path, constants.LOCK_FILE))
+	if errors.Is(err, vfs.ErrLockHeld) {
+		return nil, ErrLocked
+	}
+	return lock, err
+}
@@ -7,21 +7,72 @@ package quelldb
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/golang/snappy"
+	"github.com/quellington/quelldb/base"
 	"github.com/quellington/quelldb/constants"
 	"github.com/quellington/quelldb/utils"
+	"github.com/quellington/quelldb/vfs"
 )
 
+// SSSMeta describes an SSS file recorded in the manifest.
+// Files recorded by older manifests only carry the name, key range and level,
+// the remaining fields are zero for them.
 type SSSMeta struct {
 	Filename string
 	MinKey   string
 	MaxKey   string
+	Level    int
+
+	// FileSize is the size of the file in bytes.
+	FileSize int64
+	// EntryCount is the number of records, tombstones included.
+	EntryCount uint64
+	// TombstoneCount is the number of delete records.
+	TombstoneCount uint64
+	// SmallestSeq and LargestSeq bound the sequence numbers of the
+	// writes held by the file.
+	SmallestSeq uint64
+	LargestSeq  uint64
+	// CreatedAt is the time the file was written.
+	CreatedAt time.Time
+	// Checksum is the CRC-32C of the whole file.
+	Checksum uint32
+}
+
+// newSSSMeta describes a freshly written SSS file holding the given records.
+// The file size and checksum are read back from disk.
+func newSSSMeta(fs vfs.FS, basePath, filename string, level int, entries map[string]base.Entry, minKey, maxKey string, smallestSeq, largestSeq uint64) (SSSMeta, error) {
+	size, checksum, err := utils.FileChecksumFS(fs, filepath.Join(basePath, filename))
+	if err != nil {
+		return SSSMeta{}, err
+	}
+	meta := SSSMeta{
+		Filename:    filename,
+		MinKey:      minKey,
+		MaxKey:      maxKey,
+		Level:       level,
+		FileSize:    size,
+		EntryCount:  uint64(len(entries)),
+		SmallestSeq: smallestSeq,
+		LargestSeq:  largestSeq,
+		CreatedAt:   time.Now(),
+		Checksum:    checksum,
+	}
+	for _, entry := range entries {
+		if entry.Kind == base.KindDelete {
+			meta.TombstoneCount++
+		}
+	}
+	return meta, nil
 }
 
 // write string as [len][bytes]
@@ -39,24 +90,60 @@ func readString(buf *bytes.Reader) string {
 	return string(b)
 }
 
-// EncodeManifest encodes SSStorage names with binary format, nappy, ptional encryption
+// EncodeManifest encodes SSStorage names as a manifest log holding a single
+// snapshot VersionEdit. Each record is compressed with snappy and
+// optionally encrypted.
 func EncodeManifest(ssts []SSSMeta, key []byte) ([]byte, error) {
-	buf := new(bytes.Buffer)
-	binary.Write(buf, binary.LittleEndian, int32(len(ssts)))
-	for _, s := range ssts {
-		writeString(buf, s.Filename)
-		writeString(buf, s.MinKey)
-		writeString(buf, s.MaxKey)
-	}
-	compressed := snappy.Encode(nil, buf.Bytes())
-	if key != nil {
-		return utils.Encrypt(compressed, key)
+	state := &manifestState{files: ssts}
+	return encodeManifestFile(state, key, base.DefaultCompression, 0)
+}
+
+// encodeManifestFile writes the manifest log header followed by a snapshot
+// of the given state, compressed with codec c.
+func encodeManifestFile(state *manifestState, key []byte, c base.Compression, level int) ([]byte, error) {
+	record, err := encodeManifestRecord(state.snapshot(), key, c, level)
+	if err != nil {
+		return nil, err
 	}
-	return compressed, nil
+	return append([]byte(constants.MANIFEST_LOG_CODEC_MAGIC), record...), nil
 }
 
 // DecodeManifest decodes manifest data to extract SSStorage names
+// It reads manifest logs as well as the older single snapshot format.
 func DecodeManifest(data []byte, key []byte) ([]SSSMeta, error) {
+	state, _, err := decodeManifestState(data, key)
+	if err != nil {
+		return nil, err
+	}
+	return state.files, nil
+}
+
+// decodeManifestState replays a manifest and reports whether new edits can
+// be appended to it, which is only the case for an intact log of the
+// current record format.
+func decodeManifestState(data []byte, key []byte) (*manifestState, bool, error) {
+	for _, magic := range []string{constants.MANIFEST_LOG_CODEC_MAGIC, constants.MANIFEST_LOG_CRC_MAGIC, constants.MANIFEST_LOG_MAGIC} {
+		if !bytes.HasPrefix(data, []byte(magic)) {
+			continue
+		}
+		body := data[len(magic):]
+		state, valid, err := decodeManifestLog(body, key, magic)
+		if err != nil {
+			return nil, false, err
+		}
+		return state, magic == constants.MANIFEST_LOG_CODEC_MAGIC && valid == len(body), nil
+	}
+
+	ssts, err := decodeSnapshotManifest(data, key)
+	if err != nil {
+		return nil, false, err
+	}
+	return &manifestState{files: ssts}, false, nil
+}
+
+// decodeSnapshotManifest reads manifests written before the manifest
+// became a log of version edits.
+func decodeSnapshotManifest(data []byte, key []byte) ([]SSSMeta, error) {
 	if key != nil {
 		var err error
 		data, err = utils.Decrypt(data, key)
@@ -70,8 +157,16 @@ func DecodeManifest(data []byte, key []byte) ([]SSSMeta, error) {
 	}
 	buf := bytes.NewReader(decoded)
 
-	var count int32
+	// manifests without a version marker start with the file count
+	var count, version int32
 	binary.Read(buf, binary.LittleEndian, &count)
+	if count == constants.MANIFEST_VERSION_MARKER {
+		binary.Read(buf, binary.LittleEndian, &version)
+		if version > 2 {
+			return nil, fmt.Errorf("unsupported manifest version %d", version)
+		}
+		binary.Read(buf, binary.LittleEndian, &count)
+	}
 
 	ssts := make([]SSSMeta, 0, count)
 	for i := 0; i < int(count); i++ {
@@ -80,6 +175,11 @@ func DecodeManifest(data []byte, key []byte) ([]SSSMeta, error) {
 			MinKey:   readString(buf),
 			MaxKey:   readString(buf),
 		}
+		if version >= 2 {
+			var level int32
+			binary.Read(buf, binary.LittleEndian, &level)
+			meta.Level = int(level)
+		}
 		ssts = append(ssts, meta)
 	}
 	return ssts, nil
@@ -87,71 +187,196 @@ func DecodeManifest(data []byte, key []byte) ([]SSSMeta, error) {
 
 // SaveManifest writes a new numbered manifest and updates CURRENT
 func SaveManifest(basePath string, ssts []SSSMeta, key []byte) error {
+	return SaveManifestFS(vfs.Default, basePath, ssts, key)
+}
+
+// SaveManifestFS is SaveManifest on the given file system.
+func SaveManifestFS(fs vfs.FS, basePath string, ssts []SSSMeta, key []byte) error {
 	// determine next manifest ID
-	nextID, err := nextManifestID(basePath)
+	nextID, err := nextManifestID(fs, basePath)
 	if err != nil {
 		return err
 	}
-	filename := fmt.Sprintf("%s-%05d%s", constants.MANIFEST_FILE_PREFIX, nextID, constants.MANIFEST_FILE_SUFFIX)
+	return saveManifestState(fs, basePath, nextID, &manifestState{files: ssts}, key, base.DefaultCompression, 0)
+}
+
+// saveManifestState writes the state as a fresh manifest log with the given
+// number and installs it as the current manifest. The previously current
+// manifest is kept as a fallback, every older one is removed.
+func saveManifestState(fs vfs.FS, basePath string, num int, state *manifestState, key []byte, c base.Compression, level int) error {
+	filename := manifestFileName(num)
 	fullPath := filepath.Join(basePath, filename)
 
 	// write new manifest
-	data, err := EncodeManifest(ssts, key)
+	data, err := encodeManifestFile(state, key, c, level)
 	if err != nil {
 		return err
 	}
-	if err := os.WriteFile(fullPath, data, 0644); err != nil {
+	if err := utils.WriteFileAtomicFS(fs, fullPath, data); err != nil {
 		return err
 	}
 
-	// update CURRENT pointer
-	currentPath := filepath.Join(basePath, constants.CURRENT_MANIFEST_FILE)
-	if err := os.WriteFile(currentPath, []byte(filename), 0644); err != nil {
+	previous, _ := readCurrent(fs, basePath)
+	if err := installCurrent(fs, basePath, filename); err != nil {
 		return err
 	}
 
-	// manifest cleanup
-	files, _ := os.ReadDir(basePath)
-	for _, f := range files {
-		name := f.Name()
-		if strings.HasPrefix(name, constants.MANIFEST_FILE_PREFIX+"-") && name != filename {
-			os.Remove(filepath.Join(basePath, name))
-		}
+	removeOldManifests(fs, basePath, filename, previous)
+	return nil
+}
+
+// installCurrent atomically points CURRENT at the named manifest.
+func installCurrent(fs vfs.FS, basePath, manifestName string) error {
+	currentPath := filepath.Join(basePath, constants.CURRENT_MANIFEST_FILE)
+	return utils.WriteFileAtomicFS(fs, currentPath, []byte(manifestName))
+}
+
+// readCurrent returns the manifest name CURRENT points to.
+func readCurrent(fs vfs.FS, basePath string) (string, error) {
+	data, err := vfs.ReadFile(fs, filepath.Join(basePath, constants.CURRENT_MANIFEST_FILE))
+	if err != nil {
+		return "", err
 	}
+	return string(bytes.TrimSpace(data)), nil
+}
 
-	return nil
+// removeOldManifests deletes every manifest except the current one and
+// the previous one kept as a fallback.
+func removeOldManifests(fs vfs.FS, basePath, current, previous string) {
+	files, _ := fs.List(basePath)
+	for _, name := range files {
+		if strings.HasPrefix(name, constants.MANIFEST_FILE_PREFIX+"-") && name != current && name != previous {
+			fs.Remove(filepath.Join(basePath, name))
+		}
+	}
 }
 
 // LoadManifest reads CURRENT, then loads the correct numbered manifest
 func LoadManifest(basePath string, key []byte) ([]SSSMeta, error) {
-	currentPath := filepath.Join(basePath, constants.CURRENT_MANIFEST_FILE)
-	data, err := os.ReadFile(currentPath)
+	return LoadManifestFS(vfs.Default, basePath, key)
+}
+
+// LoadManifestFS is LoadManifest on the given file system.
+func LoadManifestFS(fs vfs.FS, basePath string, key []byte) ([]SSSMeta, error) {
+	state, _, _, err := loadManifestState(fs, basePath, key)
 	if err != nil {
-		if os.IsNotExist(err) {
+		return nil, err
+	}
+	return state.files, nil
+}
 
-			// CURRENT file not found, return empty manifest (fresh storage)
-			return []SSSMeta{}, nil
+// loadManifestState reads CURRENT and replays the manifest it points to.
+// When CURRENT is missing, empty or points to a manifest that cannot be
+// read or fails its checksums, the remaining manifests are tried newest
+// first and the last good one is used, unless an SSS file it refers to is
+// missing: the files of an older manifest may have been collected already.
+// It returns the manifest name, empty for a fresh storage, and whether new
+// edits may be appended to that manifest.
+func loadManifestState(fs vfs.FS, basePath string, key []byte) (*manifestState, string, bool, error) {
+	current, err := readCurrent(fs, basePath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, "", false, err
+	}
+
+	candidates := listManifests(fs, basePath)
+	if current == "" && len(candidates) == 0 {
+
+		// CURRENT file not found, return empty manifest (fresh storage)
+		return &manifestState{files: []SSSMeta{}}, "", false, nil
+	}
+	if current != "" {
+		candidates = append([]string{current}, candidates...)
+	}
+
+	var errs []error
+	tried := make(map[string]bool)
+	for _, name := range candidates {
+		if tried[name] {
+			continue
+		}
+		tried[name] = true
+
+		manifestData, err := vfs.ReadFile(fs, filepath.Join(basePath, name))
+		if err == nil {
+			var state *manifestState
+			var appendable bool
+			state, appendable, err = decodeManifestState(manifestData, key)
+			if err == nil && name != current {
+				err = checkManifestFiles(fs, basePath, state)
+			}
+			if err == nil {
+				// never append to a fallback, the next edit installs a new manifest
+				return state, name, appendable && name == current, nil
+			}
+		}
+		errs = append(errs, fmt.Errorf("manifest %s: %w", name, err))
+	}
+	return nil, "", false, errors.Join(errs...)
+}
+
+// checkManifestFiles returns an error when an SSS file of the manifest
+// state is missing from the storage directory.
+func checkManifestFiles(fs vfs.FS, basePath string, state *manifestState) error {
+	for _, f := range state.files {
+		if _, err := fs.Stat(filepath.Join(basePath, f.Filename)); err != nil {
+			return fmt.Errorf("fallback refers to missing SSS file %s: %w", f.Filename, err)
 		}
-		return nil, err
 	}
-	manifestName := string(bytes.TrimSpace(data))
-	manifestPath := filepath.Join(basePath, manifestName)
-	manifestData, err := os.ReadFile(manifestPath)
+	return nil
+}
+
+// listManifests returns the manifest files in the base path, newest first.
+func listManifests(fs vfs.FS, basePath string) []string {
+	files, _ := fs.List(basePath)
+	var names []string
+	for _, name := range files {
+		if strings.HasPrefix(name, constants.MANIFEST_FILE_PREFIX+"-") && strings.HasSuffix(name, constants.MANIFEST_FILE_SUFFIX) {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return manifestFileNumber(names[i]) > manifestFileNumber(names[j])
+	})
+	return names
+}
+
+// listSSSFiles returns the SSS files in the base path, oldest first.
+func listSSSFiles(fs vfs.FS, basePath string) ([]string, error) {
+	files, err := fs.List(basePath)
 	if err != nil {
 		return nil, err
 	}
-	return DecodeManifest(manifestData, key)
+	var names []string
+	for _, name := range files {
+		if strings.HasPrefix(name, constants.SSS_PREFIX) && strings.HasSuffix(name, constants.SSS_SUFFIX) {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return sssFileNumber(names[i]) < sssFileNumber(names[j])
+	})
+	return names, nil
+}
+
+// manifestFileName returns the manifest file name for the given number.
+func manifestFileName(num int) string {
+	return fmt.Sprintf("%s-%05d%s", constants.MANIFEST_FILE_PREFIX, num, constants.MANIFEST_FILE_SUFFIX)
+}
+
+// manifestFileNumber extracts the number of a manifest file name.
+func manifestFileNumber(name string) int {
+	num, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, constants.MANIFEST_FILE_PREFIX+"-"), constants.MANIFEST_FILE_SUFFIX))
+	return num
 }
 
 // internal: gets next manifest ID
-func nextManifestID(basePath string) (int, error) {
-	files, err := os.ReadDir(basePath)
+func nextManifestID(fs vfs.FS, basePath string) (int, error) {
+	files, err := fs.List(basePath)
 	if err != nil {
 		return 1, err
 	}
 	max := 0
-	for _, f := range files {
-		name := f.Name()
+	for _, name := range files {
 		if len(name) >= 16 && strings.HasPrefix(name, constants.MANIFEST_FILE_PREFIX) {
 			numStr := name[len(constants.MANIFEST_FILE_PREFIX)+1 : len(constants.MANIFEST_FILE_PREFIX)+6]
 			num, err := strconv.Atoi(numStr)
@@ -163,6 +388,76 @@ func nextManifestID(basePath string) (int, error) {
 	return max + 1, nil
 }
 
+// expandOverlapping grows the selected files with every other file whose key
+// range overlaps one of them, until no outside file overlaps the selection.
+// A compaction over the result can write its output to any level without
+// older data of the same keys being left behind in another file.
+func expandOverlapping(selected, all []SSSMeta) []SSSMeta {
+	picked := make(map[string]bool)
+	for _, s := range selected {
+		picked[s.Filename] = true
+	}
+	for grown := true; grown; {
+		grown = false
+		for _, s := range all {
+			if !picked[s.Filename] && overlapsAny(s, selected) {
+				selected = append(selected, s)
+				picked[s.Filename] = true
+				grown = true
+			}
+		}
+	}
+
+	// keep manifest order, oldest first
+	result := make([]SSSMeta, 0, len(selected))
+	for _, s := range all {
+		if picked[s.Filename] {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+// filesAtLevel returns the files of the given level in manifest order.
+func filesAtLevel(ssts []SSSMeta, level int) []SSSMeta {
+	var result []SSSMeta
+	for _, s := range ssts {
+		if s.Level == level {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+// sssFileNumber extracts the number of an SSS file name.
+func sssFileNumber(name string) int {
+	num, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, constants.SSS_PREFIX), constants.SSS_SUFFIX))
+	return num
+}
+
+// readOrder sorts SSS files the way reads must visit them: level 0 files
+// newest first, then every deeper level from top to bottom. Files of a
+// level are ordered by their newest write, and by file number when their
+// sequence numbers tie, as they do for files recorded without them.
+func readOrder(ssts []SSSMeta) []SSSMeta {
+	ordered := append([]SSSMeta(nil), ssts...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		if ordered[i].Level != ordered[j].Level {
+			return ordered[i].Level < ordered[j].Level
+		}
+		return newerFile(ordered[i], ordered[j])
+	})
+	return ordered
+}
+
+// newerFile reports whether a holds newer writes than b.
+func newerFile(a, b SSSMeta) bool {
+	if a.LargestSeq != b.LargestSeq {
+		return a.LargestSeq > b.LargestSeq
+	}
+	return sssFileNumber(a.Filename) > sssFileNumber(b.Filename)
+}
+
 func overlapsAny(a SSSMeta, group []SSSMeta) bool {
 	for _, b := range group {
 		if !(a.MaxKey < b.MinKey || a.MinKey > b.MaxKey) {
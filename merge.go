@@ -0,0 +1,156 @@
+// Copyright 2025 The QuellDB Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be found in
+// the LICENSE file.
+
+package quelldb
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/quellington/quelldb/base"
+	"github.com/quellington/quelldb/constants"
+)
+
+// MergeOperator resolves merge operands written with DB.Merge.
+// Operands are always passed oldest first.
+type MergeOperator interface {
+	Name() string
+
+	// FullMerge applies the operands on top of the existing value.
+	// exists is false when the key has no value or has been deleted.
+	FullMerge(key, existing string, exists bool, operands []string) (string, error)
+
+	// PartialMerge combines two adjacent operands into a single one.
+	// It returns false when the operands can only be resolved against a base value.
+	PartialMerge(key, left, right string) (string, bool)
+}
+
+// Merge records a merge operand for the given key.
+// The operand is written to the WAL and the memtable without reading the
+// current value; Get, iterators and Compact resolve it lazily through the
+// configured Options.MergeOperator.
+// If the memtable already holds a value or tombstone for the key, the
+// operand is folded into it right away.
+func (db *DB) Merge(key, operand string) error {
+	return db.MergeContext(context.Background(), key, operand)
+}
+
+// MergeContext records a merge operand like Merge, waiting for a write
+// stall to clear like PutContext.
+func (db *DB) MergeContext(ctx context.Context, key, operand string) error {
+	if err := db.writable(); err != nil {
+		return err
+	}
+	if db.mergeOperator == nil {
+		return fmt.Errorf("merge requires Options.MergeOperator")
+	}
+	if err := db.waitForWriteRoom(ctx); err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	if db.closed.Load() {
+		db.mu.Unlock()
+		return ErrClosed
+	}
+	// the WAL comes first, a write it does not hold never reaches the memtable.
+	// Writers hold db.mu, so the record cannot change before it is stored.
+	entry, err := db.mergedEntry(db.memStorage, key, operand)
+	if err == nil {
+		err = db.writeWAL(constants.MERGE, key, operand)
+	}
+	if err == nil {
+		db.seq++
+		err = db.memStorage.Apply(key, func(base.Entry, bool) (base.Entry, error) {
+			return entry, nil
+		})
+	}
+	db.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// Publish to subscribers
+	db.publish(ChangeEvent{
+		Type:  constants.MERGE,
+		Key:   key,
+		Value: operand,
+	})
+
+	return nil
+}
+
+// applyMerge folds a merge operand into the given memtable.
+func (db *DB) applyMerge(mem *base.MemStorage, key, operand string) error {
+	newer := base.Entry{Kind: base.KindMerge, Operands: []string{operand}}
+	return mem.Apply(key, func(old base.Entry, ok bool) (base.Entry, error) {
+		if !ok {
+			return newer, nil
+		}
+		return db.combineEntries(key, old, newer)
+	})
+}
+
+// mergedEntry returns the record of key in the given memtable with a merge
+// operand folded into it, leaving the memtable unchanged.
+func (db *DB) mergedEntry(mem *base.MemStorage, key, operand string) (base.Entry, error) {
+	newer := base.Entry{Kind: base.KindMerge, Operands: []string{operand}}
+	old, ok := mem.GetEntry(key)
+	if !ok {
+		return newer, nil
+	}
+	return db.combineEntries(key, old, newer)
+}
+
+// combineEntries stacks a newer record of a key on top of an older one.
+// Values and tombstones replace whatever is older, merge operands are
+// resolved against an older value or tombstone, or appended to older
+// operands and partially merged where the operator allows it.
+func (db *DB) combineEntries(key string, older, newer base.Entry) (base.Entry, error) {
+	if newer.Kind != base.KindMerge {
+		return newer, nil
+	}
+	if db.mergeOperator == nil {
+		return base.Entry{}, fmt.Errorf("merge record for %q requires Options.MergeOperator", key)
+	}
+
+	switch older.Kind {
+	case base.KindValue, base.KindDelete:
+		value, err := db.mergeOperator.FullMerge(key, older.Value, older.Kind == base.KindValue, newer.Operands)
+		if err != nil {
+			return base.Entry{}, err
+		}
+		return base.Entry{Kind: base.KindValue, Value: value}, nil
+	}
+
+	operands := make([]string, 0, len(older.Operands)+len(newer.Operands))
+	operands = append(operands, older.Operands...)
+	for _, op := range newer.Operands {
+		last := len(operands) - 1
+		if last >= 0 {
+			if merged, ok := db.mergeOperator.PartialMerge(key, operands[last], op); ok {
+				operands[last] = merged
+				continue
+			}
+		}
+		operands = append(operands, op)
+	}
+	return base.Entry{Kind: base.KindMerge, Operands: operands}, nil
+}
+
+// resolveEntry turns the final record of a key into its visible value.
+// Merge operands without any older record are merged against no value.
+func (db *DB) resolveEntry(key string, entry base.Entry) (string, bool, error) {
+	switch entry.Kind {
+	case base.KindDelete:
+		return "", false, nil
+	case base.KindMerge:
+		resolved, err := db.combineEntries(key, base.Entry{Kind: base.KindDelete}, entry)
+		if err != nil {
+			return "", false, err
+		}
+		return resolved.Value, true, nil
+	}
+	return entry.Value, true, nil
+}
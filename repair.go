@@ -0,0 +1,280 @@
+// Copyright 2025 The QuellDB Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be found in
+// the LICENSE file.
+
+package quelldb
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+
+	"github.com/quellington/quelldb/base"
+	"github.com/quellington/quelldb/constants"
+	"github.com/quellington/quelldb/utils"
+	"github.com/quellington/quelldb/vfs"
+)
+
+// Repair rebuilds the manifest of the database at path from the files that
+// survived, for when CURRENT or the manifest is lost or corrupt.
+// Every SSS file is read in full, which validates its footer, index and
+// records, and its key range is recovered from the records. Files that
+// cannot be read are moved into the lost/ directory, together with any
+// manifest that cannot be decoded.
+// Levels are taken over from the newest readable manifest, sequence numbers
+// from the properties of every file. Files the manifest does not know are
+// placed on level 0, or below every overlapping file holding newer writes
+// down to the bottommost level, while files it dropped are left for the obsolete file collection.
+// Files written without sequence numbers are numbered in file order after
+// every known sequence number.
+// A fresh manifest is then installed and the database opened once, which
+// replays every WAL still needed and flushes it into a new SSS file.
+func Repair(path string, opts *Options) error {
+	fs := vfs.Default
+	if opts != nil && opts.FS != nil {
+		fs = opts.FS
+	}
+	if _, err := fs.Stat(path); err != nil {
+		return err
+	}
+
+	if opts != nil && opts.ReadOnly {
+		return ErrReadOnly
+	}
+	if opts != nil {
+		if err := checkCompression(opts); err != nil {
+			return err
+		}
+	}
+
+	lock, err := lockDir(fs, path)
+	if err != nil {
+		return err
+	}
+	// released before the final Open takes the lock itself
+	defer func() {
+		if lock != nil {
+			lock.Close()
+		}
+	}()
+
+	var key []byte
+	codec, level := base.DefaultCompression, 0
+	logger := log.Default()
+	if opts != nil {
+		key = opts.EncryptionKey
+		codec, level = opts.Compression, opts.CompressionLevel
+		if opts.Logger != nil {
+			logger = opts.Logger
+		}
+	}
+
+	lostPath := filepath.Join(path, constants.LOST_DIR)
+	moveToLost := func(name string, cause error) error {
+		if err := fs.MkdirAll(lostPath); err != nil {
+			return err
+		}
+		if err := fs.Rename(filepath.Join(path, name), filepath.Join(lostPath, name)); err != nil {
+			return err
+		}
+		logger.Printf("quelldb: repair moved %s to %s: %v", name, constants.LOST_DIR, cause)
+		return nil
+	}
+
+	for _, name := range listManifests(fs, path) {
+		data, err := vfs.ReadFile(fs, filepath.Join(path, name))
+		if err == nil {
+			_, _, err = decodeManifestState(data, key)
+		}
+		if err != nil {
+			if err := moveToLost(name, err); err != nil {
+				return err
+			}
+		}
+	}
+
+	// whatever a readable manifest still knows about the files
+	known := make(map[string]SSSMeta)
+	previous, _, _, err := loadManifestState(fs, path, key)
+	if err != nil {
+		previous = &manifestState{}
+	}
+	for _, f := range previous.files {
+		known[f.Filename] = f
+	}
+
+	tables, err := listSSSFiles(fs, path)
+	if err != nil {
+		return err
+	}
+
+	state := &manifestState{
+		logNumber:      previous.logNumber,
+		nextFileNumber: previous.nextFileNumber,
+		lastSequence:   previous.lastSequence,
+	}
+	for _, f := range previous.files {
+		if f.LargestSeq > state.lastSequence {
+			state.lastSequence = f.LargestSeq
+		}
+	}
+
+	var unknown, legacy []SSSMeta
+	for _, name := range tables {
+		num := sssFileNumber(name)
+		prior, isKnown := known[name]
+		if !isKnown && num < previous.nextFileNumber {
+			// dropped by the manifest, a compaction replaced it
+			continue
+		}
+
+		meta, err := repairTable(fs, path, name, key)
+		if err == nil && isKnown && prior.Checksum != 0 && prior.Checksum != meta.Checksum {
+			err = fmt.Errorf("checksum mismatch")
+		}
+		if err != nil {
+			if err := moveToLost(name, err); err != nil {
+				return err
+			}
+			if _, statErr := fs.Stat(filepath.Join(path, name+constants.SSS_BOOM_FILTER_SUFFIX)); statErr == nil {
+				if err := moveToLost(name+constants.SSS_BOOM_FILTER_SUFFIX, err); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		if num >= state.nextFileNumber {
+			state.nextFileNumber = num + 1
+		}
+		if meta.LargestSeq > state.lastSequence {
+			state.lastSequence = meta.LargestSeq
+		}
+		switch {
+		case isKnown:
+			meta.Level = prior.Level
+			if meta.LargestSeq == 0 {
+				meta.SmallestSeq, meta.LargestSeq = prior.SmallestSeq, prior.LargestSeq
+			}
+			meta.CreatedAt = prior.CreatedAt
+			state.files = append(state.files, meta)
+		case meta.LargestSeq == 0:
+			legacy = append(legacy, meta)
+		default:
+			unknown = append(unknown, meta)
+		}
+	}
+
+	// files without sequence numbers can only be ordered by their number,
+	// as newer than everything else
+	for _, meta := range legacy {
+		meta.SmallestSeq = state.lastSequence + 1
+		meta.LargestSeq = state.lastSequence + meta.EntryCount
+		state.lastSequence = meta.LargestSeq
+		unknown = append(unknown, meta)
+	}
+	sort.SliceStable(unknown, func(i, j int) bool {
+		return newerFile(unknown[j], unknown[i])
+	})
+	for _, meta := range unknown {
+		meta.Level = repairLevel(meta, state.files)
+		state.files = append(state.files, meta)
+		logger.Printf("quelldb: repair recovered %s on level %d", meta.Filename, meta.Level)
+	}
+
+	// the manifest lists the files oldest first
+	sort.SliceStable(state.files, func(i, j int) bool {
+		return newerFile(state.files[j], state.files[i])
+	})
+
+	// WALs and manifests must not reuse a number either
+	logNums, err := utils.LogNumbersFS(fs, path)
+	if err != nil {
+		return err
+	}
+	for _, num := range logNums {
+		if num >= state.nextFileNumber {
+			state.nextFileNumber = num + 1
+		}
+	}
+	for _, name := range listManifests(fs, path) {
+		if num := manifestFileNumber(name); num >= state.nextFileNumber {
+			state.nextFileNumber = num + 1
+		}
+	}
+
+	num := state.nextFileNumber
+	state.nextFileNumber++
+	if err := saveManifestState(fs, path, num, state, key, codec, level); err != nil {
+		return err
+	}
+
+	lock.Close()
+	lock = nil
+
+	// replay the remaining WALs and persist them as SSS files
+	db, err := Open(path, opts)
+	if err != nil {
+		return err
+	}
+	if err := db.Flush(); err != nil {
+		db.Close()
+		return err
+	}
+	return db.Close()
+}
+
+// repairTable reads every record of an SSS file and describes it as a
+// level 0 file. Files recording their number of records must hold all of
+// them. The sequence numbers are those recorded in the properties of the
+// file, zero when it has none.
+func repairTable(fs vfs.FS, path, name string, key []byte) (SSSMeta, error) {
+	table, err := base.OpenTableFS(fs, filepath.Join(path, name), key, base.TableOptions{})
+	if err != nil {
+		return SSSMeta{}, err
+	}
+	defer table.Close()
+	entries, err := table.Entries()
+	if err != nil {
+		return SSSMeta{}, err
+	}
+	if len(entries) == 0 {
+		return SSSMeta{}, fmt.Errorf("no records")
+	}
+	props, ok := table.Properties()
+	if ok && props.NumEntries != uint64(len(entries)) {
+		return SSSMeta{}, fmt.Errorf("%d of %d records", len(entries), props.NumEntries)
+	}
+
+	var minKey, maxKey string
+	first := true
+	for k := range entries {
+		if first || k < minKey {
+			minKey = k
+		}
+		if first || k > maxKey {
+			maxKey = k
+		}
+		first = false
+	}
+	return newSSSMeta(fs, path, name, 0, entries, minKey, maxKey, props.SmallestSeq, props.LargestSeq)
+}
+
+// repairLevel returns the level a recovered file is placed on: level 0,
+// unless files overlapping it hold newer writes, then the level below the
+// deepest of them, so it cannot hide them from reads. Below the bottommost
+// level it shares the level with them, where reads order files by their
+// sequence numbers.
+func repairLevel(meta SSSMeta, files []SSSMeta) int {
+	level := 0
+	for _, f := range files {
+		if newerFile(f, meta) && overlapsAny(f, []SSSMeta{meta}) && f.Level >= level {
+			level = f.Level + 1
+		}
+	}
+	if level >= constants.NUM_LEVELS {
+		level = constants.NUM_LEVELS - 1
+	}
+	return level
+}
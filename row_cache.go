@@ -0,0 +1,257 @@
+// Copyright 2025 The QuellDB Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be found in
+// the LICENSE file.
+
+package quelldb
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/quellington/quelldb/base"
+	"github.com/quellington/quelldb/constants"
+)
+
+// RowCacheStats holds the counters of the row cache.
+type RowCacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Inserts   uint64
+	Evictions uint64
+	// Invalidations counts the rows dropped because a flush or compaction
+	// changed the SSS files holding their key. Rows are checked and
+	// dropped when they are next read.
+	Invalidations uint64
+	// Entries and Size are the number and the approximate bytes of the rows
+	// held.
+	Entries int
+	Size    int64
+}
+
+// cachedRow is what the SSS files of one version hold for a key: the merge
+// records, newest first, stacked on the record found below them.
+// version is the newest version the row is known to hold for.
+type cachedRow struct {
+	key     string
+	entry   base.Entry
+	merges  []base.Entry
+	charge  int64
+	version uint64
+}
+
+// versionChange names the files added or removed by a version.
+type versionChange struct {
+	version uint64
+	files   []SSSMeta
+}
+
+// rowCache caches the SSS lookups of Get by user key, least recently used
+// first out. Only readers of the version the cache was last advanced to
+// read and fill it. A row read from an older version is checked against
+// the files changed since when it is next read, and dropped if one of them
+// may hold its key, so installing a version costs nothing per row.
+// A nil rowCache caches nothing.
+type rowCache struct {
+	capacity int64
+
+	mu      sync.Mutex
+	version uint64
+	size    int64
+	lru     *list.List
+	items   map[string]*list.Element
+	stats   RowCacheStats
+
+	// changes holds the files changed by the versions after historyFrom,
+	// oldest first, up to ROW_CACHE_VERSION_HISTORY of them. Rows older
+	// than historyFrom cannot be checked and are dropped.
+	changes     []versionChange
+	historyFrom uint64
+}
+
+func newRowCache(capacity int64) *rowCache {
+	return &rowCache{
+		capacity: capacity,
+		lru:      list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+// get returns the row of the key read from the given version.
+func (c *rowCache) get(version uint64, key string) (*cachedRow, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[key]; ok && version == c.version {
+		row := e.Value.(*cachedRow)
+		if c.current(row) {
+			c.lru.MoveToFront(e)
+			c.stats.Hits++
+			return row, true
+		}
+		c.stats.Invalidations++
+		c.remove(e)
+	}
+	c.stats.Misses++
+	return nil, false
+}
+
+// current reports whether a row still holds for the current version, and
+// moves it to the current version if so. A row is outdated once a file
+// changed after the version it was read from may hold its key.
+// The caller must hold c.mu.
+func (c *rowCache) current(row *cachedRow) bool {
+	if row.version == c.version {
+		return true
+	}
+	if row.version < c.historyFrom {
+		return false
+	}
+	for i := len(c.changes) - 1; i >= 0 && c.changes[i].version > row.version; i-- {
+		for _, f := range c.changes[i].files {
+			// files without recorded bounds may hold any key
+			unbounded := f.MinKey == "" && f.MaxKey == ""
+			if unbounded || (row.key >= f.MinKey && row.key <= f.MaxKey) {
+				return false
+			}
+		}
+	}
+	row.version = c.version
+	return true
+}
+
+// set stores the row of a key read from the given version, unless a newer
+// version has been installed meanwhile.
+func (c *rowCache) set(version uint64, row *cachedRow) {
+	if c == nil {
+		return
+	}
+	row.charge = rowCharge(row)
+	if row.charge > c.capacity {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if version != c.version {
+		return
+	}
+	row.version = version
+	if e, ok := c.items[row.key]; ok {
+		c.remove(e)
+	}
+	c.items[row.key] = c.lru.PushFront(row)
+	c.size += row.charge
+	c.stats.Inserts++
+	for c.size > c.capacity {
+		c.stats.Evictions++
+		c.remove(c.lru.Back())
+	}
+}
+
+// advance moves the cache to a new version, remembering the files added or
+// removed by it. Rows within their key range are dropped when next read.
+func (c *rowCache) advance(version uint64, changed []SSSMeta) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.version = version
+	if len(changed) == 0 {
+		return
+	}
+	c.changes = append(c.changes, versionChange{version: version, files: changed})
+	if len(c.changes) > constants.ROW_CACHE_VERSION_HISTORY {
+		c.historyFrom = c.changes[0].version
+		c.changes = c.changes[1:]
+	}
+}
+
+// remove drops a row. The caller must hold c.mu.
+func (c *rowCache) remove(e *list.Element) {
+	row := c.lru.Remove(e).(*cachedRow)
+	delete(c.items, row.key)
+	c.size -= row.charge
+}
+
+// rowCharge approximates the memory held by a row.
+func rowCharge(row *cachedRow) int64 {
+	n := len(row.key) + len(row.entry.Value)
+	for _, op := range row.entry.Operands {
+		n += len(op)
+	}
+	for _, m := range row.merges {
+		for _, op := range m.Operands {
+			n += len(op)
+		}
+	}
+	return int64(n)
+}
+
+// changedFiles returns the files named by only one of two versions, files
+// moved to another level included.
+func changedFiles(old, cur []SSSMeta) []SSSMeta {
+	levels := make(map[string]int, len(old))
+	for _, f := range old {
+		levels[f.Filename] = f.Level
+	}
+	var changed []SSSMeta
+	for _, f := range cur {
+		level, ok := levels[f.Filename]
+		if !ok || level != f.Level {
+			changed = append(changed, f)
+		}
+		delete(levels, f.Filename)
+	}
+	for _, f := range old {
+		if _, ok := levels[f.Filename]; ok {
+			changed = append(changed, f)
+		}
+	}
+	return changed
+}
+
+// sssGet collects what the SSS files of a version hold for a key, the merge
+// records newest first and the record found below them, through the row
+// cache when one is configured. A key no file holds reads as deleted.
+func (db *DB) sssGet(v *version, key string) (base.Entry, []base.Entry, error) {
+	if row, ok := db.rows.get(v.num, key); ok {
+		return row.entry, row.merges, nil
+	}
+
+	var merges []base.Entry
+	entry := base.Entry{Kind: base.KindDelete}
+	// check from newest SSS to oldest, level by level
+	for _, meta := range readOrder(v.files) {
+		// the bloom filter of the file is checked first
+		e, ok, err := db.tableGet(meta, key)
+		if err != nil {
+			return base.Entry{}, nil, err
+		}
+		if ok {
+			if e.Kind != base.KindMerge {
+				entry = e
+				break
+			}
+			merges = append(merges, e)
+		}
+	}
+	db.rows.set(v.num, &cachedRow{key: key, entry: entry, merges: merges})
+	return entry, merges, nil
+}
+
+// RowCacheStats returns the hit, miss and invalidation counts and the usage
+// of the row cache, all zero when Options.RowCacheBytes is not set.
+func (db *DB) RowCacheStats() RowCacheStats {
+	if db.rows == nil {
+		return RowCacheStats{}
+	}
+	db.rows.mu.Lock()
+	defer db.rows.mu.Unlock()
+	stats := db.rows.stats
+	stats.Entries = db.rows.lru.Len()
+	stats.Size = db.rows.size
+	return stats
+}
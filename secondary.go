@@ -0,0 +1,135 @@
+// Copyright 2025 The QuellDB Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be found in
+// the LICENSE file.
+
+package quelldb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/quellington/quelldb/base"
+	"github.com/quellington/quelldb/constants"
+	"github.com/quellington/quelldb/utils"
+)
+
+// OpenSecondary opens the database at primaryPath as a secondary instance
+// that follows a primary process writing to the same directory.
+// The secondary never writes to the primary directory and takes no lock on
+// it; secondaryPath is its own directory and holds its lock instead.
+// The secondary sees the primary as of the time it was opened, call
+// TryCatchUpWithPrimary to pick up newer writes. Mutating methods return
+// ErrReadOnly.
+func OpenSecondary(primaryPath, secondaryPath string, opts *Options) (*DB, error) {
+	if secondaryPath == "" {
+		return nil, fmt.Errorf("secondary path must not be empty")
+	}
+	return open(primaryPath, opts, secondaryPath)
+}
+
+// TryCatchUpWithPrimary brings a secondary up to date with its primary.
+// It re-reads the primary manifest, drops the memtables of WALs the primary
+// has flushed since and tails the remaining WALs from where the last call
+// stopped. When the primary installs a new manifest while the WALs are read,
+// the catch up is repeated so the file set and the memtables agree.
+// Files the primary removes in the meantime are missing from reads until
+// the next catch up. When the primary changed again during each of
+// SECONDARY_CATCH_UP_ATTEMPTS attempts, ErrCatchUpIncomplete is returned;
+// the secondary then holds the state of the last attempt, whose file set
+// and memtables may disagree, until a later call succeeds.
+func (db *DB) TryCatchUpWithPrimary() error {
+	if !db.secondary {
+		return fmt.Errorf("TryCatchUpWithPrimary requires a secondary instance")
+	}
+	if db.closed.Load() {
+		return ErrClosed
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for attempt := 0; attempt < constants.SECONDARY_CATCH_UP_ATTEMPTS; attempt++ {
+		state, name, _, err := loadManifestState(db.fs, db.basePath, db.key)
+		if err != nil {
+			return err
+		}
+		db.installVersion(state.files)
+		db.logNum, db.manifestName = state.logNumber, name
+		if state.lastSequence > db.seq {
+			db.seq = state.lastSequence
+		}
+		if err := db.tailWALs(); err != nil {
+			return err
+		}
+
+		after, _, _, err := loadManifestState(db.fs, db.basePath, db.key)
+		if err != nil || sameVersion(state, after) {
+			return err
+		}
+	}
+	return ErrCatchUpIncomplete
+}
+
+// sameVersion reports whether two manifest states name the same live files
+// and WALs.
+func sameVersion(a, b *manifestState) bool {
+	if a.logNumber != b.logNumber || len(a.files) != len(b.files) {
+		return false
+	}
+	for i := range a.files {
+		if a.files[i].Filename != b.files[i].Filename || a.files[i].Level != b.files[i].Level {
+			return false
+		}
+	}
+	return true
+}
+
+// tailWALs keeps one memtable per WAL of the primary that has not been
+// flushed yet and applies the records appended since the last call.
+// Memtables of WALs older than the log number are dropped, their data is
+// in the SSS files now.
+// The caller must hold db.mu.
+func (db *DB) tailWALs() error {
+	kept := db.immStorages[:0]
+	for _, imm := range db.immStorages {
+		if imm.walNum < db.logNum {
+			imm.mem.Close()
+			continue
+		}
+		kept = append(kept, imm)
+	}
+	db.immStorages = kept
+
+	logNums, err := utils.LogNumbersFS(db.fs, db.basePath)
+	if err != nil {
+		return err
+	}
+	for _, num := range logNums {
+		if num < db.logNum {
+			continue
+		}
+
+		i := len(db.immStorages)
+		for j, imm := range db.immStorages {
+			if imm.walNum == num {
+				i = j
+				break
+			}
+		}
+		if i == len(db.immStorages) {
+			db.immStorages = append(db.immStorages, frozenMemStorage{
+				mem:    base.NewMemStorage(),
+				walNum: num,
+			})
+		}
+
+		imm := &db.immStorages[i]
+		offset, err := db.tailWAL(filepath.Join(db.basePath, utils.LogFileName(num)), imm.mem, imm.walOffset)
+		imm.walOffset = offset
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
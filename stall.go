@@ -0,0 +1,328 @@
+// Copyright 2025 The QuellDB Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be found in
+// the LICENSE file.
+
+package quelldb
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/quellington/quelldb/constants"
+)
+
+// WriteStallCondition describes how writes are currently throttled.
+type WriteStallCondition int
+
+const (
+	WriteStallNormal WriteStallCondition = iota
+	WriteStallDelayed
+	WriteStallStopped
+)
+
+func (c WriteStallCondition) String() string {
+	switch c {
+	case WriteStallDelayed:
+		return "delayed"
+	case WriteStallStopped:
+		return "stopped"
+	}
+	return "normal"
+}
+
+// Causes reported in WriteStallInfo.
+const (
+	WriteStallCauseNone                   = ""
+	WriteStallCauseL0Files                = "l0-files"
+	WriteStallCausePendingCompactionBytes = "pending-compaction-bytes"
+	WriteStallCauseImmutableMemtables     = "immutable-memtables"
+)
+
+// WriteStallInfo is passed to Options.OnWriteStall when the condition changes.
+type WriteStallInfo struct {
+	Condition              WriteStallCondition
+	Previous               WriteStallCondition
+	Cause                  string
+	L0Files                int
+	PendingCompactionBytes uint64
+	ImmutableMemtables     int
+}
+
+// WriteStallStats holds the accumulated stall counters of a database.
+type WriteStallStats struct {
+	Condition     WriteStallCondition
+	Cause         string
+	DelayedWrites uint64
+	StoppedWrites uint64
+	DelayDuration time.Duration
+	StopDuration  time.Duration
+}
+
+type writeStall struct {
+	l0Slowdown   uint
+	l0Stop       uint
+	softPending  uint64
+	hardPending  uint64
+	maxImmutable uint
+	onChange     func(WriteStallInfo)
+	condition    WriteStallCondition
+	cause        string
+	changed      chan struct{}
+	stats        WriteStallStats
+	// events are the changes not yet passed to onChange, delivered by a
+	// single goroutine while delivering is set
+	events     []WriteStallInfo
+	delivering bool
+	// relief is the running flush or compaction clearing a stop, nil
+	// when none runs
+	relief *stallRelief
+	// work tracks the goroutines delivering events and relieving stops,
+	// Close waits for them
+	work sync.WaitGroup
+}
+
+// stallRelief is a flush or compaction run to clear a stop. done is
+// closed once it finished, err is the error it stopped on.
+type stallRelief struct {
+	done chan struct{}
+	err  error
+}
+
+func (s *writeStall) setOptions(opts *Options) {
+	s.l0Slowdown = opts.L0SlowdownWritesTrigger
+	s.l0Stop = opts.L0StopWritesTrigger
+	s.softPending = opts.SoftPendingCompactionBytesLimit
+	s.hardPending = opts.HardPendingCompactionBytesLimit
+	s.maxImmutable = opts.MaxImmutableMemtables
+	s.onChange = opts.OnWriteStall
+}
+
+// WriteStallStats returns the current stall condition together with the
+// number of delayed and stopped writes and the time they spent waiting.
+func (db *DB) WriteStallStats() WriteStallStats {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	stats := db.stall.stats
+	stats.Condition = db.stall.condition
+	stats.Cause = db.stall.cause
+	return stats
+}
+
+// updateWriteStall re-evaluates the stall triggers against the current
+// number of SSS files, pending compaction bytes and immutable memtables.
+// Writers waiting on a stop are woken up whenever the condition changes.
+// The caller must hold db.mu.
+func (db *DB) updateWriteStall() {
+	s := &db.stall
+	l0 := filesAtLevel(db.current.files, 0)
+	info := WriteStallInfo{
+		Previous:           s.condition,
+		L0Files:            len(l0),
+		ImmutableMemtables: len(db.immStorages),
+	}
+
+	if len(l0) > 0 && uint(len(l0)) >= db.compactLimit {
+		info.PendingCompactionBytes = db.pendingCompactionBytes(expandOverlapping(l0, db.current.files))
+	}
+
+	switch {
+	case s.l0Stop > 0 && uint(info.L0Files) >= s.l0Stop:
+		info.Condition, info.Cause = WriteStallStopped, WriteStallCauseL0Files
+	case s.hardPending > 0 && info.PendingCompactionBytes >= s.hardPending:
+		info.Condition, info.Cause = WriteStallStopped, WriteStallCausePendingCompactionBytes
+	case s.maxImmutable > 0 && uint(info.ImmutableMemtables) >= s.maxImmutable:
+		info.Condition, info.Cause = WriteStallStopped, WriteStallCauseImmutableMemtables
+	case s.l0Slowdown > 0 && uint(info.L0Files) >= s.l0Slowdown:
+		info.Condition, info.Cause = WriteStallDelayed, WriteStallCauseL0Files
+	case s.softPending > 0 && info.PendingCompactionBytes >= s.softPending:
+		info.Condition, info.Cause = WriteStallDelayed, WriteStallCausePendingCompactionBytes
+	}
+
+	if info.Condition == s.condition && info.Cause == s.cause {
+		return
+	}
+	s.condition, s.cause = info.Condition, info.Cause
+	if s.changed != nil {
+		close(s.changed)
+	}
+	s.changed = make(chan struct{})
+
+	// nothing is started any more once Close waits for the running work
+	if s.onChange != nil && !db.closed.Load() {
+		s.events = append(s.events, info)
+		if !s.delivering {
+			s.delivering = true
+			s.work.Add(1)
+			go db.deliverWriteStalls()
+		}
+	}
+}
+
+// deliverWriteStalls passes the queued stall changes to onChange in the
+// order they happened, without holding db.mu, and returns once the queue
+// is empty.
+func (db *DB) deliverWriteStalls() {
+	s := &db.stall
+	defer s.work.Done()
+	for {
+		db.mu.Lock()
+		if len(s.events) == 0 {
+			s.delivering = false
+			db.mu.Unlock()
+			return
+		}
+		info, onChange := s.events[0], s.onChange
+		s.events = s.events[1:]
+		db.mu.Unlock()
+		onChange(info)
+	}
+}
+
+// pendingCompactionBytes sums the size of the SSS files waiting to be compacted.
+func (db *DB) pendingCompactionBytes(ssss []SSSMeta) uint64 {
+	var total uint64
+	for _, meta := range ssss {
+		if meta.FileSize > 0 {
+			total += uint64(meta.FileSize)
+			continue
+		}
+		// files recorded before sizes were kept
+		if stat, err := db.fs.Stat(filepath.Join(db.basePath, meta.Filename)); err == nil {
+			total += uint64(stat.Size())
+		}
+	}
+	return total
+}
+
+// startStallRelief returns the running relief of a stop, starting one when
+// none runs. It returns nil once the database is closed.
+// The caller must hold db.mu.
+func (db *DB) startStallRelief() *stallRelief {
+	s := &db.stall
+	if s.relief == nil && !db.closed.Load() {
+		s.relief = &stallRelief{done: make(chan struct{})}
+		s.work.Add(1)
+		go db.relieveWriteStall(s.relief)
+	}
+	return s.relief
+}
+
+// relieveWriteStall flushes the immutable memtables or compacts level 0,
+// whatever stopped the writes, until writes are no longer stopped. Level 0
+// is compacted even below the compact limit, so a stop trigger under it
+// clears as well.
+func (db *DB) relieveWriteStall(r *stallRelief) {
+	defer db.stall.work.Done()
+	for r.err == nil {
+		db.mu.Lock()
+		condition, cause, changed := db.stall.condition, db.stall.cause, db.stall.changed
+		db.mu.Unlock()
+		if condition != WriteStallStopped || db.closed.Load() {
+			break
+		}
+		if cause == WriteStallCauseImmutableMemtables {
+			r.err = db.flush()
+		} else {
+			r.err = db.compact(1)
+		}
+
+		db.mu.Lock()
+		if r.err == nil && db.stall.changed == changed {
+			r.err = fmt.Errorf("write stall %s not cleared", cause)
+		}
+		db.mu.Unlock()
+	}
+	if r.err != nil && r.err != ErrClosed {
+		db.logger.Printf("quelldb: relieving write stall: %v", r.err)
+	}
+
+	db.mu.Lock()
+	db.stall.relief = nil
+	db.mu.Unlock()
+	close(r.done)
+}
+
+// waitForWriteRoom delays or blocks a write according to the stall condition.
+// A delayed write sleeps once for WRITE_STALL_SLOWDOWN_DELAY_MS. A stopped
+// write starts the flush or compaction clearing the stop, unless one is
+// running, and waits until the condition changes or the context is done.
+// It returns the error of that flush or compaction when it failed to clear
+// the stop.
+func (db *DB) waitForWriteRoom(ctx context.Context) error {
+	delayed := false
+	for {
+		db.mu.Lock()
+		condition, changed := db.stall.condition, db.stall.changed
+		db.mu.Unlock()
+		if db.closed.Load() {
+			return ErrClosed
+		}
+
+		switch condition {
+		case WriteStallNormal:
+			return nil
+
+		case WriteStallDelayed:
+			if delayed {
+				return nil
+			}
+			delayed = true
+			start := time.Now()
+			timer := time.NewTimer(constants.WRITE_STALL_SLOWDOWN_DELAY_MS * time.Millisecond)
+			select {
+			case <-timer.C:
+			case <-changed:
+				timer.Stop()
+			case <-ctx.Done():
+				timer.Stop()
+			}
+			db.recordWriteStall(WriteStallDelayed, time.Since(start))
+			if err := ctx.Err(); err != nil {
+				return fmt.Errorf("write delayed by stall: %w", err)
+			}
+
+		case WriteStallStopped:
+			db.mu.Lock()
+			relief := db.startStallRelief()
+			db.mu.Unlock()
+			if relief == nil {
+				return ErrClosed
+			}
+
+			start := time.Now()
+			select {
+			case <-changed:
+			case <-relief.done:
+			case <-ctx.Done():
+			}
+			db.recordWriteStall(WriteStallStopped, time.Since(start))
+			if err := ctx.Err(); err != nil {
+				return fmt.Errorf("write stopped by stall: %w", err)
+			}
+			select {
+			case <-relief.done:
+				if relief.err != nil {
+					return fmt.Errorf("write stopped by stall: %w", relief.err)
+				}
+			default:
+			}
+		}
+	}
+}
+
+func (db *DB) recordWriteStall(condition WriteStallCondition, d time.Duration) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if condition == WriteStallStopped {
+		db.stall.stats.StoppedWrites++
+		db.stall.stats.StopDuration += d
+		return
+	}
+	db.stall.stats.DelayedWrites++
+	db.stall.stats.DelayDuration += d
+}
@@ -40,10 +40,19 @@ func (db *DB) Unsubscribe(id int) {
 // Subscribe adds a new subscriber to the database.
 // The subscriber is a function that takes a ChangeEvent as an argument.
 // The subscriber will be notified of changes to the database, such as PUT or DELETE operations.
+// Nothing is published once Close has started, so no handler is added
+// while Close waits for the running ones.
 func (db *DB) publish(event ChangeEvent) {
 	db.subLock.RLock()
 	defer db.subLock.RUnlock()
+	if db.closed.Load() {
+		return
+	}
 	for _, handler := range db.subscribers {
-		go handler(event)
+		db.handlers.Add(1)
+		go func(handler func(ChangeEvent)) {
+			defer db.handlers.Done()
+			handler(event)
+		}(handler)
 	}
 }
@@ -0,0 +1,241 @@
+// Copyright 2025 The QuellDB Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be found in
+// the LICENSE file.
+
+package quelldb
+
+import (
+	"container/list"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/quellington/quelldb/base"
+)
+
+// TableCacheStats holds the counters of the table cache.
+type TableCacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	// OpenTables is the number of SSS files currently held open.
+	OpenTables int
+}
+
+// cachedTable is an open SSS file with its parsed index and filters.
+// It is closed once it left the cache and no reader holds it anymore.
+type cachedTable struct {
+	num    int
+	table  *base.Table
+	filter *base.Filter
+	// prefixFilter is nil for files without one of the prefix extractor
+	prefixFilter *base.Filter
+	// refs and evicted are guarded by tableCache.mu
+	refs    int
+	evicted bool
+}
+
+// tableCache keeps up to Options.MaxOpenFiles SSS files open, keyed by file
+// number, least recently used first out. Readers take a table with find and
+// hand it back with release.
+type tableCache struct {
+	db       *DB
+	capacity int
+
+	mu    sync.Mutex
+	lru   *list.List
+	items map[int]*list.Element
+	stats TableCacheStats
+	// closed is set by close, no table is opened any more
+	closed bool
+}
+
+func newTableCache(db *DB, capacity int) *tableCache {
+	return &tableCache{
+		db:       db,
+		capacity: capacity,
+		lru:      list.New(),
+		items:    make(map[int]*list.Element),
+	}
+}
+
+// find returns the open table of an SSS file, opening it on a miss.
+// The table must be handed back with release. Once the cache is closed it
+// returns ErrClosed.
+func (c *tableCache) find(meta SSSMeta) (*cachedTable, error) {
+	num := sssFileNumber(meta.Filename)
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, ErrClosed
+	}
+	if e, ok := c.items[num]; ok {
+		c.lru.MoveToFront(e)
+		t := e.Value.(*cachedTable)
+		t.refs++
+		c.stats.Hits++
+		c.mu.Unlock()
+		return t, nil
+	}
+	c.stats.Misses++
+	c.mu.Unlock()
+
+	// opened without the lock, readers of other files go on meanwhile
+	t, err := c.open(meta, num)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		// the database was closed while the file was opened
+		t.table.Close()
+		return nil, ErrClosed
+	}
+	if e, ok := c.items[num]; ok {
+		// another reader opened it first
+		t.table.Close()
+		t = e.Value.(*cachedTable)
+		c.lru.MoveToFront(e)
+	} else {
+		c.items[num] = c.lru.PushFront(t)
+		for c.lru.Len() > c.capacity {
+			c.stats.Evictions++
+			c.remove(c.lru.Back())
+		}
+	}
+	t.refs++
+	c.stats.OpenTables = c.lru.Len()
+	return t, nil
+}
+
+// open opens an SSS file and loads its filters, built by any known filter
+// policy. Files without a filter, or one of an unknown policy, are searched
+// without one. A filter that cannot be read fails the open, except for the
+// filter file of a file written before filters were embedded.
+func (c *tableCache) open(meta SSSMeta, num int) (*cachedTable, error) {
+	db := c.db
+	path := filepath.Join(db.basePath, meta.Filename)
+	table, err := base.OpenTableFS(db.fs, path, db.key, db.tableOptions(meta))
+	if err != nil {
+		return nil, err
+	}
+	filter, prefixFilter, err := table.LoadFilters(db.prefixExtractor, db.filterPolicy)
+	if err != nil {
+		if _, embedded := table.Properties(); embedded {
+			table.Close()
+			return nil, err
+		}
+		db.logger.Printf("quelldb: reading %s without a filter: %v", meta.Filename, err)
+		filter, prefixFilter = nil, nil
+	}
+	return &cachedTable{num: num, table: table, filter: filter, prefixFilter: prefixFilter}, nil
+}
+
+// release hands back a table returned by find.
+func (c *tableCache) release(t *cachedTable) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t.refs--
+	if t.refs == 0 && t.evicted {
+		t.table.Close()
+	}
+}
+
+// evict drops the table of a deleted SSS file.
+func (c *tableCache) evict(num int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[num]; ok {
+		c.remove(e)
+		c.stats.OpenTables = c.lru.Len()
+	}
+}
+
+// close drops every table, tables still being read are closed on release.
+// No table is opened afterwards.
+func (c *tableCache) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+	c.stats.OpenTables = 0
+}
+
+// remove takes a table out of the cache, closing it unless a reader still
+// holds it. The caller must hold c.mu.
+func (c *tableCache) remove(e *list.Element) {
+	t := c.lru.Remove(e).(*cachedTable)
+	delete(c.items, t.num)
+	t.evicted = true
+	if t.refs == 0 {
+		t.table.Close()
+	}
+}
+
+// skipMissingTable reports whether a file that could not be opened is
+// skipped. A secondary may find a file removed by its primary and skips it
+// until the next catch up. Anywhere else the version refers to a file that
+// must exist, so the error is reported.
+func (db *DB) skipMissingTable(err error) bool {
+	return db.secondary && errors.Is(err, os.ErrNotExist)
+}
+
+// tableGet looks the key up in a single SSS file, unless its filter
+// rules the key out.
+func (db *DB) tableGet(meta SSSMeta, key string) (base.Entry, bool, error) {
+	t, err := db.tables.find(meta)
+	if err != nil {
+		if db.skipMissingTable(err) {
+			return base.Entry{}, false, nil
+		}
+		return base.Entry{}, false, err
+	}
+	defer db.tables.release(t)
+
+	if t.filter != nil && !t.filter.MayContain(key) {
+		return base.Entry{}, false, nil
+	}
+	return t.table.Get(key)
+}
+
+// tablePrefixEntries returns the records of a single SSS file whose key
+// starts with prefix. Files whose key range or prefix filter rule the
+// prefix out are not read.
+func (db *DB) tablePrefixEntries(meta SSSMeta, prefix string) (map[string]base.Entry, error) {
+	if prefix != "" && meta.MaxKey != "" &&
+		(meta.MaxKey < prefix || (meta.MinKey > prefix && !strings.HasPrefix(meta.MinKey, prefix))) {
+		return nil, nil
+	}
+
+	t, err := db.tables.find(meta)
+	if err != nil {
+		if db.skipMissingTable(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer db.tables.release(t)
+
+	// every key starting with prefix has the prefix the extractor takes
+	// from it
+	if t.prefixFilter != nil && prefix != "" {
+		if p, ok := db.prefixExtractor.Prefix(prefix); ok && !t.prefixFilter.MayContain(p) {
+			return nil, nil
+		}
+	}
+	return t.table.PrefixEntries(prefix)
+}
+
+// TableCacheStats returns the hit, miss and eviction counts of the table
+// cache and the number of SSS files it holds open.
+func (db *DB) TableCacheStats() TableCacheStats {
+	db.tables.mu.Lock()
+	defer db.tables.mu.Unlock()
+	return db.tables.stats
+}
@@ -0,0 +1,93 @@
+// Copyright 2025 The QuellDB Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be found in
+// the LICENSE file.
+
+package tests
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/quellington/quelldb"
+	"github.com/quellington/quelldb/cache"
+)
+
+func TestBlockCache(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	db, err := quelldb.Open(t.TempDir(), &quelldb.Options{EncryptionKey: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// enough records for several blocks
+	for i := 0; i < 2000; i++ {
+		db.Put(fmt.Sprintf("key%05d", i), fmt.Sprintf("value-%d", i))
+	}
+	db.Flush()
+
+	for round := 0; round < 2; round++ {
+		for i := 0; i < 2000; i += 100 {
+			val, err := db.Get(fmt.Sprintf("key%05d", i))
+			if err != nil || val != fmt.Sprintf("value-%d", i) {
+				t.Fatalf("key%05d = %q, %v", i, val, err)
+			}
+		}
+	}
+
+	stats := db.BlockCacheStats()
+	if stats.Misses == 0 || stats.Hits < 20 {
+		t.Fatalf("expected the second round to hit the cache, got %+v", stats)
+	}
+	if stats.Entries == 0 || stats.Size == 0 || stats.Size > stats.Capacity {
+		t.Fatalf("unexpected cache usage %+v", stats)
+	}
+}
+
+func TestSharedBlockCache(t *testing.T) {
+	shared := cache.New(1 << 20)
+	a, err := quelldb.Open(t.TempDir(), &quelldb.Options{BlockCache: shared})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := quelldb.Open(t.TempDir(), &quelldb.Options{BlockCache: shared})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	// the same file numbers and keys in both databases must not mix
+	a.Put("k", "from-a")
+	a.Flush()
+	b.Put("k", "from-b")
+	b.Flush()
+	for i := 0; i < 2; i++ {
+		if val, _ := a.Get("k"); val != "from-a" {
+			t.Fatalf("a: k = %q", val)
+		}
+		if val, _ := b.Get("k"); val != "from-b" {
+			t.Fatalf("b: k = %q", val)
+		}
+	}
+
+	if stats := shared.Stats(); stats.Entries != 2 || stats.Hits != 2 {
+		t.Fatalf("expected one cached block per database, got %+v", stats)
+	}
+	if a.BlockCacheStats() != shared.Stats() {
+		t.Fatal("a shared cache reports the same stats to every database")
+	}
+
+	// a full cache evicts the least recently used blocks
+	small := cache.New(64)
+	for offset := uint64(0); offset < 100; offset++ {
+		small.Set(1, 1, offset*3, make([]byte, 3))
+	}
+	if stats := small.Stats(); stats.Evictions == 0 || stats.Size > stats.Capacity {
+		t.Fatalf("expected evictions within the capacity, got %+v", stats)
+	}
+	small.EvictFile(1, 1)
+	if stats := small.Stats(); stats.Entries != 0 || stats.Size != 0 {
+		t.Fatalf("blocks of an evicted file left, got %+v", stats)
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2025 The QuellDB Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be found in
+// the LICENSE file.
+
+package tests
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/quellington/quelldb"
+	"github.com/quellington/quelldb/base"
+	"github.com/quellington/quelldb/constants"
+	"github.com/quellington/quelldb/vfs"
+)
+
+// falsePositiveRate writes n keys with the writer options and returns the
+// share of absent keys its bloom filter lets through.
+func falsePositiveRate(t *testing.T, n int, opts base.WriterOptions) (float64, *base.BloomFilter) {
+	fs := vfs.NewMem()
+	entries := make(map[string]base.Entry, n)
+	for i := 0; i < n; i++ {
+		entries[fmt.Sprintf("key%07d", i)] = base.Entry{Kind: base.KindValue, Value: "v"}
+	}
+	path := "sss-00001.qldb"
+	if _, _, err := base.WriteSSStorageEntriesFS(fs, path, entries, nil, opts); err != nil {
+		t.Fatal(err)
+	}
+	filter := tableBloomFilter(t, fs, path)
+
+	for k := range entries {
+		if !filter.Test(k) {
+			t.Fatalf("bloom filter rejects %s", k)
+		}
+	}
+	positives := 0
+	for i := 0; i < 20000; i++ {
+		if filter.Test(fmt.Sprintf("absent%07d", i)) {
+			positives++
+		}
+	}
+	return float64(positives) / 20000, filter
+}
+
+// tableBloomFilter returns the bloom filter embedded in an SSS file.
+func tableBloomFilter(t *testing.T, fs vfs.FS, path string) *base.BloomFilter {
+	table, err := base.OpenTableFS(fs, path, nil, base.TableOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.Close()
+	keys, _, err := table.LoadFilters(nil)
+	if err != nil || keys == nil {
+		t.Fatalf("no filter in %s: %v", path, err)
+	}
+	filter, ok := keys.Bloom()
+	if !ok {
+		t.Fatalf("%s filter of %s", keys.PolicyName(), path)
+	}
+	return filter
+}
+
+func TestBloomFilterSizing(t *testing.T) {
+	// the default of 10 bits per key gives about 1% false positives,
+	// whatever the number of keys
+	for _, n := range []int{100, 100000} {
+		rate, filter := falsePositiveRate(t, n, base.WriterOptions{})
+		if rate > 0.02 {
+			t.Fatalf("%d keys: false positive rate %.3f", n, rate)
+		}
+		if filter.Size() < uint32(n*10) {
+			t.Fatalf("%d keys: filter of %d bits", n, filter.Size())
+		}
+	}
+
+	rate, filter := falsePositiveRate(t, 10000, base.WriterOptions{BloomBitsPerKey: base.BloomBitsPerKey(0.001)})
+	if rate > 0.004 || filter.HashCount() != 10 {
+		t.Fatalf("false positive rate %.4f with %d hashes for a target of 0.001", rate, filter.HashCount())
+	}
+
+	// fixed parameters are read back from the filter header
+	_, filter = falsePositiveRate(t, 1000, base.WriterOptions{BloomBits: 4096, BloomHashCount: 3})
+	if filter.Size() != 4096 || filter.HashCount() != 3 {
+		t.Fatalf("filter of %d bits and %d hashes, expected 4096 and 3", filter.Size(), filter.HashCount())
+	}
+}
+
+func TestBloomFilterFormats(t *testing.T) {
+	fs := vfs.NewMem()
+	filter := base.NewBloomFilterForKeys(1000, 30)
+	if filter.HashCount() <= 8 || filter.Size()%512 != 0 {
+		t.Fatalf("filter of %d bits and %d hashes", filter.Size(), filter.HashCount())
+	}
+
+	// filters written before the header hold BOOM_BIT_SIZE bits
+	legacy := make([]byte, constants.BOOM_BIT_SIZE/8+1)
+	for i := range legacy {
+		legacy[i] = 0xff
+	}
+	vfs.WriteFile(fs, "legacy.filter", legacy)
+	filter, err := base.LoadBloomFilterFS(fs, "legacy.filter", 0, 0)
+	if err != nil || filter.Size() != constants.BOOM_BIT_SIZE || !filter.Test("any") {
+		t.Fatalf("legacy filter not read: %v", err)
+	}
+
+	// formats of later versions are refused rather than misread
+	unknown := append([]byte(constants.FILTER_MAGIC), 99, 4, 0, 2, 0, 0)
+	vfs.WriteFile(fs, "unknown.filter", append(unknown, make([]byte, 64)...))
+	if _, err := base.LoadBloomFilterFS(fs, "unknown.filter", 0, 0); err == nil {
+		t.Fatal("filter of an unknown format loaded")
+	}
+}
+
+func TestBloomFilterOptions(t *testing.T) {
+	dir := t.TempDir()
+	db, err := quelldb.Open(dir, &quelldb.Options{BloomFalsePositiveRate: 0.001})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5000; i++ {
+		db.Put(fmt.Sprintf("key%05d", i), "v")
+	}
+	db.Flush()
+	db.Close()
+
+	// files written with other filter options stay readable
+	db, err = quelldb.Open(dir, &quelldb.Options{BloomBitsPerKey: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 5000; i++ {
+		if val, err := db.Get(fmt.Sprintf("key%05d", i)); err != nil || val != "v" {
+			t.Fatalf("key%05d = %q, %v", i, val, err)
+		}
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*"+constants.SSS_SUFFIX))
+	if len(files) != 1 {
+		t.Fatalf("expected one SSS file, found %v", files)
+	}
+	if filter := tableBloomFilter(t, vfs.Default, files[0]); filter.Size() < 5000*14 {
+		t.Fatalf("filter of %d bits for 5000 keys at 0.001 false positives", filter.Size())
+	}
+}
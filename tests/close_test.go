@@ -0,0 +1,169 @@
+// Copyright 2025 The QuellDB Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be found in
+// the LICENSE file.
+
+package tests
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/quellington/quelldb"
+	"github.com/quellington/quelldb/constants"
+	"github.com/quellington/quelldb/vfs"
+)
+
+func TestCloseContext(t *testing.T) {
+	dir := t.TempDir()
+	opts := &quelldb.Options{Logger: log.New(io.Discard, "", 0)}
+	goroutines := runtime.NumGoroutine()
+
+	db, err := quelldb.Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var handled atomic.Int32
+	db.Subscribe(func(e quelldb.ChangeEvent) {
+		time.Sleep(50 * time.Millisecond)
+		handled.Add(1)
+	})
+	db.Put("a", "1")
+	db.PutTTL("b", "2", time.Hour)
+
+	if err := db.CloseContext(context.Background(), &quelldb.CloseOptions{Flush: true}); err != nil {
+		t.Fatal(err)
+	}
+	if handled.Load() != 2 {
+		t.Fatalf("Close returned before the subscribers were drained, %d handled", handled.Load())
+	}
+	if err := db.Close(); !errors.Is(err, quelldb.ErrClosed) {
+		t.Fatalf("second Close: expected ErrClosed, got %v", err)
+	}
+	if err := db.Put("c", "3"); !errors.Is(err, quelldb.ErrClosed) {
+		t.Fatalf("Put: expected ErrClosed, got %v", err)
+	}
+	if _, err := db.Get("a"); !errors.Is(err, quelldb.ErrClosed) {
+		t.Fatalf("Get: expected ErrClosed, got %v", err)
+	}
+	if it := db.Iterator(); it.Next() || !errors.Is(it.Err(), quelldb.ErrClosed) {
+		t.Fatalf("Iterator: expected ErrClosed, got %v", it.Err())
+	}
+
+	// memtable TTL loops and handlers are gone
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > goroutines && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > goroutines {
+		t.Fatalf("%d goroutines left running after Close, %d before Open", n, goroutines)
+	}
+
+	// the flush on close left nothing to replay
+	ssss, err := quelldb.LoadManifest(dir, nil)
+	if err != nil || len(ssss) != 1 || ssss[0].EntryCount != 2 {
+		t.Fatalf("expected the memtable flushed on close: %+v, %v", ssss, err)
+	}
+}
+
+func TestCloseContextRunningFlush(t *testing.T) {
+	mem := vfs.NewMem()
+	fault := vfs.NewFault(mem)
+	opts := &quelldb.Options{FS: fault, Logger: log.New(io.Discard, "", 0)}
+	db, err := quelldb.Open("db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put("a", "1")
+
+	// hold the flush inside the creation of its SSS file
+	blocked, release := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	fault.SetInjector(func(op vfs.Op, name string) error {
+		if op == vfs.OpCreate && strings.HasSuffix(name, constants.SSS_SUFFIX) {
+			once.Do(func() { close(blocked) })
+			<-release
+		}
+		return nil
+	})
+	flushed := make(chan error, 1)
+	go func() { flushed <- db.Flush() }()
+	<-blocked
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := db.CloseContext(ctx, nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline error, got %v", err)
+	}
+	// the directory stays locked while the flush runs
+	if _, err := quelldb.Open("db", &quelldb.Options{FS: mem, Logger: opts.Logger}); !errors.Is(err, quelldb.ErrLocked) {
+		t.Fatalf("Open during the running flush: expected ErrLocked, got %v", err)
+	}
+
+	// the flush finishes, but can no longer log its file to the manifest
+	close(release)
+	if err := <-flushed; !errors.Is(err, quelldb.ErrClosed) {
+		t.Fatalf("flush after close: expected ErrClosed, got %v", err)
+	}
+	var reopened *quelldb.DB
+	for deadline := time.Now().Add(time.Second); ; {
+		if reopened, err = quelldb.Open("db", &quelldb.Options{FS: mem, Logger: opts.Logger}); !errors.Is(err, quelldb.ErrLocked) || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if val, err := reopened.Get("a"); err != nil || val != "1" {
+		t.Fatalf("a = %q, %v", val, err)
+	}
+}
+
+func TestCloseDuringTableOpen(t *testing.T) {
+	fault := vfs.NewFault(vfs.NewMem())
+	db, err := quelldb.Open("db", &quelldb.Options{FS: fault, Logger: log.New(io.Discard, "", 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put("a", "1")
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// hold the read inside the table cache while it opens the SSS file
+	blocked, release := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	fault.SetInjector(func(op vfs.Op, name string) error {
+		if op == vfs.OpOpen && strings.HasSuffix(name, constants.SSS_SUFFIX) {
+			once.Do(func() { close(blocked) })
+			<-release
+		}
+		return nil
+	})
+	read := make(chan error, 1)
+	go func() {
+		_, err := db.Get("a")
+		read <- err
+	}()
+	<-blocked
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	if err := <-read; !errors.Is(err, quelldb.ErrClosed) {
+		t.Fatalf("Get racing Close: expected ErrClosed, got %v", err)
+	}
+	if stats := db.TableCacheStats(); stats.OpenTables != 0 {
+		t.Fatalf("table opened after Close: %+v", stats)
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2025 The QuellDB Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be found in
+// the LICENSE file.
+
+package tests
+
+import (
+	"io"
+	"log"
+	"testing"
+
+	"github.com/quellington/quelldb"
+	"github.com/quellington/quelldb/vfs"
+)
+
+func TestCompactRange(t *testing.T) {
+	dir := t.TempDir()
+	db, err := quelldb.Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Put("a", "1")
+	db.Put("b1", "1")
+	db.Flush()
+	db.Put("b2", "2")
+	db.Put("c", "3")
+	db.Flush()
+	db.Put("x", "9")
+	db.Flush()
+	db.Delete("b1")
+	db.Delete("b2")
+
+	var events []quelldb.CompactRangeEvent
+	err = db.CompactRange("b", "c", &quelldb.CompactRangeOptions{
+		Exclusive: true,
+		OnProgress: func(e quelldb.CompactRangeEvent) {
+			events = append(events, e)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	last := events[len(events)-1]
+	if last.Stage != quelldb.CompactRangeCompleted || last.Err != nil {
+		t.Fatalf("unexpected last event: %+v", last)
+	}
+	if last.TargetLevel != 6 || last.InputFiles != 3 || last.FilesRead != 3 || last.OutputFiles != 1 {
+		t.Fatalf("unexpected progress: %+v", last)
+	}
+
+	for _, k := range []string{"b1", "b2"} {
+		if _, err := db.Get(k); err == nil {
+			t.Fatalf("%s should stay deleted", k)
+		}
+	}
+	for k, want := range map[string]string{"a": "1", "c": "3", "x": "9"} {
+		if val, _ := db.Get(k); val != want {
+			t.Fatalf("%s = %q, want %q", k, val, want)
+		}
+	}
+
+	if err := db.CompactRange("", "", &quelldb.CompactRangeOptions{TargetLevel: 9}); err == nil {
+		t.Fatal("expected error for invalid target level")
+	}
+}
+
+func TestCompactRangeFlushFailure(t *testing.T) {
+	fault := vfs.NewFault(vfs.NewMem())
+	db, err := quelldb.Open("db", &quelldb.Options{FS: fault, Logger: log.New(io.Discard, "", 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.Put("a", "1")
+
+	// the flush before the compaction cannot create its SSS file
+	fault.SetInjector(vfs.FailNth(vfs.OpCreate, 1))
+	var events []quelldb.CompactRangeEvent
+	err = db.CompactRange("", "", &quelldb.CompactRangeOptions{
+		OnProgress: func(e quelldb.CompactRangeEvent) {
+			events = append(events, e)
+		},
+	})
+	if err == nil {
+		t.Fatal("expected CompactRange to fail with the flush")
+	}
+	if len(events) != 0 {
+		t.Fatalf("expected no progress before the compaction started, got %+v", events)
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2025 The QuellDB Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be found in
+// the LICENSE file.
+
+package tests
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/quellington/quelldb"
+)
+
+type sessionPurger struct{}
+
+func (sessionPurger) Name() string { return "session-purger" }
+
+func (sessionPurger) Filter(ctx quelldb.CompactionFilterContext, key, value string) (quelldb.CompactionDecision, string) {
+	if strings.HasPrefix(key, "session:") {
+		return quelldb.CompactionRemove, ""
+	}
+	if value == "old" {
+		return quelldb.CompactionChangeValue, "new"
+	}
+	return quelldb.CompactionKeep, ""
+}
+
+func TestCompactionFilter(t *testing.T) {
+	db, err := quelldb.Open(t.TempDir(), &quelldb.Options{
+		CompactLimit:     2,
+		CompactionFilter: sessionPurger{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Put("session:1", "token")
+	db.Put("user:1", "old")
+	db.Flush()
+	db.Put("session:2", "token")
+	db.Put("user:2", "alice")
+	db.Flush()
+
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.Get("session:1"); err == nil {
+		t.Fatal("session:1 should have been removed by the filter")
+	}
+	if val, _ := db.Get("user:1"); val != "new" {
+		t.Fatalf("user:1 = %q, want new", val)
+	}
+	if val, _ := db.Get("user:2"); val != "alice" {
+		t.Fatalf("user:2 = %q, want alice", val)
+	}
+
+	stats := db.CompactionFilterStats()
+	if stats.Records != 4 || stats.Removed != 2 || stats.Changed != 1 || stats.Kept != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+// bottommostRecorder removes every session key and records whether the
+// compactions it ran in were bottommost.
+type bottommostRecorder struct {
+	sessionPurger
+	bottommost []bool
+}
+
+func (r *bottommostRecorder) Filter(ctx quelldb.CompactionFilterContext, key, value string) (quelldb.CompactionDecision, string) {
+	r.bottommost = append(r.bottommost, ctx.Bottommost)
+	return r.sessionPurger.Filter(ctx, key, value)
+}
+
+func TestCompactionFilterAboveBottommost(t *testing.T) {
+	dir := t.TempDir()
+	filter := &bottommostRecorder{}
+	db, err := quelldb.Open(dir, &quelldb.Options{
+		CompactLimit:     2,
+		CompactionFilter: filter,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// a file on the bottommost level, away from the keys compacted below
+	db.Put("zzz", "1")
+	db.Flush()
+	if err := db.CompactRange("", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	filter.bottommost = nil
+
+	db.Put("session:1", "token")
+	db.Flush()
+	db.Put("user:1", "alice")
+	db.Flush()
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(filter.bottommost) != 2 || filter.bottommost[0] || filter.bottommost[1] {
+		t.Fatalf("expected a compaction above the bottommost level, got %v", filter.bottommost)
+	}
+	if _, err := db.Get("session:1"); err == nil {
+		t.Fatal("session:1 should have been removed by the filter")
+	}
+	ssss, err := quelldb.LoadManifest(dir, nil)
+	if err != nil || len(ssss) != 2 {
+		t.Fatalf("manifest files = %v, %v", ssss, err)
+	}
+	for _, f := range ssss {
+		if f.Level == 1 && f.TombstoneCount != 1 {
+			t.Fatalf("removed record not kept as a tombstone above the bottommost level: %+v", f)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+// Copyright 2025 The QuellDB Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be found in
+// the LICENSE file.
+
+package tests
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/quellington/quelldb"
+	"github.com/quellington/quelldb/base"
+	"github.com/quellington/quelldb/constants"
+	"github.com/quellington/quelldb/vfs"
+)
+
+var codecs = []base.Compression{
+	base.NoCompression,
+	base.SnappyCompression,
+	base.ZstdCompression,
+	base.LZ4Compression,
+}
+
+// tableCompressions returns the codec recorded in every SSS file of dir.
+func tableCompressions(t *testing.T, fs vfs.FS, dir string) []string {
+	files, err := fs.List(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var codecs []string
+	for _, name := range files {
+		if !strings.HasSuffix(name, constants.SSS_SUFFIX) {
+			continue
+		}
+		table, err := base.OpenTableFS(fs, filepath.Join(dir, name), nil, base.TableOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		props, _ := table.Properties()
+		table.Close()
+		codecs = append(codecs, props.Compression)
+	}
+	return codecs
+}
+
+func TestCompressionCodecs(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	entries := make(map[string]base.Entry)
+	for i := 0; i < 2000; i++ {
+		// repetitive values compress, random ones are stored as they are
+		value := strings.Repeat(fmt.Sprintf("value-%d;", i%7), 1+i%20)
+		if i%10 == 0 {
+			raw := make([]byte, 100)
+			rng.Read(raw)
+			value = string(raw)
+		}
+		entries[fmt.Sprintf("key%05d", i)] = base.Entry{Kind: base.KindValue, Value: value}
+	}
+
+	for _, key := range [][]byte{nil, []byte("thisis32byteslongthisis32byteslo")} {
+		sizes := map[base.Compression]int{}
+		for _, codec := range codecs {
+			fs := vfs.NewMem()
+			opts := base.WriterOptions{Compression: codec, CompressionLevel: 9}
+			if _, _, err := base.WriteSSStorageEntriesFS(fs, "sss-00001.qldb", entries, key, opts); err != nil {
+				t.Fatal(err)
+			}
+			data, _ := vfs.ReadFile(fs, "sss-00001.qldb")
+			sizes[codec] = len(data)
+
+			got, err := base.ReadSSStorageEntriesFS(fs, "sss-00001.qldb", key)
+			if err != nil {
+				t.Fatalf("%v: %v", codec, err)
+			}
+			if len(got) != len(entries) {
+				t.Fatalf("%v: read %d records, wrote %d", codec, len(got), len(entries))
+			}
+			for k, entry := range entries {
+				if got[k].Value != entry.Value {
+					t.Fatalf("%v: %s = %q, want %q", codec, k, got[k].Value, entry.Value)
+				}
+			}
+		}
+		for _, codec := range codecs[1:] {
+			if sizes[codec] >= sizes[base.NoCompression] {
+				t.Fatalf("%v table of %d bytes, uncompressed %d", codec, sizes[codec], sizes[base.NoCompression])
+			}
+		}
+	}
+}
+
+func TestCompressionMixedTables(t *testing.T) {
+	fs := vfs.NewMem()
+	dir := "mixed"
+
+	// every reopen writes its file with another codec
+	for i, codec := range codecs {
+		db, err := quelldb.Open(dir, &quelldb.Options{FS: fs, Compression: codec})
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.Put(fmt.Sprintf("key%d", i), strings.Repeat(codec.String(), 50))
+		db.Flush()
+		db.Close()
+	}
+	got := tableCompressions(t, fs, dir)
+	if len(got) != len(codecs) {
+		t.Fatalf("expected %d SSS files, found %v", len(codecs), got)
+	}
+
+	db, err := quelldb.Open(dir, &quelldb.Options{FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i, codec := range codecs {
+		if val, err := db.Get(fmt.Sprintf("key%d", i)); err != nil || val != strings.Repeat(codec.String(), 50) {
+			t.Fatalf("key%d = %q, %v", i, val, err)
+		}
+	}
+}
+
+func TestBottommostCompression(t *testing.T) {
+	fs := vfs.NewMem()
+	dir := "bottommost"
+	db, err := quelldb.Open(dir, &quelldb.Options{
+		FS:                    fs,
+		CompactLimit:          2,
+		Compression:           base.LZ4Compression,
+		BottommostCompression: base.ZstdCompression,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for f := 0; f < 2; f++ {
+		db.Put(fmt.Sprintf("key%d", f), strings.Repeat("value", 40))
+		db.Flush()
+	}
+	if got := tableCompressions(t, fs, dir); len(got) != 2 || got[0] != "lz4" || got[1] != "lz4" {
+		t.Fatalf("flushed files written with %v, want lz4", got)
+	}
+
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if got := tableCompressions(t, fs, dir); len(got) != 1 || got[0] != "zstd" {
+		t.Fatalf("bottommost file written with %v, want zstd", got)
+	}
+	for f := 0; f < 2; f++ {
+		if val, _ := db.Get(fmt.Sprintf("key%d", f)); val != strings.Repeat("value", 40) {
+			t.Fatalf("key%d = %q after compaction", f, val)
+		}
+	}
+}
+
+func TestUnknownCompression(t *testing.T) {
+	for _, opts := range []*quelldb.Options{
+		{FS: vfs.NewMem(), Compression: base.Compression(9)},
+		{FS: vfs.NewMem(), BottommostCompression: base.Compression(9)},
+	} {
+		if db, err := quelldb.Open("db", opts); err == nil {
+			db.Close()
+			t.Fatalf("expected Open to refuse compression %v, bottommost %v", opts.Compression, opts.BottommostCompression)
+		}
+	}
+
+	entries := map[string]base.Entry{"a": {Kind: base.KindValue, Value: "1"}}
+	opts := base.WriterOptions{Compression: base.Compression(9)}
+	if _, _, err := base.WriteSSStorageEntriesFS(vfs.NewMem(), "sss-00001.qldb", entries, nil, opts); err == nil {
+		t.Fatal("expected the writer to refuse an unknown compression")
+	}
+}
+
+func FuzzCompressionCodecs(f *testing.F) {
+	f.Add([]byte(""), []byte("value"))
+	f.Add([]byte("key"), bytes.Repeat([]byte("abcd"), 2000))
+	f.Add([]byte("k"), []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 255})
+	f.Fuzz(func(t *testing.T, prefix, value []byte) {
+		entries := map[string]base.Entry{}
+		for i := 0; i < 3; i++ {
+			entries[fmt.Sprintf("%s%d", prefix, i)] = base.Entry{Kind: base.KindValue, Value: string(value[:len(value)*i/2])}
+		}
+		for _, codec := range codecs {
+			fs := vfs.NewMem()
+			opts := base.WriterOptions{Compression: codec}
+			if _, _, err := base.WriteSSStorageEntriesFS(fs, "sss-00001.qldb", entries, nil, opts); err != nil {
+				t.Fatal(err)
+			}
+			got, err := base.ReadSSStorageEntriesFS(fs, "sss-00001.qldb", nil)
+			if err != nil {
+				t.Fatalf("%v: %v", codec, err)
+			}
+			for k, entry := range entries {
+				if got[k].Value != entry.Value {
+					t.Fatalf("%v: %q = %q, want %q", codec, k, got[k].Value, entry.Value)
+				}
+			}
+		}
+	})
+}
+
+// manifestCodecs returns the codec byte of every record of the current
+// manifest of dir.
+func manifestCodecs(t *testing.T, fs vfs.FS, dir string) []byte {
+	current, err := vfs.ReadFile(fs, filepath.Join(dir, constants.CURRENT_MANIFEST_FILE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := vfs.ReadFile(fs, filepath.Join(dir, strings.TrimSpace(string(current))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, []byte(constants.MANIFEST_LOG_CODEC_MAGIC)) {
+		t.Fatalf("manifest starts with %q", data[:4])
+	}
+	var codecs []byte
+	for data = data[4:]; len(data) >= 8; {
+		end := 8 + int(binary.LittleEndian.Uint32(data[4:]))
+		codecs = append(codecs, data[end-1])
+		data = data[end:]
+	}
+	return codecs
+}
+
+func TestManifestCompression(t *testing.T) {
+	fs := vfs.NewMem()
+	dir := "manifest"
+	// long keys make the snapshot records worth compressing
+	key := func(i int) string { return fmt.Sprintf("%s%d", strings.Repeat("key", 100), i) }
+
+	// the manifest records are compressed with the codec of the SSS files,
+	// recording it the way blocks do
+	for i, codec := range []base.Compression{base.ZstdCompression, base.LZ4Compression} {
+		db, err := quelldb.Open(dir, &quelldb.Options{FS: fs, Compression: codec})
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.Put(key(i), "value")
+		if err := db.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+	}
+	// the flush of the reopened store is appended to the same manifest;
+	// records too small to shrink are stored uncompressed
+	got := manifestCodecs(t, fs, dir)
+	if len(got) < 2 || got[len(got)-2] != 2 || got[len(got)-1] != 3 {
+		t.Fatalf("manifest record codecs %v, want zstd then lz4", got)
+	}
+
+	db, err := quelldb.Open(dir, &quelldb.Options{FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 2; i++ {
+		if val, err := db.Get(key(i)); err != nil || val != "value" {
+			t.Fatalf("%s = %q, %v", key(i), val, err)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2025 The QuellDB Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be found in
+// the LICENSE file.
+
+package tests
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/quellington/quelldb"
+)
+
+func TestConcurrentAccess(t *testing.T) {
+	dir := t.TempDir()
+	db, err := quelldb.Open(dir, &quelldb.Options{
+		CompactLimit: 2,
+		Logger:       log.New(io.Discard, "", 0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	const writers, perWriter = 4, 300
+	var written [writers]atomic.Int64
+	var done atomic.Bool
+	errs := make(chan error, 100)
+
+	var background sync.WaitGroup
+	background.Add(4)
+	go func() {
+		defer background.Done()
+		for !done.Load() {
+			if err := db.Flush(); err != nil {
+				errs <- fmt.Errorf("flush: %w", err)
+				return
+			}
+		}
+	}()
+	go func() {
+		defer background.Done()
+		for !done.Load() {
+			if err := db.Compact(); err != nil {
+				errs <- fmt.Errorf("compact: %w", err)
+				return
+			}
+			if err := db.CompactRange("", "", &quelldb.CompactRangeOptions{Exclusive: true}); err != nil {
+				errs <- fmt.Errorf("compact range: %w", err)
+				return
+			}
+		}
+	}()
+	for r := 0; r < 2; r++ {
+		go func(seed int64) {
+			defer background.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			for !done.Load() {
+				w := rnd.Intn(writers)
+				n := written[w].Load()
+				if n == 0 {
+					continue
+				}
+				key := fmt.Sprintf("w%d-%04d", w, rnd.Int63n(n))
+				if val, err := db.Get(key); err != nil || val != key {
+					errs <- fmt.Errorf("get %s = %q, %v", key, val, err)
+					return
+				}
+				db.PrefixIterator(fmt.Sprintf("w%d-", w))
+			}
+		}(int64(r))
+	}
+
+	var writes sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		writes.Add(1)
+		go func(w int) {
+			defer writes.Done()
+			for i := 0; i < perWriter; i++ {
+				key := fmt.Sprintf("w%d-%04d", w, i)
+				if err := db.Put(key, key); err != nil {
+					errs <- fmt.Errorf("put %s: %w", key, err)
+					return
+				}
+				written[w].Store(int64(i + 1))
+			}
+		}(w)
+	}
+	writes.Wait()
+	done.Store(true)
+	background.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	it := db.Iterator()
+	count := 0
+	for it.Next() {
+		count++
+	}
+	if count != writers*perWriter {
+		t.Fatalf("iterated %d keys, want %d", count, writers*perWriter)
+	}
+}
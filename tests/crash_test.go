@@ -0,0 +1,208 @@
+// Copyright 2025 The QuellDB Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be found in
+// the LICENSE file.
+
+package tests
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"testing"
+
+	"github.com/quellington/quelldb"
+	"github.com/quellington/quelldb/vfs"
+)
+
+// crashModel tracks what a database must hold after a crash. durable is
+// the value every key must at least have, "" for none; possible holds the
+// writes since then that may or may not have survived, the acknowledged
+// ones among them become durable with the next Flush.
+type crashModel struct {
+	durable  map[string]string
+	possible map[string][]crashWrite
+}
+
+type crashWrite struct {
+	value string
+	acked bool
+}
+
+func (m *crashModel) write(key, value string, err error, synced bool) {
+	if err == nil && synced {
+		m.durable[key] = value
+		m.possible[key] = nil
+		return
+	}
+	m.possible[key] = append(m.possible[key], crashWrite{value: value, acked: err == nil})
+}
+
+func (m *crashModel) flushed() {
+	for key, writes := range m.possible {
+		for i := len(writes) - 1; i >= 0; i-- {
+			if writes[i].acked {
+				m.durable[key] = writes[i].value
+				m.possible[key] = writes[i+1:]
+				break
+			}
+		}
+	}
+}
+
+// check compares the recovered database against the model, which then
+// starts over from what was recovered.
+func (m *crashModel) check(t *testing.T, db *quelldb.DB, keys []string) {
+	t.Helper()
+	for _, key := range keys {
+		got, _ := db.Get(key)
+		allowed := []string{m.durable[key]}
+		for _, w := range m.possible[key] {
+			allowed = append(allowed, w.value)
+		}
+		ok := false
+		for _, v := range allowed {
+			ok = ok || v == got
+		}
+		if !ok {
+			t.Fatalf("%s = %q after crash, want one of %q", key, got, allowed)
+		}
+		m.durable[key] = got
+		m.possible[key] = nil
+	}
+}
+
+// crashInjector picks the failure of a round: none, a single failed
+// operation, or a disk that stops responding.
+func crashInjector(rng *rand.Rand) (vfs.Injector, string) {
+	ops := []vfs.Op{vfs.OpCreate, vfs.OpOpenAppend, vfs.OpRename, vfs.OpRemove, vfs.OpSyncDir, vfs.OpWrite, vfs.OpSync}
+	switch rng.Intn(3) {
+	case 0:
+		return nil, "power loss"
+	case 1:
+		op, n := ops[rng.Intn(len(ops))], 1+rng.Intn(40)
+		return vfs.FailNth(op, n), fmt.Sprintf("failed %s #%d", op, n)
+	default:
+		n := 1 + rng.Intn(400)
+		return vfs.FailAfter(n), fmt.Sprintf("failing after %d operations", n)
+	}
+}
+
+// runCrashWorkload writes, flushes and compacts at random, crashes at a
+// random point and checks after every reopen that no acknowledged write
+// is lost.
+func runCrashWorkload(t *testing.T, seed int64, rounds int) {
+	rng := rand.New(rand.NewSource(seed))
+	mem := vfs.NewMem()
+	dir := "/db"
+
+	syncWrites := rng.Intn(2) == 0
+	open := func() (*quelldb.DB, *vfs.FaultFS) {
+		fault := vfs.NewFault(mem)
+		db, err := quelldb.Open(dir, &quelldb.Options{
+			FS:                  fault,
+			SyncWrites:          syncWrites,
+			CompactLimit:        2,
+			MaxManifestFileSize: 1 << 10,
+			Logger:              log.New(io.Discard, "", 0),
+		})
+		if err != nil {
+			t.Fatalf("seed %d: reopen after crash: %v\n%s", seed, err, mem)
+		}
+		return db, fault
+	}
+
+	keys := make([]string, 16)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%02d", i)
+	}
+	model := &crashModel{durable: make(map[string]string), possible: make(map[string][]crashWrite)}
+
+	db, fault := open()
+	for round := 0; round < rounds; round++ {
+		injector, failure := crashInjector(rng)
+		fault.SetInjector(injector)
+
+		for i := 0; i < 20+rng.Intn(60); i++ {
+			key := keys[rng.Intn(len(keys))]
+			value := fmt.Sprintf("v%d.%d", round, i)
+			switch n := rng.Intn(100); {
+			case n < 55:
+				model.write(key, value, db.Put(key, value), syncWrites)
+			case n < 70:
+				model.write(key, "", db.Delete(key), syncWrites)
+			case n < 80:
+				other := keys[rng.Intn(len(keys))]
+				batch := map[string]string{key: value, other: value}
+				err := db.PutBatch(batch)
+				for k, v := range batch {
+					model.write(k, v, err, syncWrites)
+				}
+			case n < 95:
+				if db.Flush() == nil {
+					model.flushed()
+				}
+			default:
+				db.Compact()
+			}
+		}
+
+		// the old instance is abandoned, like a process killed mid-way
+		crashRng := rng
+		if rng.Intn(2) == 0 {
+			crashRng = nil
+		}
+		mem = mem.CrashClone(crashRng)
+		db, fault = open()
+		t.Run(fmt.Sprintf("round%d", round), func(t *testing.T) {
+			t.Logf("seed %d, %s, sync writes %v", seed, failure, syncWrites)
+			model.check(t, db, keys)
+		})
+	}
+	db.Close()
+}
+
+func TestCrashRecovery(t *testing.T) {
+	seeds := 60
+	if testing.Short() {
+		seeds = 10
+	}
+	for seed := int64(1); seed <= int64(seeds); seed++ {
+		t.Run(fmt.Sprintf("seed%d", seed), func(t *testing.T) {
+			runCrashWorkload(t, seed, 5)
+		})
+	}
+}
+
+func TestFaultFS(t *testing.T) {
+	mem := vfs.NewMem()
+	fault := vfs.NewFault(mem)
+
+	f, err := fault.Create("/synced")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("durable"))
+	f.Sync()
+	fault.SetInjector(vfs.FailNth(vfs.OpWrite, 1))
+	if n, err := f.Write([]byte("torn-write")); err == nil || n != 5 {
+		t.Fatalf("expected a torn write of 5 bytes, got %d (%v)", n, err)
+	}
+	f.Write([]byte("|unsynced"))
+	f.Close()
+	fault.SetInjector(nil)
+	fault.Sync("/")
+
+	if data, _ := vfs.ReadFile(mem, "/synced"); string(data) != "durabletorn-|unsynced" {
+		t.Fatalf("content before crash = %q", data)
+	}
+	vfs.WriteFile(mem, "/unsynced-entry", []byte("lost"))
+
+	crashed := mem.CrashClone(nil)
+	if data, _ := vfs.ReadFile(crashed, "/synced"); string(data) != "durable" {
+		t.Fatalf("content after crash = %q", data)
+	}
+	if _, err := crashed.Stat("/unsynced-entry"); err == nil {
+		t.Fatal("entry never synced survived the crash")
+	}
+}
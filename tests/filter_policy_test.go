@@ -0,0 +1,121 @@
+// Copyright 2025 The QuellDB Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be found in
+// the LICENSE file.
+
+package tests
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/quellington/quelldb"
+	"github.com/quellington/quelldb/base"
+	"github.com/quellington/quelldb/vfs"
+)
+
+// acceptAll is a filter policy only this test knows.
+type acceptAll struct{}
+
+func (acceptAll) Name() string                       { return "test.AcceptAll" }
+func (acceptAll) NewWriter() base.FilterWriter       { return &acceptAllWriter{} }
+func (acceptAll) MayContain(_ []byte, _ string) bool { return true }
+
+type acceptAllWriter struct{}
+
+func (*acceptAllWriter) AddKey(string)  {}
+func (*acceptAllWriter) Finish() []byte { return nil }
+
+// writeFilter writes n keys with the filter policy and returns the loaded
+// filter and its size.
+func writeFilter(t *testing.T, n int, opts base.WriterOptions) (*base.Filter, int) {
+	fs := vfs.NewMem()
+	entries := make(map[string]base.Entry, n)
+	for i := 0; i < n; i++ {
+		entries[fmt.Sprintf("key%07d", i)] = base.Entry{Kind: base.KindValue, Value: "v"}
+	}
+	if _, _, err := base.WriteSSStorageEntriesFS(fs, "sss-00001.qldb", entries, nil, opts); err != nil {
+		t.Fatal(err)
+	}
+	table, err := base.OpenTableFS(fs, "sss-00001.qldb", nil, base.TableOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.Close()
+	filter, _, err := table.LoadFilters(nil)
+	if err != nil || filter == nil {
+		t.Fatalf("no filter: %v", err)
+	}
+	for k := range entries {
+		if !filter.MayContain(k) {
+			t.Fatalf("%s filter rejects %s", filter.PolicyName(), k)
+		}
+	}
+	return filter, filter.Size()
+}
+
+func TestBinaryFuseFilter(t *testing.T) {
+	for _, n := range []int{1, 2, 3, 100, 10000} {
+		writeFilter(t, n, base.WriterOptions{FilterPolicy: base.BinaryFuseFilterPolicy{}})
+	}
+
+	fuse, fuseSize := writeFilter(t, 100000, base.WriterOptions{FilterPolicy: base.BinaryFuseFilterPolicy{}})
+	if fuse.PolicyName() != (base.BinaryFuseFilterPolicy{}).Name() {
+		t.Fatalf("filter built by %q", fuse.PolicyName())
+	}
+	fuseRate := filterFalsePositives(fuse)
+	if fuseRate > 0.006 {
+		t.Fatalf("false positive rate %.4f", fuseRate)
+	}
+
+	// a blocked Bloom filter needs about 13.5 bits per key for the same
+	// false positive rate
+	bloom, bloomSize := writeFilter(t, 100000, base.WriterOptions{BloomBitsPerKey: 13.5})
+	if bloomRate := filterFalsePositives(bloom); fuseRate > 1.25*bloomRate {
+		t.Fatalf("false positive rate %.4f, bloom filter %.4f", fuseRate, bloomRate)
+	}
+	if float64(fuseSize) > 0.8*float64(bloomSize) {
+		t.Fatalf("binary fuse filter of %d bytes, bloom filter of %d bytes", fuseSize, bloomSize)
+	}
+}
+
+// filterFalsePositives returns the share of absent keys the filter lets through.
+func filterFalsePositives(filter *base.Filter) float64 {
+	positives := 0
+	for i := 0; i < 100000; i++ {
+		if filter.MayContain(fmt.Sprintf("absent%07d", i)) {
+			positives++
+		}
+	}
+	return float64(positives) / 100000
+}
+
+func TestFilterPolicies(t *testing.T) {
+	dir := t.TempDir()
+	policies := []base.FilterPolicy{nil, base.BinaryFuseFilterPolicy{}, acceptAll{}, nil}
+
+	// every reopen writes a file with another policy
+	for i, policy := range policies {
+		db, err := quelldb.Open(dir, &quelldb.Options{FilterPolicy: policy})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < 100; j++ {
+			db.Put(fmt.Sprintf("key%d-%03d", i, j), fmt.Sprintf("value%d", i))
+		}
+		db.Flush()
+
+		// files built by an unknown policy are read without their filter
+		for k := 0; k <= i; k++ {
+			for j := 0; j < 100; j += 7 {
+				key := fmt.Sprintf("key%d-%03d", k, j)
+				if val, err := db.Get(key); err != nil || val != fmt.Sprintf("value%d", k) {
+					t.Fatalf("round %d: %s = %q, %v", i, key, val, err)
+				}
+			}
+		}
+		if _, err := db.Get("absent"); err == nil {
+			t.Fatalf("round %d: absent key found", i)
+		}
+		db.Close()
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2025 The QuellDB Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be found in
+// the LICENSE file.
+
+package tests
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/quellington/quelldb"
+)
+
+func TestObsoleteFileCollection(t *testing.T) {
+	dir := t.TempDir()
+	var logs bytes.Buffer
+	opts := &quelldb.Options{Logger: log.New(&logs, "", 0)}
+
+	db, err := quelldb.Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put("a", "1")
+	db.Flush()
+	db.Put("b", "2")
+	db.Flush()
+	db.Close()
+
+	// leftovers of a crashed flush or compaction
+	orphans := []string{"sss-99999.qldb", "sss-99999.qldb.filter", "00000.log", "CURRENT.tmp", "MANIFEST-99999.qmf.tmp"}
+	for _, name := range append(orphans, "notes.txt", "notes.tmp") {
+		os.WriteFile(filepath.Join(dir, name), []byte("junk"), 0644)
+	}
+
+	db, err = quelldb.Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, name := range orphans {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Fatalf("%s was not collected", name)
+		}
+		if !strings.Contains(logs.String(), name) {
+			t.Fatalf("removal of %s not logged:\n%s", name, logs.String())
+		}
+	}
+	for _, name := range []string{"notes.txt", "notes.tmp"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Fatalf("foreign file %s was removed", name)
+		}
+	}
+
+	// compaction inputs go away once the manifest drops them
+	if err := db.CompactRange("", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	ssss, _ := quelldb.LoadManifest(dir, nil)
+	matches, _ := filepath.Glob(filepath.Join(dir, "sss-*.qldb"))
+	if len(ssss) != 1 || len(matches) != 1 || filepath.Base(matches[0]) != ssss[0].Filename {
+		t.Fatalf("live files %v, on disk %v", ssss, matches)
+	}
+	for k, want := range map[string]string{"a": "1", "b": "2"} {
+		if val, _ := db.Get(k); val != want {
+			t.Fatalf("%s = %q, want %q", k, val, want)
+		}
+	}
+}
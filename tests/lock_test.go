@@ -0,0 +1,42 @@
+// Copyright 2025 The QuellDB Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be found in
+// the LICENSE file.
+
+package tests
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/quellington/quelldb"
+)
+
+func TestDirectoryLock(t *testing.T) {
+	dir := t.TempDir()
+	db, err := quelldb.Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put("a", "1")
+	db.Flush()
+
+	if _, err := quelldb.Open(dir, nil); !errors.Is(err, quelldb.ErrLocked) {
+		t.Fatalf("expected ErrLocked, got %v", err)
+	}
+
+	reader, err := quelldb.Open(dir, &quelldb.Options{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("read-only open should skip the lock: %v", err)
+	}
+	if val, _ := reader.Get("a"); val != "1" {
+		t.Fatalf("a = %q", val)
+	}
+	reader.Close()
+
+	db.Close()
+	db, err = quelldb.Open(dir, nil)
+	if err != nil {
+		t.Fatalf("lock not released by Close: %v", err)
+	}
+	db.Close()
+}
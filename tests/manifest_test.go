@@ -0,0 +1,344 @@
+// Copyright 2025 The QuellDB Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be found in
+// the LICENSE file.
+
+package tests
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/quellington/quelldb"
+	"github.com/quellington/quelldb/base"
+	"github.com/quellington/quelldb/constants"
+	"github.com/quellington/quelldb/utils"
+)
+
+func manifestFiles(t *testing.T, dir string) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), "MANIFEST-") {
+			names = append(names, e.Name())
+		}
+	}
+	return names
+}
+
+func TestManifestLog(t *testing.T) {
+	dir := t.TempDir()
+	opts := &quelldb.Options{CompactLimit: 100}
+	db, err := quelldb.Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sizes []int64
+	for i := 0; i < 3; i++ {
+		db.Put("key"+strconv.Itoa(i), "val")
+		if err := db.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		names := manifestFiles(t, dir)
+		if len(names) != 1 {
+			t.Fatalf("expected one manifest, got %v", names)
+		}
+		stat, _ := os.Stat(filepath.Join(dir, names[0]))
+		sizes = append(sizes, stat.Size())
+	}
+	if !(sizes[0] < sizes[1] && sizes[1] < sizes[2]) {
+		t.Fatalf("manifest should grow by appended edits, sizes %v", sizes)
+	}
+	db.Put("unflushed", "val")
+	db.Close()
+
+	// reopen with a tiny limit, the next edit rolls over to a new manifest
+	opts.MaxManifestFileSize = 1
+	db, err = quelldb.Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	before := manifestFiles(t, dir)
+	db.Flush()
+	after := manifestFiles(t, dir)
+	if len(after) != 2 || after[0] != before[0] {
+		t.Fatalf("expected rollover keeping the previous manifest, before %v after %v", before, after)
+	}
+
+	for _, k := range []string{"key0", "key1", "key2", "unflushed"} {
+		if val, err := db.Get(k); err != nil || val != "val" {
+			t.Fatalf("%s = %q, %v", k, val, err)
+		}
+	}
+
+	ssss, err := quelldb.LoadManifest(dir, nil)
+	if err != nil || len(ssss) != 4 {
+		t.Fatalf("manifest files = %v, %v", ssss, err)
+	}
+}
+
+func TestManifestFallback(t *testing.T) {
+	dir := t.TempDir()
+	db, err := quelldb.Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put("a", "1")
+	db.Flush()
+	db.Put("b", "2")
+	db.Flush()
+	db.Close()
+
+	// a crash while CURRENT was rewritten must not make the store unreadable
+	if err := os.WriteFile(filepath.Join(dir, "CURRENT"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	db, err = quelldb.Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, want := range map[string]string{"a": "1", "b": "2"} {
+		if val, _ := db.Get(k); val != want {
+			t.Fatalf("%s = %q, want %q", k, val, want)
+		}
+	}
+	db.Put("c", "3")
+	db.Flush()
+	db.Close()
+
+	current, err := os.ReadFile(filepath.Join(dir, "CURRENT"))
+	if err != nil || !strings.HasPrefix(string(current), "MANIFEST-") {
+		t.Fatalf("CURRENT not reinstalled: %q, %v", current, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "CURRENT.tmp")); !os.IsNotExist(err) {
+		t.Fatal("temporary CURRENT left behind")
+	}
+
+	// flip a byte inside the first record of the current manifest
+	path := filepath.Join(dir, string(current))
+	data, _ := os.ReadFile(path)
+	data[14] ^= 0xff
+	os.WriteFile(path, append(data, data[4:]...), 0644)
+
+	db, err = quelldb.Open(dir, nil)
+	if err != nil {
+		t.Fatalf("expected fallback to the previous manifest: %v", err)
+	}
+	defer db.Close()
+	if val, _ := db.Get("a"); val != "1" {
+		t.Fatalf("a = %q after fallback", val)
+	}
+}
+
+func TestSSSMetaStats(t *testing.T) {
+	dir := t.TempDir()
+	db, err := quelldb.Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Put("a", "1")
+	db.Put("b", "2")
+	db.Delete("c")
+	db.Flush()
+	db.Put("d", "4")
+	db.Flush()
+
+	ssss, err := quelldb.LoadManifest(dir, nil)
+	if err != nil || len(ssss) != 2 {
+		t.Fatalf("manifest files = %v, %v", ssss, err)
+	}
+	first := ssss[0]
+	stat, err := os.Stat(filepath.Join(dir, first.Filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.FileSize != stat.Size() || first.EntryCount != 3 || first.TombstoneCount != 1 {
+		t.Fatalf("unexpected file stats: %+v", first)
+	}
+	if first.SmallestSeq != 1 || first.LargestSeq != 3 || ssss[1].SmallestSeq != 4 {
+		t.Fatalf("unexpected sequence range: %+v %+v", first, ssss[1])
+	}
+	if first.Checksum == 0 || first.CreatedAt.IsZero() {
+		t.Fatalf("missing checksum or creation time: %+v", first)
+	}
+
+	if err := db.CompactRange("", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	ssss, _ = quelldb.LoadManifest(dir, nil)
+	if len(ssss) != 1 || ssss[0].Level != 6 || ssss[0].SmallestSeq != 1 || ssss[0].LargestSeq != 4 || ssss[0].TombstoneCount != 0 {
+		t.Fatalf("unexpected compaction output: %+v", ssss)
+	}
+}
+
+func TestManifestFallbackAdvanced(t *testing.T) {
+	dir := t.TempDir()
+	opts := &quelldb.Options{CompactLimit: 2, MaxManifestFileSize: 1}
+	db, err := quelldb.Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put("a", "1")
+	db.Flush()
+	db.Put("b", "2")
+	db.Flush()
+
+	// every edit starts a new manifest, the previous one is rewritten
+	// instead of keeping the inputs of the compaction on disk
+	inputs := sssFiles(t, dir)
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range inputs {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			t.Fatalf("compaction input %s kept for the fallback manifest", name)
+		}
+	}
+	if files := sssFiles(t, dir); len(files) != 1 {
+		t.Fatalf("expected only the compaction output on disk, got %v", files)
+	}
+	db.Close()
+
+	current, _ := os.ReadFile(filepath.Join(dir, "CURRENT"))
+	path := filepath.Join(dir, string(current))
+	os.WriteFile(path, []byte("not a manifest"), 0644)
+
+	db, err = quelldb.Open(dir, opts)
+	if err != nil {
+		t.Fatalf("expected fallback to the previous manifest: %v", err)
+	}
+	for k, want := range map[string]string{"a": "1", "b": "2"} {
+		if val, err := db.Get(k); err != nil || val != want {
+			t.Fatalf("%s = %q, %v after fallback", k, val, err)
+		}
+	}
+	db.Close()
+
+	// a fallback whose files are gone is refused
+	current, _ = os.ReadFile(filepath.Join(dir, "CURRENT"))
+	os.WriteFile(filepath.Join(dir, string(current)), []byte("not a manifest"), 0644)
+	for _, name := range sssFiles(t, dir) {
+		os.Remove(filepath.Join(dir, name))
+	}
+	if _, err := quelldb.Open(dir, opts); err == nil || !strings.Contains(err.Error(), "missing SSS file") {
+		t.Fatalf("expected a fallback with missing files to be refused, got %v", err)
+	}
+}
+
+func sssFiles(t *testing.T, dir string) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), "sss-") && strings.HasSuffix(e.Name(), ".qldb") {
+			names = append(names, e.Name())
+		}
+	}
+	return names
+}
+
+// snapshotManifest encodes files the way SaveManifest wrote them before the
+// manifest became a log: snappy of [count] and the name and key range of
+// every file, each string as [len][bytes]. Version 2 snapshots start with
+// a version marker and record the level of every file.
+func snapshotManifest(t *testing.T, ssss []quelldb.SSSMeta, version int32, key []byte) []byte {
+	buf := new(bytes.Buffer)
+	if version > 0 {
+		binary.Write(buf, binary.LittleEndian, int32(constants.MANIFEST_VERSION_MARKER))
+		binary.Write(buf, binary.LittleEndian, version)
+	}
+	binary.Write(buf, binary.LittleEndian, int32(len(ssss)))
+	for _, meta := range ssss {
+		for _, s := range []string{meta.Filename, meta.MinKey, meta.MaxKey} {
+			binary.Write(buf, binary.LittleEndian, int32(len(s)))
+			buf.WriteString(s)
+		}
+		if version >= 2 {
+			binary.Write(buf, binary.LittleEndian, int32(meta.Level))
+		}
+	}
+	data := snappy.Encode(nil, buf.Bytes())
+	if key != nil {
+		var err error
+		if data, err = utils.Encrypt(data, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return data
+}
+
+func TestManifestSnapshotFormat(t *testing.T) {
+	ssss := []quelldb.SSSMeta{
+		{Filename: "sss-00001.qldb", MinKey: "a", MaxKey: "m", Level: 1},
+		{Filename: "sss-00002.qldb", MinKey: "n", MaxKey: "z"},
+	}
+	for _, key := range [][]byte{nil, []byte("thisis32byteslongthisis32byteslo")} {
+		for _, version := range []int32{0, 2} {
+			dir := t.TempDir()
+			data := snapshotManifest(t, ssss, version, key)
+			os.WriteFile(filepath.Join(dir, "MANIFEST-00001.qmf"), data, 0644)
+			os.WriteFile(filepath.Join(dir, "CURRENT"), []byte("MANIFEST-00001.qmf"), 0644)
+
+			got, err := quelldb.LoadManifest(dir, key)
+			if err != nil || len(got) != len(ssss) {
+				t.Fatalf("version %d: manifest files = %+v, %v", version, got, err)
+			}
+			for i, meta := range got {
+				// snapshots without a version keep every file in level 0
+				level := ssss[i].Level
+				if version < 2 {
+					level = 0
+				}
+				if meta.Filename != ssss[i].Filename || meta.MinKey != ssss[i].MinKey ||
+					meta.MaxKey != ssss[i].MaxKey || meta.Level != level {
+					t.Fatalf("version %d: file %d = %+v, want %+v at level %d", version, i, meta, ssss[i], level)
+				}
+			}
+		}
+	}
+
+	// a store left by the snapshot format opens, and its next edit starts
+	// a manifest log
+	dir := t.TempDir()
+	for i, meta := range ssss {
+		kv := map[string]string{meta.MinKey: strconv.Itoa(i), meta.MaxKey: strconv.Itoa(i)}
+		if _, _, err := base.WriteSSStorage(filepath.Join(dir, meta.Filename), kv, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.WriteFile(filepath.Join(dir, "MANIFEST-00003.qmf"), snapshotManifest(t, ssss, 0, nil), 0644)
+	os.WriteFile(filepath.Join(dir, "CURRENT"), []byte("MANIFEST-00003.qmf"), 0644)
+	db, err := quelldb.Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i, meta := range ssss {
+		for _, k := range []string{meta.MinKey, meta.MaxKey} {
+			if val, err := db.Get(k); err != nil || val != strconv.Itoa(i) {
+				t.Fatalf("%s = %q, %v", k, val, err)
+			}
+		}
+	}
+	db.Put("b", "new")
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := quelldb.LoadManifest(dir, nil); err != nil || len(got) != 3 {
+		t.Fatalf("manifest files after a flush = %+v, %v", got, err)
+	}
+}
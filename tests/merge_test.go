@@ -0,0 +1,126 @@
+// Copyright 2025 The QuellDB Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be found in
+// the LICENSE file.
+
+package tests
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/quellington/quelldb"
+	"github.com/quellington/quelldb/vfs"
+)
+
+type counterOperator struct{}
+
+func (counterOperator) Name() string { return "counter" }
+
+func (counterOperator) FullMerge(key, existing string, exists bool, operands []string) (string, error) {
+	total := 0
+	if exists {
+		n, err := strconv.Atoi(existing)
+		if err != nil {
+			return "", err
+		}
+		total = n
+	}
+	for _, op := range operands {
+		n, err := strconv.Atoi(op)
+		if err != nil {
+			return "", err
+		}
+		total += n
+	}
+	return strconv.Itoa(total), nil
+}
+
+func (counterOperator) PartialMerge(key, left, right string) (string, bool) {
+	l, err1 := strconv.Atoi(left)
+	r, err2 := strconv.Atoi(right)
+	if err1 != nil || err2 != nil {
+		return "", false
+	}
+	return strconv.Itoa(l + r), true
+}
+
+func TestMergeOperator(t *testing.T) {
+	dir := t.TempDir()
+	opts := &quelldb.Options{CompactLimit: 2, MergeOperator: counterOperator{}}
+	db, err := quelldb.Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.Put("hits", "10")
+	db.Flush()
+	db.Merge("hits", "1")
+	db.Merge("hits", "2")
+	db.Merge("misses", "5")
+
+	if val, _ := db.Get("hits"); val != "13" {
+		t.Fatalf("hits = %q, want 13", val)
+	}
+
+	db.Flush()
+	db.Merge("hits", "7")
+	db.Delete("misses")
+	db.Merge("misses", "1")
+
+	it := db.Iterator()
+	got := map[string]string{}
+	for it.Next() {
+		got[it.Key()] = it.Value()
+	}
+	if got["hits"] != "20" || got["misses"] != "1" {
+		t.Fatalf("iterator = %v", got)
+	}
+	db.Close()
+
+	// unflushed operands are replayed from the WAL
+	db, err = quelldb.Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.Flush()
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if val, _ := db.Get("hits"); val != "20" {
+		t.Fatalf("hits after compaction = %q, want 20", val)
+	}
+	if val, _ := db.Get("misses"); val != "1" {
+		t.Fatalf("misses after compaction = %q, want 1", val)
+	}
+}
+
+func TestMergeWALFailure(t *testing.T) {
+	fault := vfs.NewFault(vfs.NewMem())
+	db, err := quelldb.Open("db", &quelldb.Options{FS: fault, MergeOperator: counterOperator{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.Put("hits", "10")
+
+	// an operand the WAL does not hold must not be visible
+	fault.SetInjector(vfs.FailNth(vfs.OpWrite, 1))
+	if err := db.Merge("hits", "1"); err == nil {
+		t.Fatal("expected Merge to fail with the WAL write")
+	}
+	fault.SetInjector(nil)
+	if val, _ := db.Get("hits"); val != "10" {
+		t.Fatalf("hits = %q after a failed merge, want 10", val)
+	}
+
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Merge("hits", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if val, _ := db.Get("hits"); val != "12" {
+		t.Fatalf("hits = %q, want 12", val)
+	}
+}
@@ -36,7 +36,7 @@ func LoadUser(db *quelldb.DB, id string) (*User, error) {
 }
 
 func TestMain(t *testing.T) {
-	store, err := quelldb.Open("data", &quelldb.Options{
+	store, err := quelldb.Open(t.TempDir(), &quelldb.Options{
 		CompactLimit:  10,
 		BoomHashCount: 4,
 	})
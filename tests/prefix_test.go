@@ -0,0 +1,158 @@
+// Copyright 2025 The QuellDB Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be found in
+// the LICENSE file.
+
+package tests
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/quellington/quelldb"
+	"github.com/quellington/quelldb/base"
+	"github.com/quellington/quelldb/vfs"
+)
+
+// readCounter counts the reads of every file.
+type readCounter struct {
+	mu    sync.Mutex
+	reads map[string]int
+}
+
+func (c *readCounter) inject(op vfs.Op, name string) error {
+	if op == vfs.OpRead {
+		c.mu.Lock()
+		c.reads[name]++
+		c.mu.Unlock()
+	}
+	return nil
+}
+
+func (c *readCounter) reset() map[string]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	reads := c.reads
+	c.reads = make(map[string]int)
+	return reads
+}
+
+func TestPrefixExtractors(t *testing.T) {
+	fixed := base.FixedPrefix(4)
+	if p, ok := fixed.Prefix("user42"); !ok || p != "user" {
+		t.Fatalf("fixed prefix %q, %v", p, ok)
+	}
+	if _, ok := fixed.Prefix("abc"); ok {
+		t.Fatal("a key shorter than the prefix has one")
+	}
+	delimited := base.DelimitedPrefix(":")
+	if p, ok := delimited.Prefix("user:42:name"); !ok || p != "user:" {
+		t.Fatalf("delimited prefix %q, %v", p, ok)
+	}
+	if _, ok := delimited.Prefix("user"); ok {
+		t.Fatal("a key without the delimiter has a prefix")
+	}
+}
+
+// prefixReads fills a database with one file per key prefix, all spanning
+// the same key range, and returns the SSS files read by PrefixIterator("user:").
+func prefixReads(t *testing.T, extractor base.PrefixExtractor) []string {
+	counter := &readCounter{reads: make(map[string]int)}
+	fs := vfs.NewFault(vfs.NewMem())
+	fs.SetInjector(counter.inject)
+	db, err := quelldb.Open("db", &quelldb.Options{FS: fs, PrefixExtractor: extractor})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, prefix := range []string{"order:", "user:", "session:"} {
+		db.Put("a:first", "a")
+		for i := 0; i < 10; i++ {
+			db.Put(fmt.Sprintf("%s%d", prefix, i), prefix)
+		}
+		db.Put("z:last", "z")
+		db.Flush()
+	}
+
+	// the first iterator opens the files and loads their filters
+	db.PrefixIterator("user:")
+	counter.reset()
+
+	it := db.PrefixIterator("user:")
+	n := 0
+	for it.Next() {
+		if !strings.HasPrefix(it.Key(), "user:") || it.Value() != "user:" {
+			t.Fatalf("%s = %s", it.Key(), it.Value())
+		}
+		n++
+	}
+	if n != 10 {
+		t.Fatalf("iterated %d keys, expected 10", n)
+	}
+
+	var read []string
+	for name := range counter.reset() {
+		if strings.HasSuffix(name, ".qldb") {
+			read = append(read, name)
+		}
+	}
+	return read
+}
+
+func TestPrefixFilter(t *testing.T) {
+	if read := prefixReads(t, nil); len(read) != 3 {
+		t.Fatalf("without a prefix filter expected all 3 files read, read %v", read)
+	}
+	if read := prefixReads(t, base.DelimitedPrefix(":")); len(read) != 1 {
+		t.Fatalf("expected only the file holding the prefix read, read %v", read)
+	}
+}
+
+func TestPrefixIteratorBlocks(t *testing.T) {
+	counter := &readCounter{reads: make(map[string]int)}
+	fs := vfs.NewFault(vfs.NewMem())
+	fs.SetInjector(counter.inject)
+	db, err := quelldb.Open("db", &quelldb.Options{FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// a single file of many blocks
+	for _, prefix := range []string{"a", "m", "z"} {
+		for i := 0; i < 2000; i++ {
+			db.Put(fmt.Sprintf("%s:%05d", prefix, i), strings.Repeat("v", 20))
+		}
+	}
+	db.Flush()
+
+	counter.reset()
+	it := db.Iterator()
+	for it.Next() {
+	}
+	all := counter.reset()
+
+	it = db.PrefixIterator("m:")
+	n := 0
+	for it.Next() {
+		n++
+	}
+	if n != 2000 {
+		t.Fatalf("iterated %d keys, expected 2000", n)
+	}
+	read := 0
+	for name, reads := range counter.reset() {
+		if !strings.HasSuffix(name, ".qldb") {
+			continue
+		}
+		read++
+		if reads*2 > all[name] {
+			t.Fatalf("%s: %d reads for a third of the keys, %d for all", name, reads, all[name])
+		}
+	}
+	if read != 1 {
+		t.Fatalf("expected the file to be read, read %d files", read)
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2025 The QuellDB Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be found in
+// the LICENSE file.
+
+package tests
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/quellington/quelldb"
+)
+
+// dirState lists the names, sizes and modification times of a directory.
+func dirState(t *testing.T, dir string) map[string]string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := make(map[string]string)
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			t.Fatal(err)
+		}
+		state[e.Name()] = fmt.Sprintf("%v/%d", info.ModTime(), info.Size())
+	}
+	return state
+}
+
+func TestReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	db, err := quelldb.Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put("flushed", "1")
+	db.Flush()
+	db.Put("unflushed", "2")
+	db.Close()
+
+	before := dirState(t, dir)
+	db, err = quelldb.Open(dir, &quelldb.Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, want := range map[string]string{"flushed": "1", "unflushed": "2"} {
+		if val, _ := db.Get(k); val != want {
+			t.Fatalf("%s = %q, want %q", k, val, want)
+		}
+	}
+
+	mutations := map[string]func() error{
+		"Put":          func() error { return db.Put("k", "v") },
+		"PutBatch":     func() error { return db.PutBatch(map[string]string{"k": "v"}) },
+		"PutTTL":       func() error { return db.PutTTL("k", "v", time.Minute) },
+		"Delete":       func() error { return db.Delete("flushed") },
+		"Merge":        func() error { return db.Merge("k", "v") },
+		"Flush":        db.Flush,
+		"Compact":      db.Compact,
+		"CompactRange": func() error { return db.CompactRange("", "", nil) },
+	}
+	for name, fn := range mutations {
+		if err := fn(); !errors.Is(err, quelldb.ErrReadOnly) {
+			t.Fatalf("%s: expected ErrReadOnly, got %v", name, err)
+		}
+	}
+	db.Close()
+
+	after := dirState(t, dir)
+	if len(before) != len(after) {
+		t.Fatalf("directory changed: %v -> %v", before, after)
+	}
+	for name, state := range before {
+		if after[name] != state {
+			t.Fatalf("%s changed by a read-only open", name)
+		}
+	}
+
+	missing := filepath.Join(dir, "missing")
+	if _, err := quelldb.Open(missing, &quelldb.Options{ReadOnly: true}); err == nil {
+		t.Fatal("expected error for a missing directory")
+	}
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Fatal("read-only open created the directory")
+	}
+}
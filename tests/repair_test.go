@@ -0,0 +1,184 @@
+// Copyright 2025 The QuellDB Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be found in
+// the LICENSE file.
+
+package tests
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/quellington/quelldb"
+	"github.com/quellington/quelldb/constants"
+)
+
+func TestRepair(t *testing.T) {
+	dir := t.TempDir()
+	opts := &quelldb.Options{Logger: log.New(io.Discard, "", 0)}
+	db, err := quelldb.Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put("a", "1")
+	db.Put("b", "2")
+	db.Flush()
+	db.Put("b", "3")
+	db.Delete("a")
+	db.Flush()
+	db.Put("c", "4")
+	db.Close()
+
+	// lose every manifest and add a table that cannot be read
+	os.Remove(filepath.Join(dir, "CURRENT"))
+	for _, name := range manifestFiles(t, dir) {
+		os.Remove(filepath.Join(dir, name))
+	}
+	os.WriteFile(filepath.Join(dir, "sss-00900.qldb"), []byte("not a table"), 0644)
+
+	if _, err := quelldb.Open(dir, opts); err == nil {
+		t.Fatal("expected Open to fail without a manifest")
+	}
+	if err := quelldb.Repair(dir, opts); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "lost", "sss-00900.qldb")); err != nil {
+		t.Fatal("unreadable table not moved to lost/")
+	}
+
+	db, err = quelldb.Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Get("a"); err == nil {
+		t.Fatal("a should stay deleted")
+	}
+	for k, want := range map[string]string{"b": "3", "c": "4"} {
+		if val, _ := db.Get(k); val != want {
+			t.Fatalf("%s = %q, want %q", k, val, want)
+		}
+	}
+
+	ssss, _ := quelldb.LoadManifest(dir, nil)
+	if len(ssss) != 3 {
+		t.Fatalf("expected the two tables and the replayed WAL, got %+v", ssss)
+	}
+	for i := 1; i < len(ssss); i++ {
+		if ssss[i].SmallestSeq <= ssss[i-1].LargestSeq {
+			t.Fatalf("recovered sequence ranges overlap: %+v", ssss)
+		}
+	}
+}
+
+// flushingFilter flushes a write while the compaction it filters runs.
+type flushingFilter struct {
+	once  sync.Once
+	flush func()
+}
+
+func (*flushingFilter) Name() string { return "flushing" }
+
+func (f *flushingFilter) Filter(ctx quelldb.CompactionFilterContext, key, value string) (quelldb.CompactionDecision, string) {
+	f.once.Do(f.flush)
+	return quelldb.CompactionKeep, ""
+}
+
+func TestRepairFlushDuringCompaction(t *testing.T) {
+	dir := t.TempDir()
+	var db *quelldb.DB
+	filter := &flushingFilter{flush: func() {
+		db.Put("k", "new")
+		if err := db.Flush(); err != nil {
+			t.Error(err)
+		}
+	}}
+	opts := &quelldb.Options{CompactLimit: 2, CompactionFilter: filter, Logger: log.New(io.Discard, "", 0)}
+	db, err := quelldb.Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put("k", "old")
+	db.Flush()
+	db.Put("j", "1")
+	db.Flush()
+
+	// the flush gets a lower file number than the compaction output,
+	// yet holds the newer write
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if val, _ := db.Get("k"); val != "new" {
+		t.Fatalf("k = %q before repair, want new", val)
+	}
+	db.Close()
+
+	os.Remove(filepath.Join(dir, "CURRENT"))
+	for _, name := range manifestFiles(t, dir) {
+		os.Remove(filepath.Join(dir, name))
+	}
+	if err := quelldb.Repair(dir, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = quelldb.Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if val, _ := db.Get("k"); val != "new" {
+		t.Fatalf("k = %q after repair, want new", val)
+	}
+	if val, _ := db.Get("j"); val != "1" {
+		t.Fatalf("j = %q after repair, want 1", val)
+	}
+}
+
+func TestRepairBelowBottommost(t *testing.T) {
+	dir := t.TempDir()
+	opts := &quelldb.Options{Logger: log.New(io.Discard, "", 0)}
+	db, err := quelldb.Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put("k", "old")
+	db.Flush()
+	old, err := os.ReadFile(filepath.Join(dir, sssFiles(t, dir)[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put("k", "new")
+	db.Flush()
+	if err := db.CompactRange("", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// an older copy of k the manifest does not know, overlapping the
+	// newer write on the bottommost level
+	os.WriteFile(filepath.Join(dir, "sss-99999.qldb"), old, 0644)
+	if err := quelldb.Repair(dir, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	ssss, err := quelldb.LoadManifest(dir, nil)
+	if err != nil || len(ssss) != 2 {
+		t.Fatalf("manifest files = %v, %v", ssss, err)
+	}
+	for _, f := range ssss {
+		if f.Level != constants.NUM_LEVELS-1 {
+			t.Fatalf("%s recovered on level %d, want %d", f.Filename, f.Level, constants.NUM_LEVELS-1)
+		}
+	}
+	db, err = quelldb.Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if val, _ := db.Get("k"); val != "new" {
+		t.Fatalf("k = %q after repair, want new", val)
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2025 The QuellDB Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be found in
+// the LICENSE file.
+
+package tests
+
+import (
+	"testing"
+
+	"github.com/quellington/quelldb"
+)
+
+func TestRowCache(t *testing.T) {
+	db, err := quelldb.Open(t.TempDir(), &quelldb.Options{RowCacheBytes: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Put("flag:dark-mode", "on")
+	db.Put("flag:beta", "off")
+	db.Flush()
+
+	for i := 0; i < 100; i++ {
+		if val, err := db.Get("flag:dark-mode"); err != nil || val != "on" {
+			t.Fatalf("flag:dark-mode = %q, %v", val, err)
+		}
+	}
+	if stats := db.RowCacheStats(); stats.Hits < 99 || stats.Entries != 1 {
+		t.Fatalf("expected the flag to be served from the row cache, got %+v", stats)
+	}
+
+	// a write is seen at once, and still after it is flushed
+	db.Put("flag:dark-mode", "off")
+	db.Delete("flag:beta")
+	db.Get("flag:beta")
+	for i := 0; i < 2; i++ {
+		if val, _ := db.Get("flag:dark-mode"); val != "off" {
+			t.Fatalf("flag:dark-mode = %q after the write", val)
+		}
+		if _, err := db.Get("flag:beta"); err == nil {
+			t.Fatal("flag:beta readable after the delete")
+		}
+		db.Flush()
+	}
+	if stats := db.RowCacheStats(); stats.Invalidations == 0 {
+		t.Fatalf("expected the flush to invalidate rows, got %+v", stats)
+	}
+
+	// without RowCacheBytes nothing is cached
+	plain, err := quelldb.Open(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	plain.Put("k", "v")
+	plain.Flush()
+	plain.Get("k")
+	if stats := plain.RowCacheStats(); stats != (quelldb.RowCacheStats{}) {
+		t.Fatalf("row cache used without RowCacheBytes: %+v", stats)
+	}
+}
+
+func TestRowCacheCompaction(t *testing.T) {
+	db, err := quelldb.Open(t.TempDir(), &quelldb.Options{
+		RowCacheBytes:    1 << 20,
+		CompactLimit:     2,
+		CompactionFilter: sessionPurger{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Put("session:1", "token")
+	db.Put("user:1", "old")
+	db.Flush()
+	db.Put("user:2", "alice")
+	db.Flush()
+
+	// the rows are cached before the compaction changes both keys
+	for i := 0; i < 2; i++ {
+		if val, _ := db.Get("session:1"); val != "token" {
+			t.Fatalf("session:1 = %q", val)
+		}
+		if val, _ := db.Get("user:1"); val != "old" {
+			t.Fatalf("user:1 = %q", val)
+		}
+	}
+
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get("session:1"); err == nil {
+		t.Fatal("session:1 still cached after the compaction removed it")
+	}
+	if val, _ := db.Get("user:1"); val != "new" {
+		t.Fatalf("user:1 = %q after the compaction changed it", val)
+	}
+}
+
+func TestRowCacheUnrelatedFlush(t *testing.T) {
+	db, err := quelldb.Open(t.TempDir(), &quelldb.Options{RowCacheBytes: 1 << 20, CompactLimit: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Put("a", "1")
+	db.Flush()
+	db.Get("a")
+
+	// flushes of other keys keep the row
+	for i := 0; i < 3; i++ {
+		db.Put("z", "1")
+		db.Flush()
+	}
+	before := db.RowCacheStats()
+	if val, _ := db.Get("a"); val != "1" {
+		t.Fatalf("a = %q", val)
+	}
+	if stats := db.RowCacheStats(); stats.Hits != before.Hits+1 || stats.Invalidations != before.Invalidations {
+		t.Fatalf("expected a hit after unrelated flushes, got %+v", stats)
+	}
+
+	// a flush holding the key drops it, however many versions later
+	db.Put("a", "2")
+	db.Flush()
+	for i := 0; i < 100; i++ {
+		db.Put("z", "1")
+		db.Flush()
+	}
+	if val, _ := db.Get("a"); val != "2" {
+		t.Fatalf("a = %q after the flush changed it", val)
+	}
+}
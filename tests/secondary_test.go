@@ -0,0 +1,130 @@
+// Copyright 2025 The QuellDB Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be found in
+// the LICENSE file.
+
+package tests
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/quellington/quelldb"
+	"github.com/quellington/quelldb/constants"
+	"github.com/quellington/quelldb/vfs"
+)
+
+func expectValues(t *testing.T, db *quelldb.DB, want map[string]string) {
+	t.Helper()
+	for k, v := range want {
+		val, err := db.Get(k)
+		if v == "" {
+			if err == nil {
+				t.Fatalf("%s = %q, want it deleted", k, val)
+			}
+			continue
+		}
+		if val != v {
+			t.Fatalf("%s = %q, want %q", k, val, v)
+		}
+	}
+}
+
+func TestSecondary(t *testing.T) {
+	dir := t.TempDir()
+	secondaryDir := filepath.Join(t.TempDir(), "secondary")
+	opts := &quelldb.Options{Logger: log.New(io.Discard, "", 0)}
+
+	primary, err := quelldb.Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primary.Close()
+	primary.Put("a", "1")
+	primary.Flush()
+	primary.Put("b", "2")
+
+	secondary, err := quelldb.OpenSecondary(dir, secondaryDir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer secondary.Close()
+	expectValues(t, secondary, map[string]string{"a": "1", "b": "2"})
+
+	// tail the WAL the primary keeps appending to
+	primary.Put("c", "3")
+	primary.Delete("a")
+	expectValues(t, secondary, map[string]string{"a": "1", "c": ""})
+	if err := secondary.TryCatchUpWithPrimary(); err != nil {
+		t.Fatal(err)
+	}
+	expectValues(t, secondary, map[string]string{"a": "", "b": "2", "c": "3"})
+
+	// flushed WALs are picked up through the manifest
+	primary.Flush()
+	primary.Put("d", "4")
+	if err := primary.CompactRange("", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := secondary.TryCatchUpWithPrimary(); err != nil {
+		t.Fatal(err)
+	}
+	expectValues(t, secondary, map[string]string{"a": "", "b": "2", "c": "3", "d": "4"})
+
+	if err := secondary.Put("e", "5"); !errors.Is(err, quelldb.ErrReadOnly) {
+		t.Fatalf("expected ErrReadOnly, got %v", err)
+	}
+	if _, err := quelldb.OpenSecondary(dir, secondaryDir, opts); !errors.Is(err, quelldb.ErrLocked) {
+		t.Fatalf("expected the secondary directory to be locked, got %v", err)
+	}
+	if err := primary.TryCatchUpWithPrimary(); err == nil {
+		t.Fatal("expected error when catching up a primary")
+	}
+}
+
+func TestSecondaryCatchUpIncomplete(t *testing.T) {
+	mem := vfs.NewMem()
+	fault := vfs.NewFault(mem)
+	logger := log.New(io.Discard, "", 0)
+	primary, err := quelldb.Open("db", &quelldb.Options{FS: mem, Logger: logger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primary.Close()
+	primary.Put("a", "1")
+
+	secondary, err := quelldb.OpenSecondary("db", "secondary", &quelldb.Options{FS: fault, Logger: logger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer secondary.Close()
+
+	// the primary flushes whenever the secondary reads a WAL, so every
+	// attempt finds a new manifest afterwards
+	flushes := 0
+	fault.SetInjector(func(op vfs.Op, name string) error {
+		if op == vfs.OpOpen && strings.HasSuffix(name, constants.LOG_FILE_SUFFIX) {
+			flushes++
+			primary.Put(fmt.Sprintf("k%d", flushes), "v")
+			primary.Flush()
+		}
+		return nil
+	})
+	if err := secondary.TryCatchUpWithPrimary(); !errors.Is(err, quelldb.ErrCatchUpIncomplete) {
+		t.Fatalf("expected ErrCatchUpIncomplete, got %v", err)
+	}
+
+	fault.SetInjector(nil)
+	if err := secondary.TryCatchUpWithPrimary(); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"a": "1"}
+	for i := 1; i <= flushes; i++ {
+		want[fmt.Sprintf("k%d", i)] = "v"
+	}
+	expectValues(t, secondary, want)
+}
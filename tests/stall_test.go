@@ -0,0 +1,218 @@
+// Copyright 2025 The QuellDB Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be found in
+// the LICENSE file.
+
+package tests
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/quellington/quelldb"
+	"github.com/quellington/quelldb/constants"
+	"github.com/quellington/quelldb/vfs"
+)
+
+// gateFilter holds compactions until release is closed.
+type gateFilter struct {
+	release chan struct{}
+}
+
+func (gateFilter) Name() string { return "gate" }
+
+func (f gateFilter) Filter(ctx quelldb.CompactionFilterContext, key, value string) (quelldb.CompactionDecision, string) {
+	<-f.release
+	return quelldb.CompactionKeep, ""
+}
+
+func TestWriteStallStop(t *testing.T) {
+	events := make(chan quelldb.WriteStallInfo, 4)
+	gate := gateFilter{release: make(chan struct{})}
+	db, err := quelldb.Open(t.TempDir(), &quelldb.Options{
+		CompactLimit:        2,
+		L0StopWritesTrigger: 2,
+		MergeOperator:       counterOperator{},
+		CompactionFilter:    gate,
+		OnWriteStall: func(info quelldb.WriteStallInfo) {
+			events <- info
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 2; i++ {
+		if err := db.Put("a", "1"); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put("z", "1"); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case info := <-events:
+		if info.Condition != quelldb.WriteStallStopped || info.Cause != quelldb.WriteStallCauseL0Files {
+			t.Fatalf("unexpected stall event: %+v", info)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no stall event")
+	}
+
+	// the compaction started by the stopped write is held at the gate
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := db.PutContext(ctx, "b", "2"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline error, got %v", err)
+	}
+	// every write method has a variant giving up at the stop trigger
+	writes := map[string]func() error{
+		"DeleteContext":   func() error { return db.DeleteContext(ctx, "a") },
+		"PutBatchContext": func() error { return db.PutBatchContext(ctx, map[string]string{"b": "2"}) },
+		"MergeContext":    func() error { return db.MergeContext(ctx, "n", "1") },
+		"PutTTLContext":   func() error { return db.PutTTLContext(ctx, "b", "2", time.Minute) },
+	}
+	for name, write := range writes {
+		if err := write(); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("%s: expected deadline error, got %v", name, err)
+		}
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- db.Put("c", "3")
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("write passed the stop trigger: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(gate.release)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("write still stalled after compaction")
+	}
+
+	// the events arrive in the order the condition changed
+	select {
+	case info := <-events:
+		if info.Condition != quelldb.WriteStallNormal || info.Previous != quelldb.WriteStallStopped {
+			t.Fatalf("unexpected stall event: %+v", info)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no event for the cleared stall")
+	}
+
+	stats := db.WriteStallStats()
+	if stats.Condition != quelldb.WriteStallNormal || stats.StoppedWrites == 0 || stats.StopDuration <= 0 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestWriteStallStopBelowCompactLimit(t *testing.T) {
+	db, err := quelldb.Open(t.TempDir(), &quelldb.Options{
+		CompactLimit:        4,
+		L0StopWritesTrigger: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Put("a", "1")
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// no compaction is due, yet the stopped write must not wait forever
+	done := make(chan error, 1)
+	go func() {
+		done <- db.Put("b", "2")
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("write still stalled")
+	}
+	if val, _ := db.Get("a"); val != "1" {
+		t.Fatalf("a = %q, want 1", val)
+	}
+}
+
+func TestCloseWaitsForStallHandler(t *testing.T) {
+	var delivered atomic.Bool
+	db, err := quelldb.Open(t.TempDir(), &quelldb.Options{
+		L0SlowdownWritesTrigger: 1,
+		OnWriteStall: func(info quelldb.WriteStallInfo) {
+			time.Sleep(50 * time.Millisecond)
+			delivered.Store(true)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put("a", "1")
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !delivered.Load() {
+		t.Fatal("Close returned while a stall handler was running")
+	}
+}
+
+func TestFlushExpiredAfterFailure(t *testing.T) {
+	fault := vfs.NewFault(vfs.NewMem())
+	db, err := quelldb.Open("db", &quelldb.Options{FS: fault, Logger: log.New(io.Discard, "", 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.PutTTL("a", "1", 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	// the frozen memtable outlives the failed flushes until its record
+	// is evicted, then the flush has no SSS file left to create
+	fault.SetInjector(func(op vfs.Op, name string) error {
+		if op == vfs.OpCreate && strings.HasSuffix(name, constants.SSS_SUFFIX) {
+			return vfs.ErrInjected
+		}
+		return nil
+	})
+	deadline := time.Now().Add(5 * time.Second)
+	for db.Flush() != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("expired record never evicted from the frozen memtable")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	fault.SetInjector(nil)
+
+	if ssss, _ := quelldb.LoadManifestFS(fault, "db", nil); len(ssss) != 0 {
+		t.Fatalf("expected no SSS file for expired records, got %+v", ssss)
+	}
+	if _, err := db.Get("a"); err == nil {
+		t.Fatal("a should have expired")
+	}
+}
@@ -11,7 +11,8 @@ import (
 )
 
 func TestStreamEnd(t *testing.T) {
-	db, _ := quelldb.Open("data", nil)
+	db, _ := quelldb.Open(t.TempDir(), nil)
+	defer db.Close()
 
 	id := db.Subscribe(func(e quelldb.ChangeEvent) {
 		t.Logf("[Event] %s - %s = %s", e.Type, e.Key, e.Value)
@@ -13,7 +13,8 @@ import (
 
 func TestStream(t *testing.T) {
 	t.Logf("test stream starting...")
-	db, _ := quelldb.Open("data", nil)
+	db, _ := quelldb.Open(t.TempDir(), nil)
+	defer db.Close()
 	db.Subscribe(func(e quelldb.ChangeEvent) {
 		t.Logf("[Event] %s - Key: %s, Value: %s\n", e.Type, e.Key, e.Value)
 	})
@@ -0,0 +1,95 @@
+// Copyright 2025 The QuellDB Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be found in
+// the LICENSE file.
+
+package tests
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/quellington/quelldb"
+	"github.com/quellington/quelldb/constants"
+	"github.com/quellington/quelldb/vfs"
+)
+
+func TestTableCache(t *testing.T) {
+	db, err := quelldb.Open(t.TempDir(), &quelldb.Options{MaxOpenFiles: 2, CompactLimit: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// one SSS file per flush
+	for f := 0; f < 4; f++ {
+		db.Put(fmt.Sprintf("key%d", f), fmt.Sprintf("value-%d", f))
+		db.Flush()
+	}
+
+	for round := 0; round < 3; round++ {
+		for f := 0; f < 4; f++ {
+			val, err := db.Get(fmt.Sprintf("key%d", f))
+			if err != nil || val != fmt.Sprintf("value-%d", f) {
+				t.Fatalf("key%d = %q, %v", f, val, err)
+			}
+		}
+	}
+
+	stats := db.TableCacheStats()
+	if stats.Hits == 0 || stats.Misses == 0 || stats.Evictions == 0 {
+		t.Fatalf("expected hits, misses and evictions, got %+v", stats)
+	}
+	if stats.OpenTables > 2 {
+		t.Fatalf("%d files open, MaxOpenFiles is 2", stats.OpenTables)
+	}
+
+	// compaction deletes the files, their tables leave the cache
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	db.Get("key0")
+	if stats := db.TableCacheStats(); stats.OpenTables != 1 {
+		t.Fatalf("expected only the compacted file open, got %+v", stats)
+	}
+	for f := 0; f < 4; f++ {
+		if val, _ := db.Get(fmt.Sprintf("key%d", f)); val != fmt.Sprintf("value-%d", f) {
+			t.Fatalf("key%d = %q after compaction", f, val)
+		}
+	}
+}
+
+func TestMissingTable(t *testing.T) {
+	fs := vfs.NewMem()
+	opts := &quelldb.Options{FS: fs, Logger: log.New(io.Discard, "", 0)}
+	db, err := quelldb.Open("db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put("key", "value")
+	db.Flush()
+	db.Close()
+
+	files, _ := fs.List("db")
+	for _, name := range files {
+		if strings.HasSuffix(name, constants.SSS_SUFFIX) {
+			fs.Remove(filepath.Join("db", name))
+		}
+	}
+
+	// the manifest still names the file, its loss is reported
+	db, err = quelldb.Open("db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Get("key"); err == nil || err.Error() == "key not found" {
+		t.Fatalf("Get of a key in a missing file returned %v", err)
+	}
+	if it := db.Iterator(); it.Err() == nil || it.Next() {
+		t.Fatal("iterator hides a missing file")
+	}
+}
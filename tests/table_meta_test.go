@@ -0,0 +1,122 @@
+// Copyright 2025 The QuellDB Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be found in
+// the LICENSE file.
+
+package tests
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/quellington/quelldb"
+	"github.com/quellington/quelldb/base"
+	"github.com/quellington/quelldb/constants"
+	"github.com/quellington/quelldb/vfs"
+)
+
+func TestTableMetaBlocks(t *testing.T) {
+	dir := t.TempDir()
+	db, err := quelldb.Open(dir, &quelldb.Options{PrefixExtractor: base.DelimitedPrefix(":")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put("user:1", "alice")
+	db.Put("user:2", "bob")
+	db.Put("order:1", "book")
+	db.Delete("order:2")
+	db.Flush()
+	db.Close()
+
+	files, _ := vfs.Default.List(dir)
+	var tables []string
+	for _, name := range files {
+		if strings.HasSuffix(name, constants.SSS_BOOM_FILTER_SUFFIX) {
+			t.Fatalf("filter file %s written next to the table", name)
+		}
+		if strings.HasSuffix(name, constants.SSS_SUFFIX) {
+			tables = append(tables, name)
+		}
+	}
+	if len(tables) != 1 {
+		t.Fatalf("expected one SSS file, found %v", tables)
+	}
+
+	table, err := base.OpenTableFS(vfs.Default, filepath.Join(dir, tables[0]), nil, base.TableOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.Close()
+	props, ok := table.Properties()
+	if !ok {
+		t.Fatal("no properties in the table")
+	}
+	if props.NumEntries != 4 || props.NumDeletions != 1 || props.NumDataBlocks != 1 ||
+		props.SmallestKey != "order:1" || props.LargestKey != "user:2" ||
+		props.FilterPolicy != (base.BloomFilterPolicy{}).Name() ||
+		props.PrefixExtractor != base.DelimitedPrefix(":").Name() ||
+		props.RawKeySize != 26 || props.RawValueSize != 12 ||
+		props.SmallestSeq != 1 || props.LargestSeq != 4 {
+		t.Fatalf("unexpected properties %+v", props)
+	}
+
+	keys, prefixes, err := table.LoadFilters(base.DelimitedPrefix(":"))
+	if err != nil || keys == nil || prefixes == nil {
+		t.Fatalf("filters %v, %v: %v", keys, prefixes, err)
+	}
+	if !keys.MayContain("user:1") || !prefixes.MayContain("user:") {
+		t.Fatal("embedded filters reject keys of the table")
+	}
+}
+
+// writeLegacyTable writes a table of the first SSStorage format, with its
+// records indexed by a JSON footer.
+func writeLegacyTable(fs vfs.FS, path string, data map[string]string) {
+	var buf bytes.Buffer
+	offsets := map[string]int64{}
+	for k, v := range data {
+		offsets[k] = int64(buf.Len())
+		for _, field := range []string{k, v} {
+			encoded := snappy.Encode(nil, []byte(field))
+			binary.Write(&buf, binary.LittleEndian, int32(len(encoded)))
+			buf.Write(encoded)
+		}
+	}
+	index, _ := json.Marshal(offsets)
+	buf.Write(index)
+	binary.Write(&buf, binary.LittleEndian, int32(len(index)))
+	buf.WriteString(constants.INDEX_FOOTER_NAME)
+	vfs.WriteFile(fs, path, buf.Bytes())
+}
+
+func TestLegacyFilterFile(t *testing.T) {
+	fs := vfs.NewMem()
+	writeLegacyTable(fs, "sss-00001.qldb", map[string]string{"k": "v"})
+
+	// a filter file of the first format that rules every key out
+	vfs.WriteFile(fs, "sss-00001.qldb"+constants.SSS_BOOM_FILTER_SUFFIX, make([]byte, constants.BOOM_BIT_SIZE/8+1))
+
+	table, err := base.OpenTableFS(fs, "sss-00001.qldb", nil, base.TableOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.Close()
+	if _, ok := table.Properties(); ok {
+		t.Fatal("properties reported for a table without them")
+	}
+	if entry, ok, err := table.Get("k"); err != nil || !ok || entry.Value != "v" {
+		t.Fatalf("k = %+v, %v, %v", entry, ok, err)
+	}
+
+	keys, _, err := table.LoadFilters(nil)
+	if err != nil || keys == nil {
+		t.Fatalf("filter file not read: %v", err)
+	}
+	if keys.MayContain("k") {
+		t.Fatal("filter read from somewhere else than the filter file")
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2025 The QuellDB Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be found in
+// the LICENSE file.
+
+package tests
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/quellington/quelldb"
+	"github.com/quellington/quelldb/base"
+	"github.com/quellington/quelldb/utils"
+	"github.com/quellington/quelldb/vfs"
+)
+
+func TestMemFS(t *testing.T) {
+	mem := vfs.NewMem()
+	opts := &quelldb.Options{FS: mem, Logger: log.New(io.Discard, "", 0)}
+	dir := "/db"
+
+	db, err := quelldb.Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put("a", "1")
+	db.Put("b", "2")
+	db.Flush()
+	db.Put("c", "3")
+	db.Delete("a")
+
+	if _, err := quelldb.Open(dir, opts); !errors.Is(err, quelldb.ErrLocked) {
+		t.Fatalf("expected ErrLocked, got %v", err)
+	}
+	db.Close()
+
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("in-memory database touched the disk: %v", err)
+	}
+
+	// the flushed file and the WAL survive a reopen on the same FS
+	db, err = quelldb.Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for key, want := range map[string]string{"a": "", "b": "2", "c": "3"} {
+		if val, _ := db.Get(key); val != want {
+			t.Fatalf("%s = %q, want %q", key, val, want)
+		}
+	}
+
+	ssss, err := quelldb.LoadManifestFS(mem, dir, nil)
+	if err != nil || len(ssss) != 1 {
+		t.Fatalf("expected one SSS file in the manifest, got %v (%v)", ssss, err)
+	}
+}
+
+func TestDefaultFSFunctions(t *testing.T) {
+	dir := t.TempDir()
+
+	// the functions without a file system use the OS one
+	path := filepath.Join(dir, "sss-00001.qldb")
+	if _, _, err := base.WriteSSStorage(path, map[string]string{"a": "1"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	data, err := base.ReadSSStorage(path, nil)
+	if err != nil || data["a"] != "1" {
+		t.Fatalf("read %v, %v", data, err)
+	}
+	if next, err := utils.NextSSSID(dir); err != nil || next != 2 {
+		t.Fatalf("next SSS id = %d, %v", next, err)
+	}
+
+	wal, err := base.NewWAL(filepath.Join(dir, utils.LogFileName(3)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wal.Write("PUT", "a", "1")
+	wal.Close()
+	if nums, err := utils.LogNumbers(dir); err != nil || len(nums) != 1 || nums[0] != 3 {
+		t.Fatalf("log numbers = %v, %v", nums, err)
+	}
+
+	// a filter written without a header has the size it is loaded with
+	legacy := filepath.Join(dir, "legacy.filter")
+	os.WriteFile(legacy, make([]byte, 1024/8+1), 0644)
+	if filter, err := base.LoadBloomFilter(legacy, 1024, 3); err != nil || filter.Size() != 1024 || filter.HashCount() != 3 {
+		t.Fatalf("legacy filter %v, %v", filter, err)
+	}
+}
@@ -5,6 +5,7 @@
 package quelldb
 
 import (
+	"context"
 	"time"
 
 	"github.com/quellington/quelldb/constants"
@@ -17,7 +18,33 @@ import (
 // After the TTL expires, the key-value pair will be automatically removed from the in-memory storage.
 // The function returns an error if any occurs during the write operation.
 func (db *DB) PutTTL(key, value string, ttl time.Duration) error {
-	db.memStorage.PutWithTTL(key, value, ttl)
+	return db.PutTTLContext(context.Background(), key, value, ttl)
+}
+
+// PutTTLContext stores a key-value pair with a time-to-live like PutTTL,
+// waiting for a write stall to clear like PutContext.
+func (db *DB) PutTTLContext(ctx context.Context, key, value string, ttl time.Duration) error {
+	if err := db.writable(); err != nil {
+		return err
+	}
+	if err := db.waitForWriteRoom(ctx); err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	if db.closed.Load() {
+		db.mu.Unlock()
+		return ErrClosed
+	}
+	err := db.writeWAL(constants.PUT, key, value)
+	if err == nil {
+		db.seq++
+		db.memStorage.PutWithTTL(key, value, ttl)
+	}
+	db.mu.Unlock()
+	if err != nil {
+		return err
+	}
 
 	// publish to subscribers
 	db.publish(ChangeEvent{
@@ -26,5 +53,5 @@ func (db *DB) PutTTL(key, value string, ttl time.Duration) error {
 		Value: value,
 	})
 
-	return db.wal.Write(constants.PUT, key, value)
+	return nil
 }
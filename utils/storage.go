@@ -5,23 +5,33 @@
 package utils
 
 import (
-	"os"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 
 	"github.com/quellington/quelldb/constants"
+	"github.com/quellington/quelldb/vfs"
 )
 
 // nextSSSID generates the next SSStorage ID based on existing files in the base path.
 func NextSSSID(basePath string) (int, error) {
-	files, err := os.ReadDir(basePath)
+	return NextSSSIDFS(vfs.Default, basePath)
+}
+
+// NextSSSIDFS is NextSSSID on the given file system.
+func NextSSSIDFS(fs vfs.FS, basePath string) (int, error) {
+	files, err := fs.List(basePath)
 	if err != nil {
 		return 0, err
 	}
 	maxID := 0
 	for _, f := range files {
-		if strings.HasPrefix(f.Name(), constants.SSS_PREFIX) {
-			idStr := strings.TrimSuffix(strings.TrimPrefix(f.Name(), constants.SSS_PREFIX), constants.SSS_SUFFIX)
+		if strings.HasPrefix(f, constants.SSS_PREFIX) {
+			idStr := strings.TrimSuffix(strings.TrimPrefix(f, constants.SSS_PREFIX), constants.SSS_SUFFIX)
 			id, _ := strconv.Atoi(idStr)
 			if id > maxID {
 				maxID = id
@@ -30,3 +40,96 @@ func NextSSSID(basePath string) (int, error) {
 	}
 	return maxID + 1, nil
 }
+
+// LogFileName returns the WAL file name for the given log number.
+func LogFileName(num int) string {
+	return fmt.Sprintf("%05d%s", num, constants.LOG_FILE_SUFFIX)
+}
+
+// LogNumbers returns the numbers of all WAL files in the base path, oldest first.
+func LogNumbers(basePath string) ([]int, error) {
+	return LogNumbersFS(vfs.Default, basePath)
+}
+
+// LogNumbersFS is LogNumbers on the given file system.
+func LogNumbersFS(fs vfs.FS, basePath string) ([]int, error) {
+	files, err := fs.List(basePath)
+	if err != nil {
+		return nil, err
+	}
+	var nums []int
+	for _, f := range files {
+		if !strings.HasSuffix(f, constants.LOG_FILE_SUFFIX) {
+			continue
+		}
+		num, err := strconv.Atoi(strings.TrimSuffix(f, constants.LOG_FILE_SUFFIX))
+		if err != nil {
+			continue
+		}
+		nums = append(nums, num)
+	}
+	sort.Ints(nums)
+	return nums, nil
+}
+
+// WriteFileAtomic replaces the file at path with data so that a crash leaves
+// either the old or the new contents behind, never a partial file.
+// The data is written to a temporary file, synced, renamed over path and
+// the directory is synced to persist the rename.
+func WriteFileAtomic(path string, data []byte) error {
+	return WriteFileAtomicFS(vfs.Default, path, data)
+}
+
+// WriteFileAtomicFS is WriteFileAtomic on the given file system.
+func WriteFileAtomicFS(fs vfs.FS, path string, data []byte) error {
+	tmp := path + constants.TEMP_FILE_SUFFIX
+	f, err := fs.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		fs.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		fs.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		fs.Remove(tmp)
+		return err
+	}
+	if err := fs.Rename(tmp, path); err != nil {
+		fs.Remove(tmp)
+		return err
+	}
+	return fs.Sync(filepath.Dir(path))
+}
+
+// SyncDir flushes the directory entry changes of dir to disk.
+func SyncDir(dir string) error {
+	return vfs.Default.Sync(dir)
+}
+
+// FileChecksum returns the size and the CRC-32C of the whole file.
+func FileChecksum(path string) (int64, uint32, error) {
+	return FileChecksumFS(vfs.Default, path)
+}
+
+// FileChecksumFS is FileChecksum on the given file system.
+func FileChecksumFS(fs vfs.FS, path string) (int64, uint32, error) {
+	f, err := fs.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	h := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return 0, 0, err
+	}
+	return size, h.Sum32(), nil
+}
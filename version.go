@@ -0,0 +1,98 @@
+// Copyright 2025 The QuellDB Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be found in
+// the LICENSE file.
+
+package quelldb
+
+import "github.com/quellington/quelldb/base"
+
+// version is an immutable set of live SSS files. Every manifest edit
+// installs a new version; readers and compactions pin the version they
+// started with, so the files it names are not deleted under them.
+// The reference count is guarded by db.mu.
+type version struct {
+	files []SSSMeta
+	refs  int
+	// num numbers the versions in the order they were installed
+	num uint64
+}
+
+// installVersion makes the files the current version. The database holds
+// a reference to the current version, the previous one stays alive until
+// its last reader releases it.
+// The caller must hold db.mu.
+func (db *DB) installVersion(files []SSSMeta) {
+	db.versionNum++
+	v := &version{files: files, refs: 1, num: db.versionNum}
+	if db.versions == nil {
+		db.versions = make(map[*version]bool)
+	}
+	db.versions[v] = true
+	old := db.current
+	db.current = v
+	if old != nil {
+		db.rows.advance(v.num, changedFiles(old.files, files))
+		db.unrefVersion(old)
+	} else {
+		db.rows.advance(v.num, nil)
+	}
+}
+
+// unrefVersion drops a reference and forgets the version once none is left.
+// The caller must hold db.mu.
+func (db *DB) unrefVersion(v *version) {
+	v.refs--
+	if v.refs == 0 {
+		delete(db.versions, v)
+	}
+}
+
+// pinVersion returns the current version with a reference taken for the
+// caller, who must hand it back with releaseVersion.
+func (db *DB) pinVersion() *version {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.current.refs++
+	return db.current
+}
+
+// releaseVersion hands back a version returned by pinVersion or readState.
+// Files kept only because this version still named them are deleted once
+// it is gone.
+func (db *DB) releaseVersion(v *version) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.unrefVersion(v)
+	if v.refs == 0 && db.obsoleteDeferred && !db.readOnly {
+		db.collectObsoleteFiles()
+	}
+}
+
+// readState returns the memtables, newest first, together with the pinned
+// current version. Both are taken at once, so data moved from a memtable
+// into an SSS file by a concurrent flush is seen exactly once.
+// The version must be handed back with releaseVersion.
+func (db *DB) readState() ([]*base.MemStorage, *version) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	mems := make([]*base.MemStorage, 0, len(db.immStorages)+1)
+	mems = append(mems, db.memStorage)
+	for i := len(db.immStorages) - 1; i >= 0; i-- {
+		mems = append(mems, db.immStorages[i].mem)
+	}
+	db.current.refs++
+	return mems, db.current
+}
+
+// liveFiles returns the names of the SSS files named by any live version.
+// The caller must hold db.mu.
+func (db *DB) liveFiles() map[string]bool {
+	live := make(map[string]bool)
+	for v := range db.versions {
+		for _, f := range v.files {
+			live[f.Filename] = true
+		}
+	}
+	return live
+}
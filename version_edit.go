@@ -0,0 +1,489 @@
+// Copyright 2025 The QuellDB Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be found in
+// the LICENSE file.
+
+package quelldb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"path/filepath"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/quellington/quelldb/base"
+	"github.com/quellington/quelldb/constants"
+	"github.com/quellington/quelldb/utils"
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// version edit field tags
+const (
+	tagLogNumber      = 1
+	tagNextFileNumber = 2
+	tagLastSequence   = 3
+	tagDeletedFile    = 4
+	tagNewFile        = 5
+	tagNewFileStats   = 6
+)
+
+// DeletedFile names a file removed from a level by a VersionEdit.
+type DeletedFile struct {
+	Level    int
+	Filename string
+}
+
+// VersionEdit is a single change to the set of live SSS files, recorded in
+// the manifest log. Replaying every edit of a manifest, in order, rebuilds
+// the file set together with the WAL and file number bookkeeping.
+type VersionEdit struct {
+	HasLogNumber      bool
+	LogNumber         int
+	HasNextFileNumber bool
+	NextFileNumber    int
+	HasLastSequence   bool
+	LastSequence      uint64
+	DeletedFiles      []DeletedFile
+	NewFiles          []SSSMeta
+}
+
+// SetLogNumber records the oldest WAL still needed after this edit.
+func (e *VersionEdit) SetLogNumber(num int) {
+	e.HasLogNumber, e.LogNumber = true, num
+}
+
+// SetNextFileNumber records the next unused file number.
+func (e *VersionEdit) SetNextFileNumber(num int) {
+	e.HasNextFileNumber, e.NextFileNumber = true, num
+}
+
+// SetLastSequence records the last sequence number handed out.
+func (e *VersionEdit) SetLastSequence(seq uint64) {
+	e.HasLastSequence, e.LastSequence = true, seq
+}
+
+// AddFile records a new SSS file.
+func (e *VersionEdit) AddFile(meta SSSMeta) {
+	e.NewFiles = append(e.NewFiles, meta)
+}
+
+// DeleteFile records the removal of an SSS file.
+func (e *VersionEdit) DeleteFile(meta SSSMeta) {
+	e.DeletedFiles = append(e.DeletedFiles, DeletedFile{Level: meta.Level, Filename: meta.Filename})
+}
+
+func putUvarint(buf *bytes.Buffer, v uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	buf.Write(tmp[:n])
+}
+
+func putVarString(buf *bytes.Buffer, s string) {
+	putUvarint(buf, uint64(len(s)))
+	buf.WriteString(s)
+}
+
+func getVarString(r *bytes.Reader) (string, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	}
+	if n > uint64(r.Len()) {
+		return "", fmt.Errorf("string length %d exceeds record", n)
+	}
+	b := make([]byte, n)
+	r.Read(b)
+	return string(b), nil
+}
+
+// Encode serializes the edit as a sequence of tagged fields.
+func (e *VersionEdit) Encode() []byte {
+	buf := new(bytes.Buffer)
+	if e.HasLogNumber {
+		putUvarint(buf, tagLogNumber)
+		putUvarint(buf, uint64(e.LogNumber))
+	}
+	if e.HasNextFileNumber {
+		putUvarint(buf, tagNextFileNumber)
+		putUvarint(buf, uint64(e.NextFileNumber))
+	}
+	if e.HasLastSequence {
+		putUvarint(buf, tagLastSequence)
+		putUvarint(buf, e.LastSequence)
+	}
+	for _, d := range e.DeletedFiles {
+		putUvarint(buf, tagDeletedFile)
+		putUvarint(buf, uint64(d.Level))
+		putVarString(buf, d.Filename)
+	}
+	for _, f := range e.NewFiles {
+		putUvarint(buf, tagNewFileStats)
+		putUvarint(buf, uint64(f.Level))
+		putVarString(buf, f.Filename)
+		putVarString(buf, f.MinKey)
+		putVarString(buf, f.MaxKey)
+		putUvarint(buf, uint64(f.FileSize))
+		putUvarint(buf, f.EntryCount)
+		putUvarint(buf, f.TombstoneCount)
+		putUvarint(buf, f.SmallestSeq)
+		putUvarint(buf, f.LargestSeq)
+		var created int64
+		if !f.CreatedAt.IsZero() {
+			created = f.CreatedAt.UnixNano()
+		}
+		putUvarint(buf, uint64(created))
+		putUvarint(buf, uint64(f.Checksum))
+	}
+	return buf.Bytes()
+}
+
+// DecodeVersionEdit parses an edit written by Encode.
+func DecodeVersionEdit(data []byte) (*VersionEdit, error) {
+	r := bytes.NewReader(data)
+	e := &VersionEdit{}
+	for r.Len() > 0 {
+		tag, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		switch tag {
+		case tagLogNumber:
+			v, err := binary.ReadUvarint(r)
+			if err != nil {
+				return nil, err
+			}
+			e.SetLogNumber(int(v))
+		case tagNextFileNumber:
+			v, err := binary.ReadUvarint(r)
+			if err != nil {
+				return nil, err
+			}
+			e.SetNextFileNumber(int(v))
+		case tagLastSequence:
+			v, err := binary.ReadUvarint(r)
+			if err != nil {
+				return nil, err
+			}
+			e.SetLastSequence(v)
+		case tagDeletedFile:
+			level, err := binary.ReadUvarint(r)
+			if err != nil {
+				return nil, err
+			}
+			name, err := getVarString(r)
+			if err != nil {
+				return nil, err
+			}
+			e.DeletedFiles = append(e.DeletedFiles, DeletedFile{Level: int(level), Filename: name})
+		case tagNewFile, tagNewFileStats:
+			meta, err := decodeNewFile(r, tag == tagNewFileStats)
+			if err != nil {
+				return nil, err
+			}
+			e.NewFiles = append(e.NewFiles, meta)
+		default:
+			return nil, fmt.Errorf("unknown version edit tag %d", tag)
+		}
+	}
+	return e, nil
+}
+
+// decodeNewFile reads a new file record. Records written before file
+// statistics were kept stop after the key range.
+func decodeNewFile(r *bytes.Reader, withStats bool) (SSSMeta, error) {
+	level, err := binary.ReadUvarint(r)
+	if err != nil {
+		return SSSMeta{}, err
+	}
+	meta := SSSMeta{Level: int(level)}
+	if meta.Filename, err = getVarString(r); err != nil {
+		return SSSMeta{}, err
+	}
+	if meta.MinKey, err = getVarString(r); err != nil {
+		return SSSMeta{}, err
+	}
+	if meta.MaxKey, err = getVarString(r); err != nil {
+		return SSSMeta{}, err
+	}
+	if !withStats {
+		return meta, nil
+	}
+
+	var fields [7]uint64
+	for i := range fields {
+		if fields[i], err = binary.ReadUvarint(r); err != nil {
+			return SSSMeta{}, err
+		}
+	}
+	meta.FileSize = int64(fields[0])
+	meta.EntryCount = fields[1]
+	meta.TombstoneCount = fields[2]
+	meta.SmallestSeq = fields[3]
+	meta.LargestSeq = fields[4]
+	if fields[5] != 0 {
+		meta.CreatedAt = time.Unix(0, int64(fields[5]))
+	}
+	meta.Checksum = uint32(fields[6])
+	return meta, nil
+}
+
+// manifestState is the result of replaying a manifest.
+type manifestState struct {
+	files          []SSSMeta
+	logNumber      int
+	nextFileNumber int
+	lastSequence   uint64
+}
+
+// apply folds an edit into the state. Deleted files are removed before new
+// ones are added, so an edit may move a file between levels.
+func (s *manifestState) apply(e *VersionEdit) {
+	if e.HasLogNumber {
+		s.logNumber = e.LogNumber
+	}
+	if e.HasNextFileNumber {
+		s.nextFileNumber = e.NextFileNumber
+	}
+	if e.HasLastSequence {
+		s.lastSequence = e.LastSequence
+	}
+	if len(e.DeletedFiles) > 0 {
+		deleted := make(map[string]bool)
+		for _, d := range e.DeletedFiles {
+			deleted[d.Filename] = true
+		}
+		kept := s.files[:0:0]
+		for _, f := range s.files {
+			if !deleted[f.Filename] {
+				kept = append(kept, f)
+			}
+		}
+		s.files = kept
+	}
+	s.files = append(s.files, e.NewFiles...)
+}
+
+// snapshot returns an edit that recreates the whole state on its own.
+// It starts every new manifest file.
+func (s *manifestState) snapshot() *VersionEdit {
+	e := &VersionEdit{}
+	e.SetLogNumber(s.logNumber)
+	e.SetNextFileNumber(s.nextFileNumber)
+	e.SetLastSequence(s.lastSequence)
+	e.NewFiles = append(e.NewFiles, s.files...)
+	return e
+}
+
+// encodeManifestRecord frames an edit for the manifest log as
+// [crc][len][payload][codec], with the payload compressed by codec c and
+// optionally encrypted. The codec byte is the one recorded in the trailer
+// of SSStorage blocks. The CRC-32C covers the length, the payload and the
+// codec byte.
+func encodeManifestRecord(e *VersionEdit, key []byte, c base.Compression, level int) ([]byte, error) {
+	payload, codec, err := base.Compress(e.Encode(), c, level)
+	if err != nil {
+		return nil, err
+	}
+	if key != nil {
+		payload, err = utils.Encrypt(payload, key)
+		if err != nil {
+			return nil, err
+		}
+	}
+	record := make([]byte, 8+len(payload)+1)
+	binary.LittleEndian.PutUint32(record[4:], uint32(len(payload)+1))
+	copy(record[8:], payload)
+	record[len(record)-1] = codec
+	binary.LittleEndian.PutUint32(record, crc32.Checksum(record[4:], crcTable))
+	return record, nil
+}
+
+// decodeManifestLog replays the records of a manifest log that follow the
+// header. It stops at a truncated or torn tail record and reports how many
+// bytes were valid, so a crash during an append does not hide earlier edits.
+// A checksum mismatch anywhere before the tail is reported as corruption.
+// The magic of the log tells its record format: logs written before
+// records were checksummed, or before they recorded their codec, hold
+// snappy payloads.
+func decodeManifestLog(data []byte, key []byte, magic string) (*manifestState, int, error) {
+	checksummed := magic != constants.MANIFEST_LOG_MAGIC
+	withCodec := magic == constants.MANIFEST_LOG_CODEC_MAGIC
+	header := 4
+	if checksummed {
+		header = 8
+	}
+
+	state := &manifestState{}
+	pos := 0
+	for pos+header <= len(data) {
+		n := int(binary.LittleEndian.Uint32(data[pos+header-4:]))
+		end := pos + header + n
+		if end > len(data) {
+			break
+		}
+		if checksummed && binary.LittleEndian.Uint32(data[pos:]) != crc32.Checksum(data[pos+4:end], crcTable) {
+			if end == len(data) {
+				// torn final append
+				break
+			}
+			return nil, 0, fmt.Errorf("manifest record at offset %d: checksum mismatch", pos)
+		}
+		payload := data[pos+header : end]
+		var codec byte
+		if withCodec {
+			if len(payload) == 0 {
+				return nil, 0, fmt.Errorf("manifest record at offset %d: no codec", pos)
+			}
+			payload, codec = payload[:len(payload)-1], payload[len(payload)-1]
+		}
+		var err error
+		if key != nil {
+			payload, err = utils.Decrypt(payload, key)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		var decoded []byte
+		if withCodec {
+			decoded, err = base.Decompress(payload, codec)
+		} else {
+			decoded, err = snappy.Decode(nil, payload)
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		edit, err := DecodeVersionEdit(decoded)
+		if err != nil {
+			return nil, 0, err
+		}
+		state.apply(edit)
+		pos = end
+	}
+	if pos == 0 {
+		return nil, 0, fmt.Errorf("manifest log has no intact snapshot record")
+	}
+	return state, pos, nil
+}
+
+// newFileNumber hands out the next file number shared by SSS files, WALs
+// and manifests. The caller must hold db.mu.
+func (db *DB) newFileNumber() int {
+	num := db.nextFileNum
+	db.nextFileNum++
+	return num
+}
+
+// logAndApply appends the edit to the manifest log and applies it to the
+// in-memory file set. Files the new version no longer refers to are
+// deleted afterwards. A new manifest file, starting with a snapshot of the
+// current state, is rolled over to when there is none to append to yet or
+// the current one has grown past the size limit.
+// Once Close released the manifest, edits are refused with ErrClosed.
+// The caller must hold db.mu.
+func (db *DB) logAndApply(edit *VersionEdit) error {
+	if db.released {
+		return ErrClosed
+	}
+	if db.manifestFile == nil || db.manifestSize >= db.maxManifestSize {
+		if err := db.rollManifest(); err != nil {
+			db.abandonManifest()
+			return err
+		}
+	}
+
+	edit.SetNextFileNumber(db.nextFileNum)
+	edit.SetLastSequence(db.seq)
+	record, err := encodeManifestRecord(edit, db.key, db.compression, db.compressionLevel)
+	if err != nil {
+		return err
+	}
+	if _, err := db.manifestFile.Write(record); err != nil {
+		db.abandonManifest()
+		return err
+	}
+	if err := db.manifestFile.Sync(); err != nil {
+		db.abandonManifest()
+		return err
+	}
+	db.manifestSize += int64(len(record))
+
+	state := db.manifestState()
+	state.apply(edit)
+	db.installVersion(state.files)
+	db.logNum = state.logNumber
+
+	db.advanceFallback()
+	db.collectObsoleteFiles()
+	return nil
+}
+
+// abandonManifest stops appending to the manifest after a failed write.
+// The failed edit may or may not have reached the disk, and a torn record
+// would hide every edit appended after it, so the next edit starts a new
+// manifest from the in-memory state. Until then the manifest on disk may
+// name files the in-memory state does not, and no file is collected.
+// The caller must hold db.mu.
+func (db *DB) abandonManifest() {
+	if db.manifestFile != nil {
+		db.manifestFile.Close()
+		db.manifestFile = nil
+	}
+	db.manifestDirty = true
+}
+
+// manifestState returns the current file set and bookkeeping numbers.
+// The caller must hold db.mu.
+func (db *DB) manifestState() *manifestState {
+	return &manifestState{
+		files:          append([]SSSMeta(nil), db.current.files...),
+		logNumber:      db.logNum,
+		nextFileNumber: db.nextFileNum,
+		lastSequence:   db.seq,
+	}
+}
+
+// rollManifest starts a new manifest file with a snapshot of the current
+// state and installs it crash-atomically: the manifest is written and synced
+// under its final name before CURRENT is replaced through a synced temporary
+// file and rename. The previous manifest is kept as a fallback for Open,
+// older ones are removed.
+// The caller must hold db.mu.
+func (db *DB) rollManifest() error {
+	num := db.newFileNumber()
+	filename := manifestFileName(num)
+	state := db.manifestState()
+	data, err := encodeManifestFile(state, db.key, db.compression, db.compressionLevel)
+	if err != nil {
+		return err
+	}
+
+	fullPath := filepath.Join(db.basePath, filename)
+	if err := utils.WriteFileAtomicFS(db.fs, fullPath, data); err != nil {
+		return err
+	}
+	if err := installCurrent(db.fs, db.basePath, filename); err != nil {
+		return err
+	}
+
+	f, err := db.fs.OpenAppend(fullPath)
+	if err != nil {
+		return err
+	}
+	if db.manifestFile != nil {
+		db.manifestFile.Close()
+	}
+	removeOldManifests(db.fs, db.basePath, filename, db.manifestName)
+	if db.manifestName != "" {
+		// every edit of the previous manifest is applied, it ends in the
+		// state the new one starts with
+		db.keepFallback(state)
+	} else {
+		db.fallbackFiles = nil
+	}
+	db.manifestFile, db.manifestName, db.manifestSize = f, filename, int64(len(data))
+	db.manifestDirty = false
+	return nil
+}
@@ -0,0 +1,256 @@
+// Copyright 2025 The QuellDB Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be found in
+// the LICENSE file.
+
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrInjected is returned by an operation FaultFS failed on purpose.
+var ErrInjected = errors.New("vfs: injected fault")
+
+// Op is an operation of an FS or one of its files that FaultFS can fail.
+type Op int
+
+const (
+	OpCreate Op = iota
+	OpOpen
+	OpOpenAppend
+	OpRename
+	OpRemove
+	OpList
+	OpMkdirAll
+	OpStat
+	OpLock
+	// OpSyncDir is FS.Sync, OpSync is File.Sync.
+	OpSyncDir
+	OpRead
+	OpWrite
+	OpSync
+	numOps
+)
+
+var opNames = [numOps]string{
+	"create", "open", "open-append", "rename", "remove", "list", "mkdir-all",
+	"stat", "lock", "sync-dir", "read", "write", "sync",
+}
+
+func (op Op) String() string {
+	if op < 0 || op >= numOps {
+		return fmt.Sprintf("Op(%d)", int(op))
+	}
+	return opNames[op]
+}
+
+// Injector decides whether an operation on the named file fails. It returns
+// the error to fail with, or nil to let the operation through. It may be
+// called from several goroutines at once.
+type Injector func(op Op, name string) error
+
+// FailNth returns an Injector that fails the nth operation of the given kind,
+// counting from 1, and lets every other operation through.
+func FailNth(op Op, n int) Injector {
+	var count atomic.Int64
+	return func(o Op, name string) error {
+		if o == op && count.Add(1) == int64(n) {
+			return fmt.Errorf("%s %s: %w", op, name, ErrInjected)
+		}
+		return nil
+	}
+}
+
+// FailAfter returns an Injector that lets the first n operations through and
+// fails every operation after them, like a disk that stopped responding.
+func FailAfter(n int) Injector {
+	var count atomic.Int64
+	return func(op Op, name string) error {
+		if count.Add(1) > int64(n) {
+			return fmt.Errorf("%s %s: %w", op, name, ErrInjected)
+		}
+		return nil
+	}
+}
+
+// FailRandomly returns an Injector that fails every operation with
+// probability p, drawn from rng.
+func FailRandomly(rng *rand.Rand, p float64) Injector {
+	var mu sync.Mutex
+	return func(op Op, name string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if rng.Float64() < p {
+			return fmt.Errorf("%s %s: %w", op, name, ErrInjected)
+		}
+		return nil
+	}
+}
+
+// FaultFS wraps an FS and fails the operations its Injector picks.
+// A failed write is torn: the first half of the buffer is written before
+// the error is returned. Together with MemFS.CrashClone, which drops what
+// was never synced, it covers the failures a storage engine must survive.
+type FaultFS struct {
+	fs       FS
+	injector atomic.Pointer[Injector]
+}
+
+// NewFault returns a FaultFS over fs that lets every operation through
+// until an Injector is set.
+func NewFault(fs FS) *FaultFS {
+	return &FaultFS{fs: fs}
+}
+
+// SetInjector replaces the Injector. A nil Injector lets every operation
+// through.
+func (f *FaultFS) SetInjector(in Injector) {
+	if in == nil {
+		f.injector.Store(nil)
+		return
+	}
+	f.injector.Store(&in)
+}
+
+func (f *FaultFS) inject(op Op, name string) error {
+	if in := f.injector.Load(); in != nil {
+		return (*in)(op, name)
+	}
+	return nil
+}
+
+func (f *FaultFS) Create(name string) (File, error) {
+	if err := f.inject(OpCreate, name); err != nil {
+		return nil, err
+	}
+	file, err := f.fs.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{fs: f, name: name, file: file}, nil
+}
+
+func (f *FaultFS) Open(name string) (File, error) {
+	if err := f.inject(OpOpen, name); err != nil {
+		return nil, err
+	}
+	file, err := f.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{fs: f, name: name, file: file}, nil
+}
+
+func (f *FaultFS) OpenAppend(name string) (File, error) {
+	if err := f.inject(OpOpenAppend, name); err != nil {
+		return nil, err
+	}
+	file, err := f.fs.OpenAppend(name)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{fs: f, name: name, file: file}, nil
+}
+
+func (f *FaultFS) Rename(oldname, newname string) error {
+	if err := f.inject(OpRename, oldname); err != nil {
+		return err
+	}
+	return f.fs.Rename(oldname, newname)
+}
+
+func (f *FaultFS) Remove(name string) error {
+	if err := f.inject(OpRemove, name); err != nil {
+		return err
+	}
+	return f.fs.Remove(name)
+}
+
+func (f *FaultFS) List(dir string) ([]string, error) {
+	if err := f.inject(OpList, dir); err != nil {
+		return nil, err
+	}
+	return f.fs.List(dir)
+}
+
+func (f *FaultFS) MkdirAll(dir string) error {
+	if err := f.inject(OpMkdirAll, dir); err != nil {
+		return err
+	}
+	return f.fs.MkdirAll(dir)
+}
+
+func (f *FaultFS) Stat(name string) (os.FileInfo, error) {
+	if err := f.inject(OpStat, name); err != nil {
+		return nil, err
+	}
+	return f.fs.Stat(name)
+}
+
+func (f *FaultFS) Lock(name string) (io.Closer, error) {
+	if err := f.inject(OpLock, name); err != nil {
+		return nil, err
+	}
+	return f.fs.Lock(name)
+}
+
+func (f *FaultFS) Sync(dir string) error {
+	if err := f.inject(OpSyncDir, dir); err != nil {
+		return err
+	}
+	return f.fs.Sync(dir)
+}
+
+// faultFile is a file opened through a FaultFS.
+type faultFile struct {
+	fs   *FaultFS
+	name string
+	file File
+}
+
+func (f *faultFile) Read(p []byte) (int, error) {
+	if err := f.fs.inject(OpRead, f.name); err != nil {
+		return 0, err
+	}
+	return f.file.Read(p)
+}
+
+func (f *faultFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.fs.inject(OpRead, f.name); err != nil {
+		return 0, err
+	}
+	return f.file.ReadAt(p, off)
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	if err := f.fs.inject(OpWrite, f.name); err != nil {
+		n, _ := f.file.Write(p[:len(p)/2])
+		return n, err
+	}
+	return f.file.Write(p)
+}
+
+func (f *faultFile) Sync() error {
+	if err := f.fs.inject(OpSync, f.name); err != nil {
+		return err
+	}
+	return f.file.Sync()
+}
+
+func (f *faultFile) Seek(offset int64, whence int) (int64, error) {
+	return f.file.Seek(offset, whence)
+}
+
+func (f *faultFile) Close() error {
+	return f.file.Close()
+}
+
+func (f *faultFile) Stat() (os.FileInfo, error) {
+	return f.file.Stat()
+}
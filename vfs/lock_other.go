@@ -0,0 +1,16 @@
+// Copyright 2025 The QuellDB Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be found in
+// the LICENSE file.
+
+//go:build !unix
+
+package vfs
+
+import "os"
+
+// lockFile creates the file at path and keeps it open. Advisory locks are
+// not available on this platform, so the directory is not protected
+// against a second process.
+func lockFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+}
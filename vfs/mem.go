@@ -0,0 +1,440 @@
+// Copyright 2025 The QuellDB Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be found in
+// the LICENSE file.
+
+package vfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemFS is an FS that keeps every file in memory. It is safe for
+// concurrent use and meant for tests and embedded databases that must not
+// touch the disk.
+// MemFS tracks what has been synced the way a disk would, so CrashClone
+// can show what a power loss leaves behind.
+type MemFS struct {
+	mu    sync.Mutex
+	files map[string]*memNode
+	dirs  map[string]bool
+	locks map[string]bool
+
+	// syncedFiles holds the directory entries as of the last Sync of
+	// their directory
+	syncedFiles map[string]*memNode
+}
+
+// memNode is the content of an in-memory file, shared by its open handles.
+// synced is the content as of the last File.Sync.
+type memNode struct {
+	data    []byte
+	synced  []byte
+	modTime time.Time
+}
+
+// NewMem returns an empty in-memory FS. Its root directory exists.
+func NewMem() *MemFS {
+	return &MemFS{
+		files: make(map[string]*memNode),
+		dirs:  map[string]bool{"/": true, ".": true},
+		locks: make(map[string]bool),
+
+		syncedFiles: make(map[string]*memNode),
+	}
+}
+
+func memPath(name string) string {
+	return filepath.Clean(name)
+}
+
+// parentExists reports whether the directory of a path exists.
+// The caller must hold m.mu.
+func (m *MemFS) parentExists(name string) bool {
+	return m.dirs[filepath.Dir(name)]
+}
+
+func (m *MemFS) Create(name string) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = memPath(name)
+	if !m.parentExists(name) {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: fs.ErrNotExist}
+	}
+	if m.dirs[name] {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: errors.New("is a directory")}
+	}
+	node := &memNode{modTime: time.Now()}
+	m.files[name] = node
+	return &memFile{fs: m, name: name, node: node, write: true}, nil
+}
+
+func (m *MemFS) Open(name string) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = memPath(name)
+	node, ok := m.files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return &memFile{fs: m, name: name, node: node}, nil
+}
+
+func (m *MemFS) OpenAppend(name string) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = memPath(name)
+	node, ok := m.files[name]
+	if !ok {
+		if !m.parentExists(name) {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+		node = &memNode{modTime: time.Now()}
+		m.files[name] = node
+	}
+	return &memFile{fs: m, name: name, node: node, write: true, append: true, pos: int64(len(node.data))}, nil
+}
+
+func (m *MemFS) Rename(oldname, newname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	oldname, newname = memPath(oldname), memPath(newname)
+	node, ok := m.files[oldname]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: fs.ErrNotExist}
+	}
+	if !m.parentExists(newname) {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: fs.ErrNotExist}
+	}
+	delete(m.files, oldname)
+	m.files[newname] = node
+	return nil
+}
+
+func (m *MemFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = memPath(name)
+	if _, ok := m.files[name]; ok {
+		delete(m.files, name)
+		return nil
+	}
+	if m.dirs[name] {
+		if len(m.children(name)) > 0 {
+			return &fs.PathError{Op: "remove", Path: name, Err: errors.New("directory not empty")}
+		}
+		delete(m.dirs, name)
+		return nil
+	}
+	return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+}
+
+// children returns the names of the entries of a directory.
+// The caller must hold m.mu.
+func (m *MemFS) children(dir string) []string {
+	var names []string
+	for name := range m.files {
+		if filepath.Dir(name) == dir {
+			names = append(names, filepath.Base(name))
+		}
+	}
+	for name := range m.dirs {
+		if name != dir && filepath.Dir(name) == dir {
+			names = append(names, filepath.Base(name))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (m *MemFS) List(dir string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dir = memPath(dir)
+	if !m.dirs[dir] {
+		return nil, &fs.PathError{Op: "open", Path: dir, Err: fs.ErrNotExist}
+	}
+	return m.children(dir), nil
+}
+
+func (m *MemFS) MkdirAll(dir string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for dir = memPath(dir); !m.dirs[dir]; dir = filepath.Dir(dir) {
+		if _, ok := m.files[dir]; ok {
+			return &fs.PathError{Op: "mkdir", Path: dir, Err: errors.New("not a directory")}
+		}
+		m.dirs[dir] = true
+	}
+	return nil
+}
+
+func (m *MemFS) Stat(name string) (os.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = memPath(name)
+	if node, ok := m.files[name]; ok {
+		return &memFileInfo{name: filepath.Base(name), size: int64(len(node.data)), modTime: node.modTime}, nil
+	}
+	if m.dirs[name] {
+		return &memFileInfo{name: filepath.Base(name), dir: true}, nil
+	}
+	return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+}
+
+func (m *MemFS) Lock(name string) (io.Closer, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = memPath(name)
+	if m.locks[name] {
+		return nil, ErrLockHeld
+	}
+	if _, ok := m.files[name]; !ok {
+		if !m.parentExists(name) {
+			return nil, &fs.PathError{Op: "lock", Path: name, Err: fs.ErrNotExist}
+		}
+		m.files[name] = &memNode{modTime: time.Now()}
+	}
+	m.locks[name] = true
+	return &memLock{fs: m, name: name}, nil
+}
+
+func (m *MemFS) Sync(dir string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dir = memPath(dir)
+	if !m.dirs[dir] {
+		return &fs.PathError{Op: "sync", Path: dir, Err: fs.ErrNotExist}
+	}
+	for name := range m.syncedFiles {
+		if filepath.Dir(name) == dir {
+			delete(m.syncedFiles, name)
+		}
+	}
+	for name, node := range m.files {
+		if filepath.Dir(name) == dir {
+			m.syncedFiles[name] = node
+		}
+	}
+	return nil
+}
+
+// CrashClone returns a copy of the FS as a power loss would leave it behind:
+// every file holds the data synced with File.Sync, and a directory holds the
+// entries as of its last Sync. Locks are released. Directories are never
+// lost.
+// With a random source the crash is less tidy, as on a real disk: an entry
+// created, renamed or removed since the last Sync of its directory survives
+// at random, and a file keeps a random part of the data appended since its
+// last sync, possibly ending in the middle of a write.
+func (m *MemFS) CrashClone(rng *rand.Rand) *MemFS {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c := NewMem()
+	for dir := range m.dirs {
+		c.dirs[dir] = true
+	}
+
+	// visit the names in order, so a seeded source gives the same crash
+	seen := make(map[string]bool)
+	var names []string
+	for _, entries := range []map[string]*memNode{m.files, m.syncedFiles} {
+		for name := range entries {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		node := m.syncedFiles[name]
+		if current := m.files[name]; current != node && rng != nil && rng.Intn(2) == 0 {
+			node = current
+		}
+		if node == nil {
+			continue
+		}
+
+		data := node.synced
+		if unsynced := len(node.data) - len(node.synced); rng != nil && unsynced > 0 && bytes.HasPrefix(node.data, node.synced) {
+			data = node.data[:len(node.synced)+rng.Intn(unsynced+1)]
+		}
+		data = append([]byte(nil), data...)
+		clone := &memNode{data: data, synced: data, modTime: node.modTime}
+		c.files[name] = clone
+		c.syncedFiles[name] = clone
+	}
+	return c
+}
+
+// String lists the files of the FS with their sizes, for debugging.
+func (m *MemFS) String() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := make([]string, 0, len(m.files))
+	for name, node := range m.files {
+		names = append(names, fmt.Sprintf("%s (%d bytes)", name, len(node.data)))
+	}
+	sort.Strings(names)
+	return strings.Join(names, "\n")
+}
+
+// memLock releases a lock taken with MemFS.Lock.
+type memLock struct {
+	fs   *MemFS
+	name string
+	once sync.Once
+}
+
+func (l *memLock) Close() error {
+	l.once.Do(func() {
+		l.fs.mu.Lock()
+		delete(l.fs.locks, l.name)
+		l.fs.mu.Unlock()
+	})
+	return nil
+}
+
+// memFile is an open handle of an in-memory file.
+type memFile struct {
+	fs     *MemFS
+	name   string
+	node   *memNode
+	pos    int64
+	write  bool
+	append bool
+	closed bool
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if f.pos >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[f.pos:])
+	f.pos += int64(n)
+	return n, nil
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if off < 0 {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: errors.New("negative offset")}
+	}
+	if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if !f.write {
+		return 0, &fs.PathError{Op: "write", Path: f.name, Err: errors.New("file opened for reading")}
+	}
+	if f.append {
+		f.pos = int64(len(f.node.data))
+	}
+	if end := f.pos + int64(len(p)); end > int64(len(f.node.data)) {
+		f.node.data = append(f.node.data, make([]byte, end-int64(len(f.node.data)))...)
+	}
+	copy(f.node.data[f.pos:], p)
+	f.pos += int64(len(p))
+	f.node.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += int64(len(f.node.data))
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: errors.New("negative position")}
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+func (f *memFile) Close() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	return nil
+}
+
+func (f *memFile) Sync() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.node.synced = append(f.node.synced[:0:0], f.node.data...)
+	return nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	return &memFileInfo{name: filepath.Base(f.name), size: int64(len(f.node.data)), modTime: f.node.modTime}, nil
+}
+
+// memFileInfo describes an in-memory file or directory.
+type memFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (fi *memFileInfo) Name() string       { return fi.name }
+func (fi *memFileInfo) Size() int64        { return fi.size }
+func (fi *memFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *memFileInfo) IsDir() bool        { return fi.dir }
+func (fi *memFileInfo) Sys() any           { return nil }
+
+func (fi *memFileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
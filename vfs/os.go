@@ -0,0 +1,68 @@
+// Copyright 2025 The QuellDB Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be found in
+// the LICENSE file.
+
+package vfs
+
+import (
+	"io"
+	"os"
+	"sort"
+)
+
+// OS is the FS of the operating system.
+type OS struct{}
+
+func (OS) Create(name string) (File, error) {
+	return os.Create(name)
+}
+
+func (OS) Open(name string) (File, error) {
+	return os.Open(name)
+}
+
+func (OS) OpenAppend(name string) (File, error) {
+	return os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+}
+
+func (OS) Rename(oldname, newname string) error {
+	return os.Rename(oldname, newname)
+}
+
+func (OS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (OS) List(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(entries))
+	for i, e := range entries {
+		names[i] = e.Name()
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (OS) MkdirAll(dir string) error {
+	return os.MkdirAll(dir, 0755)
+}
+
+func (OS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (OS) Lock(name string) (io.Closer, error) {
+	return lockFile(name)
+}
+
+func (OS) Sync(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
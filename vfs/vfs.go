@@ -0,0 +1,82 @@
+// Copyright 2025 The QuellDB Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be found in
+// the LICENSE file.
+
+// Package vfs abstracts the file system QuellDB stores its files in.
+package vfs
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// ErrLockHeld is returned by Lock when the lock is held elsewhere.
+var ErrLockHeld = errors.New("lock held by another process")
+
+// File is an open file of an FS.
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.Seeker
+	io.Closer
+
+	// Sync flushes the written data to stable storage.
+	Sync() error
+	// Stat describes the file.
+	Stat() (os.FileInfo, error)
+}
+
+// FS is the file system a database keeps its files in.
+type FS interface {
+	// Create creates the named file for writing, truncating it if it exists.
+	Create(name string) (File, error)
+	// Open opens the named file for reading.
+	Open(name string) (File, error)
+	// OpenAppend opens the named file for appending, creating it if needed.
+	OpenAppend(name string) (File, error)
+	// Rename atomically replaces newname with oldname.
+	Rename(oldname, newname string) error
+	// Remove removes the named file or empty directory.
+	Remove(name string) error
+	// List returns the names of the entries of a directory, sorted.
+	List(dir string) ([]string, error)
+	// MkdirAll creates a directory together with any missing parents.
+	MkdirAll(dir string) error
+	// Stat describes the named file or directory.
+	Stat(name string) (os.FileInfo, error)
+	// Lock takes an exclusive lock on the named file, creating it if needed.
+	// The lock is held until the returned closer is closed, ErrLockHeld is
+	// returned while it is held elsewhere.
+	Lock(name string) (io.Closer, error)
+	// Sync persists the creation, removal and renaming of the entries of
+	// a directory.
+	Sync(dir string) error
+}
+
+// Default is the file system of the operating system.
+var Default FS = OS{}
+
+// ReadFile reads the whole named file.
+func ReadFile(fs FS, name string) ([]byte, error) {
+	f, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// WriteFile creates the named file holding data. The data is not synced.
+func WriteFile(fs FS, name string, data []byte) error {
+	f, err := fs.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
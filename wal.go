@@ -0,0 +1,34 @@
+// Copyright 2025 The QuellDB Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be found in
+// the LICENSE file.
+
+package quelldb
+
+import "fmt"
+
+// writeWAL appends a single record to the WAL, see writeWALLines.
+// The caller must hold db.mu.
+func (db *DB) writeWAL(op, key, value string) error {
+	return db.writeWALLines([]string{fmt.Sprintf("%s|%s|%s\n", op, key, value)})
+}
+
+// writeWALLines appends records to the WAL and syncs it when
+// Options.SyncWrites is set. A failed write may leave part of a record
+// behind, which would swallow every record appended after it, so once a
+// write fails the WAL takes no more records until Flush switches to a
+// fresh one.
+// The caller must hold db.mu.
+func (db *DB) writeWALLines(lines []string) error {
+	if db.walErr != nil {
+		return db.walErr
+	}
+	err := db.wal.WriteLines(lines)
+	if err == nil && db.syncWrites {
+		err = db.wal.Sync()
+	}
+	if err != nil {
+		db.walErr = fmt.Errorf("quelldb: WAL write failed, writes resume after Flush: %w", err)
+		return db.walErr
+	}
+	return nil
+}
@@ -6,42 +6,79 @@ package quelldb
 
 import (
 	"bufio"
+	"io"
 	"os"
 	"strings"
 
+	"github.com/quellington/quelldb/base"
 	"github.com/quellington/quelldb/constants"
 )
 
-// Put stores a key-value pair in the database.
-// It first stores the pair in memory and then writes it to the WAL.
-// The function takes a key and a value as parameters.
-func (db *DB) replayWAL(path string) error {
-	file, err := os.Open(path)
+// replayWAL applies the records of a WAL to the mutable memtable.
+// A crash can leave the last record torn, without its line end. It is
+// skipped and replayWAL reports false, new records must not be appended
+// after it.
+func (db *DB) replayWAL(path string) (bool, error) {
+	offset, err := db.tailWAL(path, db.memStorage, 0)
 	if err != nil {
-
 		if os.IsNotExist(err) {
-			return nil
+			return true, nil
 		}
-		return err
+		return false, err
 	}
-	defer file.Close()
+	stat, err := db.fs.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	return offset == stat.Size(), nil
+}
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		parts := strings.SplitN(line, "|", 3)
+// tailWAL applies the records of a WAL that follow the given offset to mem
+// and returns the offset after the last complete record. A record still
+// being appended, without its line end yet, is left for the next call.
+func (db *DB) tailWAL(path string, mem *base.MemStorage, offset int64) (int64, error) {
+	file, err := db.fs.Open(path)
+	if err != nil {
+		return offset, err
+	}
+	defer file.Close()
 
-		// skip empty lines or lines that don't have exact parts
-		if len(parts) != 3 {
-			continue
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return offset, err
+	}
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			return offset, nil
+		}
+		if err != nil {
+			return offset, err
 		}
-		op, key, val := parts[0], parts[1], parts[2]
-		switch op {
-		case constants.GET:
-			db.memStorage.Put(key, val)
-		case constants.DELETE:
-			db.memStorage.Delete(key)
+		if err := db.applyWALRecord(mem, strings.TrimSuffix(line, "\n")); err != nil {
+			return offset, err
 		}
+		offset += int64(len(line))
+	}
+}
+
+// applyWALRecord applies a single WAL line to mem.
+func (db *DB) applyWALRecord(mem *base.MemStorage, line string) error {
+	parts := strings.SplitN(line, "|", 3)
+
+	// skip empty lines or lines that don't have exact parts
+	if len(parts) != 3 {
+		return nil
+	}
+	op, key, val := parts[0], parts[1], parts[2]
+	db.seq++
+	switch op {
+	case constants.PUT:
+		mem.Put(key, val)
+	case constants.DELETE:
+		mem.Delete(key)
+	case constants.MERGE:
+		return db.applyMerge(mem, key, val)
 	}
-	return scanner.Err()
+	return nil
 }